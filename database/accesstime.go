@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tg123/sshpiper/libplugin"
+)
+
+// accessTimeError rejects a downstream outside its validity period or access windows,
+// the message is shown to the user in the banner
+type accessTimeError struct {
+	reason string
+}
+
+func (e *accessTimeError) Error() string {
+	return e.reason
+}
+
+// accessWindow allows access on days from start to end, minutes since midnight.
+// A window with end before start spans midnight into the next day.
+type accessWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseAccessWindows parses ; separated windows such as "Mon-Fri 08:00-18:00; Sat,Sun 10:00-12:00"
+func parseAccessWindows(s string) ([]accessWindow, error) {
+	var windows []accessWindow
+
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		days, hours, ok := strings.Cut(spec, " ")
+		if !ok {
+			return nil, fmt.Errorf("access window %q: expected days and hours", spec)
+		}
+
+		w := accessWindow{}
+
+		for _, r := range strings.Split(days, ",") {
+			from, to, isRange := strings.Cut(r, "-")
+			first, ok := weekdayNames[strings.ToLower(from)]
+			if !ok {
+				return nil, fmt.Errorf("access window %q: unknown day %v", spec, from)
+			}
+
+			last := first
+			if isRange {
+				if last, ok = weekdayNames[strings.ToLower(to)]; !ok {
+					return nil, fmt.Errorf("access window %q: unknown day %v", spec, to)
+				}
+			}
+
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+
+		start, end, ok := strings.Cut(strings.TrimSpace(hours), "-")
+		if !ok {
+			return nil, fmt.Errorf("access window %q: expected hh:mm-hh:mm", spec)
+		}
+
+		var err error
+		if w.start, err = parseClock(start); err != nil {
+			return nil, fmt.Errorf("access window %q: %w", spec, err)
+		}
+
+		if w.end, err = parseClock(end); err != nil {
+			return nil, fmt.Errorf("access window %q: %w", spec, err)
+		}
+
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+func parseClock(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %v", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *accessWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+
+	// spans midnight, the part after midnight belongs to the previous day's window
+	yesterday := (day + 6) % 7
+	return (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// checkAccessTime returns an accessTimeError if the downstream of pipe may not log in at now
+func checkAccessTime(pipe *pipeConfig, now time.Time) error {
+	if pipe.ValidFrom != nil && now.Before(*pipe.ValidFrom) {
+		return &accessTimeError{fmt.Sprintf("access for %v is not valid before %v", pipe.Username, pipe.ValidFrom.Format(time.RFC3339))}
+	}
+
+	if pipe.ValidUntil != nil && !now.Before(*pipe.ValidUntil) {
+		return &accessTimeError{fmt.Sprintf("access for %v expired at %v", pipe.Username, pipe.ValidUntil.Format(time.RFC3339))}
+	}
+
+	if len(pipe.AccessWindows) == 0 {
+		return nil
+	}
+
+	local := now.In(pipe.AccessLocation)
+	for i := range pipe.AccessWindows {
+		if pipe.AccessWindows[i].contains(local) {
+			return nil
+		}
+	}
+
+	return &accessTimeError{fmt.Sprintf("access for %v is outside the allowed hours %v (%v)", pipe.Username, pipe.AccessWindowsSpec, pipe.AccessLocation)}
+}
+
+// accessTimeBanner explains why the downstream of conn may not log in now, empty if it may
+func (p *plugin) accessTimeBanner(conn libplugin.ConnMetadata) string {
+	_, err := p.loadPipeFromDB(conn)
+
+	var denied *accessTimeError
+	if errors.As(err, &denied) {
+		return denied.reason + "\n"
+	}
+
+	return ""
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessWindows(t *testing.T) {
+	windows, err := parseAccessWindows("Mon-Fri 08:00-18:00; Sat,Sun 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2026-10-19 is a Monday
+	for _, tc := range []struct {
+		at   string
+		want bool
+	}{
+		{"2026-10-19T08:00:00Z", true},
+		{"2026-10-19T17:59:00Z", true},
+		{"2026-10-19T18:00:00Z", false},
+		{"2026-10-19T07:59:00Z", false},
+		{"2026-10-24T23:00:00Z", true},  // Saturday night
+		{"2026-10-25T01:30:00Z", true},  // after midnight of Saturday's window
+		{"2026-10-26T01:30:00Z", true},  // after midnight of Sunday's window
+		{"2026-10-27T01:30:00Z", false}, // Tuesday night
+	} {
+		at, _ := time.Parse(time.RFC3339, tc.at)
+
+		got := false
+		for i := range windows {
+			got = got || windows[i].contains(at)
+		}
+
+		if got != tc.want {
+			t.Errorf("%v: expected %v, got %v", tc.at, tc.want, got)
+		}
+	}
+
+	for _, invalid := range []string{"Mon", "Funday 08:00-18:00", "Mon 8-18", "Mon 08:00-25:00"} {
+		if _, err := parseAccessWindows(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestAccessTimeEnforced(t *testing.T) {
+	p := newTestPlugin(t)
+
+	until := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := p.db.Create(&downstream{
+		Username:       "contractor",
+		ValidUntil:     &until,
+		AccessWindows:  "Mon-Fri 09:00-17:00",
+		AccessTimezone: "Europe/Berlin",
+		Upstream:       upstream{Server: server{Address: "host:22"}},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &testConn{user: "contractor"}
+
+	for _, tc := range []struct {
+		now    time.Time
+		reason string
+	}{
+		{time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC), ""},
+		{time.Date(2026, 10, 19, 16, 0, 0, 0, time.UTC), "outside the allowed hours"},
+		{time.Date(2026, 11, 2, 10, 0, 0, 0, time.UTC), "expired"},
+	} {
+		p.now = func() time.Time { return tc.now }
+
+		_, err := p.loadPipeFromDB(conn)
+		banner := p.accessTimeBanner(conn)
+
+		if tc.reason == "" {
+			if err != nil || banner != "" {
+				t.Errorf("%v: expected access, got %v, %q", tc.now, err, banner)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(banner, tc.reason) {
+			t.Errorf("%v: expected %q, got %v, %q", tc.now, tc.reason, err, banner)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/sshpiper/libplugin"
+	"gorm.io/gorm"
+)
+
+const (
+	auditNewConnection      = "new_connection"
+	auditAuthSuccess        = "auth_success"
+	auditAuthFailure        = "auth_failure"
+	auditUpstreamAuthFailed = "upstream_auth_failure"
+	auditPipeStart          = "pipe_start"
+	auditPipeError          = "pipe_error"
+	auditDisconnect         = "disconnect"
+	auditHostKeyRecorded    = "host_key_recorded"
+	auditHostKeyMismatch    = "host_key_mismatch"
+)
+
+// auditLog writes audit events in batches from a background goroutine, events
+// are dropped when the buffer is full so the ssh handshake never waits for the database
+type auditLog struct {
+	db            *gorm.DB
+	batchSize     int
+	flushInterval time.Duration
+
+	events    chan auditEvent
+	upstreams *cache.Cache // conn unique id -> upstream user@host:port
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newAuditLog(db *gorm.DB, batchSize int, flushInterval time.Duration) *auditLog {
+	batchSize = max(batchSize, 1)
+
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	a := &auditLog{
+		db:            db,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		events:        make(chan auditEvent, batchSize*10),
+		upstreams:     cache.New(10*time.Minute, 10*time.Minute),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	go a.run()
+
+	return a
+}
+
+// record queues an event of conn, a nil auditLog records nothing
+func (a *auditLog) record(event string, conn libplugin.ConnMetadata, method string, err error) {
+	if a == nil {
+		return
+	}
+
+	e := auditEvent{
+		CreatedAt:  time.Now(),
+		Event:      event,
+		ConnID:     conn.UniqueID(),
+		RemoteAddr: conn.RemoteAddr(),
+		Username:   conn.User(),
+		AuthMethod: method,
+	}
+
+	if u, found := a.upstreams.Get(conn.UniqueID()); found {
+		e.Upstream = u.(string)
+	}
+
+	if err != nil {
+		e.Error = truncate(err.Error(), 255)
+	}
+
+	a.enqueue(e)
+}
+
+func (a *auditLog) enqueue(e auditEvent) {
+	select {
+	case a.events <- e:
+	default:
+		log.Warnf("audit log buffer full, dropped %v event for %v", e.Event, e.RemoteAddr)
+	}
+}
+
+func (a *auditLog) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]auditEvent, 0, a.batchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := a.db.CreateInBatches(batch, a.batchSize).Error; err != nil {
+			log.Errorf("failed to write %v audit events: %v", len(batch), err)
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case e := <-a.events:
+			batch = append(batch, e)
+			if len(batch) >= a.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-a.stop:
+			for len(a.events) > 0 {
+				batch = append(batch, <-a.events)
+			}
+
+			flush()
+			return
+		}
+	}
+}
+
+// close writes pending events and stops the writer
+func (a *auditLog) close() {
+	a.closeOnce.Do(func() {
+		close(a.stop)
+	})
+
+	<-a.done
+}
+
+// instrument records the events of all connections handled by config
+func (a *auditLog) instrument(config *libplugin.SshPiperPluginConfig) {
+	originNewConnection := config.NewConnectionCallback
+
+	config.NewConnectionCallback = func(conn libplugin.ConnMetadata) error {
+		a.record(auditNewConnection, conn, "", nil)
+
+		if originNewConnection != nil {
+			return originNewConnection(conn)
+		}
+
+		return nil
+	}
+
+	if originPassword := config.PasswordCallback; originPassword != nil {
+		config.PasswordCallback = func(conn libplugin.ConnMetadata, password []byte) (*libplugin.Upstream, error) {
+			u, err := originPassword(conn, password)
+			a.auth(conn, "password", u, err)
+			return u, err
+		}
+	}
+
+	if originPublicKey := config.PublicKeyCallback; originPublicKey != nil {
+		config.PublicKeyCallback = func(conn libplugin.ConnMetadata, key []byte) (*libplugin.Upstream, error) {
+			u, err := originPublicKey(conn, key)
+			a.auth(conn, "publickey", u, err)
+			return u, err
+		}
+	}
+
+	if originKeyboardInteractive := config.KeyboardInteractiveCallback; originKeyboardInteractive != nil {
+		config.KeyboardInteractiveCallback = func(conn libplugin.ConnMetadata, client libplugin.KeyboardInteractiveChallenge) (*libplugin.Upstream, error) {
+			u, err := originKeyboardInteractive(conn, client)
+			a.auth(conn, "keyboard-interactive", u, err)
+			return u, err
+		}
+	}
+
+	originUpstreamAuthFailure := config.UpstreamAuthFailureCallback
+
+	config.UpstreamAuthFailureCallback = func(conn libplugin.ConnMetadata, method string, err error, allowmethods []string) {
+		a.record(auditUpstreamAuthFailed, conn, method, err)
+
+		if originUpstreamAuthFailure != nil {
+			originUpstreamAuthFailure(conn, method, err, allowmethods)
+		}
+	}
+
+	originPipeStart := config.PipeStartCallback
+
+	config.PipeStartCallback = func(conn libplugin.ConnMetadata) {
+		a.record(auditPipeStart, conn, "", nil)
+
+		if originPipeStart != nil {
+			originPipeStart(conn)
+		}
+	}
+
+	originPipeCreateError := config.PipeCreateErrorCallback
+
+	config.PipeCreateErrorCallback = func(remoteAddr string, err error) {
+		e := auditEvent{
+			CreatedAt:  time.Now(),
+			Event:      auditPipeError,
+			RemoteAddr: remoteAddr,
+		}
+
+		if err != nil {
+			e.Error = truncate(err.Error(), 255)
+		}
+
+		a.enqueue(e)
+
+		if originPipeCreateError != nil {
+			originPipeCreateError(remoteAddr, err)
+		}
+	}
+
+	originPipeError := config.PipeErrorCallback
+
+	config.PipeErrorCallback = func(conn libplugin.ConnMetadata, err error) {
+		a.record(auditDisconnect, conn, "", err)
+		a.upstreams.Delete(conn.UniqueID())
+
+		if originPipeError != nil {
+			originPipeError(conn, err)
+		}
+	}
+}
+
+func (a *auditLog) auth(conn libplugin.ConnMetadata, method string, u *libplugin.Upstream, err error) {
+	// the target menu follows
+	if errors.Is(err, errTargetSelectionRequired) {
+		return
+	}
+
+	if err != nil {
+		a.record(auditAuthFailure, conn, method, err)
+		return
+	}
+
+	a.upstreams.SetDefault(conn.UniqueID(), fmt.Sprintf("%v@%v", u.UserName, net.JoinHostPort(u.Host, strconv.Itoa(int(u.Port)))))
+	a.record(auditAuthSuccess, conn, method, nil)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+
+	return s
+}
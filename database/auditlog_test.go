@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tg123/sshpiper/libplugin"
+)
+
+func TestAuditLogRecordsConnection(t *testing.T) {
+	p := newTestPlugin(t)
+
+	audit := newAuditLog(p.db, 2, time.Hour)
+
+	config := &libplugin.SshPiperPluginConfig{
+		PasswordCallback: func(conn libplugin.ConnMetadata, password []byte) (*libplugin.Upstream, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+
+			return &libplugin.Upstream{Host: "host", Port: 2222, UserName: "bob"}, nil
+		},
+	}
+
+	audit.instrument(config)
+
+	conn := &testConn{user: "alice", remoteAddr: "10.0.0.1:50000", uniqueID: "conn1"}
+
+	if err := config.NewConnectionCallback(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := config.PasswordCallback(conn, []byte("wrong")); err == nil {
+		t.Fatal("expected wrong password to fail")
+	}
+
+	if _, err := config.PasswordCallback(conn, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	config.PipeStartCallback(conn)
+	config.PipeErrorCallback(conn, errors.New("connection closed"))
+	config.PipeCreateErrorCallback("10.0.0.2:50000", errors.New("dial failed"))
+
+	// close writes the events still buffered
+	audit.close()
+
+	var events []auditEvent
+	if err := p.db.Order("id asc").Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{auditNewConnection, auditAuthFailure, auditAuthSuccess, auditPipeStart, auditDisconnect, auditPipeError}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+
+	for i, e := range events {
+		if e.Event != expected[i] {
+			t.Errorf("event %d: expected %v, got %v", i, expected[i], e.Event)
+		}
+	}
+
+	if events[1].Error != "wrong password" || events[1].AuthMethod != "password" {
+		t.Errorf("unexpected auth failure event %+v", events[1])
+	}
+
+	if events[3].Upstream != "bob@host:2222" || events[3].ConnID != "conn1" || events[3].Username != "alice" {
+		t.Errorf("unexpected pipe start event %+v", events[3])
+	}
+
+	if events[5].RemoteAddr != "10.0.0.2:50000" {
+		t.Errorf("unexpected pipe error event %+v", events[5])
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// databaseFlags are shared by the plugin and the management commands
+func databaseFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "driver",
+			Usage:    "database driver, one of sqlite3, mysql, postgres, mssql",
+			EnvVars:  []string{"SSHPIPERD_DATABASE_DRIVER"},
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:    "enable-database-log",
+			Usage:   "enable database log",
+			EnvVars: []string{"SSHPIPERD_DATABASE_ENABLE_DATABASE_LOG"},
+		},
+		&cli.BoolFlag{
+			Name:    "auto-migrate",
+			Value:   true,
+			Usage:   "apply pending schema migrations on start, when disabled run the migrate command before upgrading",
+			EnvVars: []string{"SSHPIPERD_DATABASE_AUTO_MIGRATE"},
+		},
+		&cli.IntFlag{
+			Name:    "max-open-conns",
+			Usage:   "maximum open database connections, 0 is unlimited",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MAX_OPEN_CONNS"},
+		},
+		&cli.IntFlag{
+			Name:    "max-idle-conns",
+			Value:   defaultMaxIdleConns,
+			Usage:   "maximum idle database connections kept open",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MAX_IDLE_CONNS"},
+		},
+		&cli.DurationFlag{
+			Name:    "conn-max-lifetime",
+			Usage:   "close database connections after this long, e.g. below a server or proxy timeout, 0 keeps them",
+			EnvVars: []string{"SSHPIPERD_DATABASE_CONN_MAX_LIFETIME"},
+		},
+		&cli.DurationFlag{
+			Name:    "conn-max-idle-time",
+			Usage:   "close database connections idle for this long, 0 keeps them",
+			EnvVars: []string{"SSHPIPERD_DATABASE_CONN_MAX_IDLE_TIME"},
+		},
+
+		// sqlite3
+		&cli.StringFlag{
+			Name:     "sqlite-file",
+			Required: false,
+			EnvVars:  []string{"SSHPIPERD_DATABASE_SQLITE_FILE"},
+		},
+
+		// mysql
+		&cli.StringFlag{
+			Name:    "mysql-host",
+			Value:   "127.0.0.1",
+			Usage:   "MySQL host",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "mysql-user",
+			Value:   "root",
+			Usage:   "MySQL user",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_USER"},
+		},
+		&cli.StringFlag{
+			Name:    "mysql-password",
+			Value:   "",
+			Usage:   "MySQL password",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_PASSWORD"},
+		},
+		&cli.UintFlag{
+			Name:    "mysql-port",
+			Value:   3306,
+			Usage:   "MySQL port",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_PORT"},
+		},
+		&cli.StringFlag{
+			Name:    "mysql-dbname",
+			Value:   "sshpiper",
+			Usage:   "MySQL database name",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_DBNAME"},
+		},
+
+		// postgres
+		&cli.StringFlag{
+			Name:    "postgres-host",
+			Value:   "127.0.0.1",
+			Usage:   "PostgreSQL host",
+			EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "postgres-user",
+			Value:   "postgres",
+			Usage:   "PostgreSQL user",
+			EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_USER"},
+		},
+		&cli.StringFlag{
+			Name:    "postgres-password",
+			Value:   "",
+			Usage:   "PostgreSQL password",
+			EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_PASSWORD"},
+		},
+		&cli.UintFlag{
+			Name:    "postgres-port",
+			Value:   5432,
+			Usage:   "PostgreSQL port",
+			EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_PORT"},
+		},
+		&cli.StringFlag{
+			Name:    "postgres-dbname",
+			Value:   "sshpiper",
+			Usage:   "PostgreSQL database name",
+			EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_DBNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "postgres-sslmode",
+			Value:   "require",
+			Usage:   "PostgreSQL SSL mode",
+			EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_SSLMODE"},
+		},
+		&cli.StringFlag{
+			Name:    "postgres-sslcert",
+			Value:   "",
+			Usage:   "PostgreSQL SSL cert path",
+			EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_SSLCERT"},
+		},
+		&cli.StringFlag{
+			Name:    "postgres-sslkey",
+			Value:   "",
+			Usage:   "PostgreSQL SSL key path",
+			EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_SSLKEY"},
+		},
+		&cli.StringFlag{
+			Name:    "postgres-sslrootcert",
+			Value:   "",
+			Usage:   "PostgreSQL SSL root cert path",
+			EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_SSLROOTCERT"},
+		},
+
+		// mssql
+		&cli.StringFlag{
+			Name:    "mssql-host",
+			Value:   "127.0.0.1",
+			Usage:   "SQL Server host",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "mssql-user",
+			Value:   "sa",
+			Usage:   "SQL Server user",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_USER"},
+		},
+		&cli.StringFlag{
+			Name:    "mssql-password",
+			Value:   "",
+			Usage:   "SQL Server password",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_PASSWORD"},
+		},
+		&cli.UintFlag{
+			Name:    "mssql-port",
+			Value:   1433,
+			Usage:   "SQL Server port",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_PORT"},
+		},
+		&cli.StringFlag{
+			Name:    "mssql-dbname",
+			Value:   "sshpiper",
+			Usage:   "SQL Server database name",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_DBNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "mssql-instance",
+			Value:   "",
+			Usage:   "SQL Server database instance",
+			EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_INSTANCE"},
+		},
+
+		// encryption at rest
+		&cli.StringFlag{
+			Name:    "encryption-key-file",
+			Usage:   "file of id:base64key AES keys, one per line, for upstream passwords and private keys, the first key encrypts",
+			EnvVars: []string{"SSHPIPERD_DATABASE_ENCRYPTION_KEY_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "encryption-keys",
+			Usage:   "comma separated id:base64key AES keys, used after keys from --encryption-key-file",
+			EnvVars: []string{"SSHPIPERD_DATABASE_ENCRYPTION_KEYS"},
+		},
+	}
+}
+
+func createBackend(c *cli.Context) (createdb, error) {
+	var backend createdb
+
+	switch c.String("driver") {
+	case "sqlite3":
+		backend = &sqliteplugin{
+			File: c.String("sqlite-file"),
+		}
+
+	case "mysql":
+		backend = &mysqlplugin{
+			Host:     c.String("mysql-host"),
+			User:     c.String("mysql-user"),
+			Password: c.String("mysql-password"),
+			Port:     c.Uint("mysql-port"),
+			Dbname:   c.String("mysql-dbname"),
+		}
+	case "postgres":
+		backend = &postgresplugin{
+			Host:        c.String("postgres-host"),
+			User:        c.String("postgres-user"),
+			Password:    c.String("postgres-password"),
+			Port:        c.Uint("postgres-port"),
+			Dbname:      c.String("postgres-dbname"),
+			SslMode:     c.String("postgres-sslmode"),
+			SslCert:     c.String("postgres-sslcert"),
+			SslKey:      c.String("postgres-sslkey"),
+			SslRootCert: c.String("postgres-sslrootcert"),
+		}
+	case "mssql":
+		backend = &mssqlplugin{
+			Host:     c.String("mssql-host"),
+			User:     c.String("mssql-user"),
+			Password: c.String("mssql-password"),
+			Port:     c.Uint("mssql-port"),
+			Dbname:   c.String("mssql-dbname"),
+			Instance: c.String("mssql-instance"),
+		}
+	default:
+		return nil, fmt.Errorf("unknown driver %s", c.String("driver"))
+	}
+
+	return backend, nil
+}
+
+// initPlugin connects p to the database configured by databaseFlags
+func initPlugin(c *cli.Context, p *plugin) error {
+	backend, err := createBackend(c)
+	if err != nil {
+		return err
+	}
+
+	keyring, err := loadKeyring(c.String("encryption-key-file"), c.String("encryption-keys"))
+	if err != nil {
+		return err
+	}
+
+	p.logmode = c.Bool("enable-database-log")
+	p.manualMigrate = !c.Bool("auto-migrate")
+	p.keyring = keyring
+	p.pool = poolConfig{
+		MaxOpenConns:    c.Int("max-open-conns"),
+		MaxIdleConns:    c.Int("max-idle-conns"),
+		ConnMaxLifetime: c.Duration("conn-max-lifetime"),
+		ConnMaxIdleTime: c.Duration("conn-max-idle-time"),
+	}
+
+	if err := p.Init(backend); err != nil {
+		return err
+	}
+
+	if p.cache != nil {
+		if err := p.cache.start(p.db, backend); err != nil {
+			p.Close()
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/sshpiper/libplugin"
+	"gorm.io/gorm"
+)
+
+// bannerEntry is a config entry holding the banner of downstreams whose downstream and server have none
+const bannerEntry = "BANNER"
+
+// bannerData is passed to banner templates, e.g. "{{.Username}} entering {{.UpstreamHost}}"
+type bannerData struct {
+	Username     string
+	Target       string
+	UpstreamHost string
+	// ValidUntil is the expiry of the downstream, nil if it does not expire
+	ValidUntil *time.Time
+}
+
+// joinBanners joins the non-empty banner templates of a downstream and its server
+func joinBanners(banners ...string) string {
+	var joined []string
+
+	for _, b := range banners {
+		if b = strings.TrimSpace(b); b != "" {
+			joined = append(joined, b)
+		}
+	}
+
+	return strings.Join(joined, "\n")
+}
+
+func parseBanner(text string) (*template.Template, error) {
+	t, err := template.New("banner").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid banner template: %w", err)
+	}
+
+	return t, nil
+}
+
+func validateBanner(text string) error {
+	_, err := parseBanner(text)
+	return err
+}
+
+func renderBanner(text string, data bannerData) (string, error) {
+	t, err := parseBanner(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	banner := b.String()
+	if banner != "" && !strings.HasSuffix(banner, "\n") {
+		banner += "\n"
+	}
+
+	return banner, nil
+}
+
+// lookupBannerDefault returns the BANNER config entry, empty if it is not set
+func lookupBannerDefault(db *gorm.DB) (string, error) {
+	banner, err := lookupConfigValue(db, bannerEntry)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+
+	return banner, err
+}
+
+// banner renders the banner of the upstream picked for conn, or of its first candidate before one is picked
+func (p *plugin) banner(conn libplugin.ConnMetadata) string {
+	pipe := p.failover.selectedPipe(conn)
+
+	if pipe == nil {
+		pipes, err := p.loadPipeFromDB(conn)
+		if err != nil {
+			return ""
+		}
+
+		pipe = &pipes[0]
+	}
+
+	if pipe.Banner == "" {
+		return ""
+	}
+
+	banner, err := renderBanner(pipe.Banner, bannerData{
+		Username:     conn.User(),
+		Target:       pipe.Target,
+		UpstreamHost: pipe.UpstreamHost,
+		ValidUntil:   pipe.ValidUntil,
+	})
+	if err != nil {
+		log.Warnf("failed to render banner of downstream %v: %v", conn.User(), err)
+		return ""
+	}
+
+	return banner
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanner(t *testing.T) {
+	p := newTestPlugin(t)
+	p.failover = newFailover(time.Minute)
+
+	validUntil := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	if err := p.db.Create(&downstream{
+		Username:   "bob",
+		Banner:     "Hello {{.Username}}{{with .ValidUntil}}, access expires {{.Format \"2006-01-02\"}}{{end}}",
+		ValidUntil: &validUntil,
+		Upstream:   upstream{Server: server{Name: "prod", Address: "prod:22", Banner: "Entering {{.Target}} at {{.UpstreamHost}}"}},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.db.Create(&downstream{
+		Username: "alice",
+		Upstream: upstream{Server: server{Address: "dev:22"}},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Hello bob, access expires 2030-01-02\nEntering prod at prod:22\n"
+	if banner := p.banner(&testConn{user: "bob", uniqueID: "1"}); banner != expected {
+		t.Errorf("expected %q, got %q", expected, banner)
+	}
+
+	if banner := p.banner(&testConn{user: "alice", uniqueID: "2"}); banner != "" {
+		t.Errorf("expected no banner, got %q", banner)
+	}
+
+	if err := p.db.Create(&config{Entry: bannerEntry, Value: "Maintenance on Saturday, {{.Username}}"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if banner := p.banner(&testConn{user: "alice", uniqueID: "3"}); banner != "Maintenance on Saturday, alice\n" {
+		t.Errorf("expected default banner, got %q", banner)
+	}
+
+	if banner := p.banner(&testConn{user: "bob", uniqueID: "4"}); banner != expected {
+		t.Errorf("expected own banner to replace the default, got %q", banner)
+	}
+
+	if err := validateBanner("{{.Username"); err == nil {
+		t.Errorf("expected invalid template to fail")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"gorm.io/gorm"
+)
+
+// commands manage the database instead of running as a plugin,
+// e.g. database reencrypt --driver sqlite3 --sqlite-file ...
+func commands() []*cli.Command {
+	cmds := append(manageCommands(), syncCommands()...)
+
+	return append(cmds,
+		&cli.Command{
+			Name:   "reencrypt",
+			Usage:  "encrypt all upstream and jump passwords and private keys with the first encryption key",
+			Flags:  databaseFlags(),
+			Action: withPlugin(reencryptCommand),
+		},
+		&cli.Command{
+			Name:  "migrate",
+			Usage: "manage schema migrations",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "status",
+					Usage:  "print applied and pending migrations",
+					Flags:  databaseFlags(),
+					Action: withDB(migrateStatusCommand),
+				},
+				{
+					Name:  "up",
+					Usage: "apply pending migrations",
+					Flags: append(databaseFlags(),
+						&cli.IntFlag{Name: "to", Usage: "target version, latest if 0"},
+					),
+					Action: withDB(migrateUpCommand),
+				},
+				{
+					Name:  "down",
+					Usage: "revert migrations newer than the target version, 0 drops all tables",
+					Flags: append(databaseFlags(),
+						&cli.IntFlag{Name: "to", Usage: "target version", Required: true},
+					),
+					Action: withDB(migrateDownCommand),
+				},
+			},
+		},
+	)
+}
+
+// runCommand runs the management command named by args[1], it returns false if
+// args[1] is not a command and the plugin should run instead
+func runCommand(args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+
+	for _, cmd := range commands() {
+		if cmd.HasName(args[1]) {
+			app := &cli.App{
+				Name:     "database",
+				Usage:    "sshpiperd database plugin management",
+				Commands: commands(),
+			}
+
+			if err := app.Run(args); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func withPlugin(action func(c *cli.Context, p *plugin) error) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		p := &plugin{}
+
+		if err := initPlugin(c, p); err != nil {
+			return err
+		}
+		defer p.Close()
+
+		return action(c, p)
+	}
+}
+
+// withDB runs action with a database connection, without migrating the schema
+func withDB(action func(c *cli.Context, db *gorm.DB) error) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		backend, err := createBackend(c)
+		if err != nil {
+			return err
+		}
+
+		db, err := backend.create()
+		if err != nil {
+			return err
+		}
+		defer closeDB(db)
+
+		db.Logger = newLogger(c.Bool("enable-database-log"))
+
+		return action(c, db)
+	}
+}
+
+func migrateStatusCommand(c *cli.Context, db *gorm.DB) error {
+	var applied []schemaMigration
+	if _, err := schemaVersion(db); err != nil {
+		return err
+	}
+
+	if err := db.Order("version asc").Find(&applied).Error; err != nil {
+		return err
+	}
+
+	appliedAt := map[int]string{}
+	for _, m := range applied {
+		appliedAt[m.Version] = m.AppliedAt.Format(time.RFC3339)
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		status, ok := appliedAt[m.version]
+		if !ok {
+			status = "pending"
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\n", m.version, m.name, status)
+	}
+
+	return w.Flush()
+}
+
+func migrateUpCommand(c *cli.Context, db *gorm.DB) error {
+	target := c.Int("to")
+	if target == 0 {
+		target = latestSchemaVersion()
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if target < current {
+		return fmt.Errorf("schema is at version %v, use migrate down to revert to %v", current, target)
+	}
+
+	return migrateTo(db, target)
+}
+
+func migrateDownCommand(c *cli.Context, db *gorm.DB) error {
+	target := c.Int("to")
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if target > current {
+		return fmt.Errorf("schema is at version %v, use migrate up to apply %v", current, target)
+	}
+
+	return migrateTo(db, target)
+}
+
+func reencryptCommand(c *cli.Context, p *plugin) error {
+	if p.keyring == nil {
+		return fmt.Errorf("no encryption key configured")
+	}
+
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		var upstreams []upstream
+		if err := tx.Find(&upstreams).Error; err != nil {
+			return err
+		}
+
+		passwords := 0
+		passphrases := 0
+		privatekeys := map[int]bool{}
+
+		for _, u := range upstreams {
+			password, changed, err := p.keyring.reencrypt(u.Password, upstreamField("password", u.ID))
+			if err != nil {
+				return fmt.Errorf("upstream %v password: %w", u.ID, err)
+			}
+
+			if changed {
+				if err := tx.Model(&u).Update("password", password).Error; err != nil {
+					return err
+				}
+
+				passwords++
+			}
+
+			passphrase, changed, err := p.keyring.reencrypt(u.PrivateKeyPassphrase, upstreamField("private_key_passphrase", u.ID))
+			if err != nil {
+				return fmt.Errorf("upstream %v private key passphrase: %w", u.ID, err)
+			}
+
+			if changed {
+				if err := tx.Model(&u).Update("private_key_passphrase", passphrase).Error; err != nil {
+					return err
+				}
+
+				passphrases++
+			}
+
+			if u.PrivateKeyID != 0 {
+				privatekeys[u.PrivateKeyID] = true
+			}
+		}
+
+		var servers []server
+		if err := tx.Find(&servers).Error; err != nil {
+			return err
+		}
+
+		for _, s := range servers {
+			password, changed, err := p.keyring.reencrypt(s.JumpPassword, serverField("jump_password", s.ID))
+			if err != nil {
+				return fmt.Errorf("server %v jump password: %w", s.ID, err)
+			}
+
+			if changed {
+				if err := tx.Model(&s).Update("jump_password", password).Error; err != nil {
+					return err
+				}
+
+				passwords++
+			}
+
+			if s.JumpPrivateKeyID != 0 {
+				privatekeys[s.JumpPrivateKeyID] = true
+			}
+		}
+
+		keys := 0
+
+		for id := range privatekeys {
+			k := keydata{}
+			if err := tx.First(&k, id).Error; err != nil {
+				return fmt.Errorf("upstream private key %v: %w", id, err)
+			}
+
+			data, changed, err := p.keyring.reencrypt(k.Data, keydataField(k.ID))
+			if err != nil {
+				return fmt.Errorf("upstream private key %v: %w", id, err)
+			}
+
+			if changed {
+				if err := tx.Model(&k).Update("data", data).Error; err != nil {
+					return err
+				}
+
+				keys++
+			}
+		}
+
+		log.Infof("reencrypted %v upstream passwords, %v passphrases and %v private keys with key %v", passwords, passphrases, keys, p.keyring.primary)
+
+		return nil
+	})
+}
@@ -1,84 +1,456 @@
 package main
 
 import (
-	"github.com/jinzhu/gorm"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 	"github.com/tg123/sshpiper/libplugin"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
 )
 
 type pipeConfig struct {
 	Username              string
+	Target                string
+	Banner                string
 	UpstreamHost          string
+	Via                   []jumpHop
 	MappedUsername        string
 	FromType              authMapType
 	FromPassword          string
 	FromPrivateKey        keydata
 	FromAuthorizedKeys    keydata
 	FromAllowAnyPublicKey bool
+	FromTrustedUserCAKeys keydata
+	FromAllowedPrincipals []string
 	ToType                authMapType
+	UpstreamID            uint
 	ToPassword            string
 	ToPrivateKey          keydata
+	ToPassphrase          string
+	ToCertificate         keydata
 	ToAuthorizedKeys      keydata
-	// NoPassthrough         bool
-	KnownHosts    keydata
-	IgnoreHostkey bool
+	NoPassthrough         bool
+	KnownHosts            keydata
+	IgnoreHostkey         bool
+	ServerID              int
+	TrustOnFirstUse       bool
+	Priority              int
+	Weight                int
+	ValidFrom             *time.Time
+	ValidUntil            *time.Time
+	AccessWindows         []accessWindow
+	AccessWindowsSpec     string
+	AccessLocation        *time.Location
+	AllowedSources        []netip.Prefix
+	DeniedSources         []netip.Prefix
+}
+
+// upstreamKey identifies the upstream credential a pipe connects with
+func (c *pipeConfig) upstreamKey() string {
+	return fmt.Sprintf("%v@%v", c.MappedUsername, c.UpstreamHost)
+}
+
+// loadPipeFromDB returns all upstream candidates of the downstream, in the order they should be tried
+func (p *plugin) loadPipeFromDB(conn libplugin.ConnMetadata) ([]pipeConfig, error) {
+	pipes, err := p.resolveLogin(conn)
+	if err != nil {
+		return nil, p.health.lookupFailed(err)
+	}
+
+	// all candidates share the downstream
+	if err := checkSource(&pipes[0], conn); err != nil {
+		var denied *sourceDeniedError
+		if errors.As(err, &denied) {
+			p.sourceDenied(conn, denied)
+		}
+
+		return nil, err
+	}
+
+	if err := checkAccessTime(&pipes[0], p.clock()); err != nil {
+		return nil, err
+	}
+
+	// cached pipes are shared, order a copy
+	pipes = append([]pipeConfig(nil), pipes...)
+	sortPipes(pipes)
+
+	return pipes, nil
+}
+
+// cachedPipes returns all upstream candidates of the downstream matching user, from the cache if enabled
+func (p *plugin) cachedPipes(user string) ([]pipeConfig, error) {
+	if p.cache != nil {
+		return p.cache.get(user, p.resolvePipes)
+	}
+
+	return p.resolvePipes(user)
 }
 
-func (p *plugin) loadPipeFromDB(conn libplugin.ConnMetadata) (pipeConfig, error) {
+// resolvePipes returns all upstream candidates of the downstream matching user, unordered,
+// with secrets as stored, see decryptPipe
+func (p *plugin) resolvePipes(user string) ([]pipeConfig, error) {
+	if p.queries != nil {
+		return p.resolvePipesByQuery(user)
+	}
+
+	d, m, err := lookupDownstreamWithFallback(p.db, user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	globalCAKeys, err := lookupKeydataByConfig(p.db, trustedUserCAKeysEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	if globalCAKeys != nil {
+		d.TrustedUserCAKeys.Data = strings.TrimSpace(d.TrustedUserCAKeys.Data + "\n" + globalCAKeys.Data)
+	}
+
+	windows, err := parseAccessWindows(d.AccessWindows)
+	if err != nil {
+		return nil, fmt.Errorf("downstream %v: %w", d.Username, err)
+	}
+
+	location, err := time.LoadLocation(d.AccessTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("downstream %v: %w", d.Username, err)
+	}
+
+	allowed, denied, err := lookupSources(p.db, d)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultBanner, err := lookupBannerDefault(p.db)
+	if err != nil {
+		return nil, err
+	}
 
-	user := conn.User()
-	d, err := lookupDownstreamWithFallback(p.db, user)
+	var pipes []pipeConfig
+
+	add := func(u *upstream, priority, weight int) error {
+		pipe := newPipeConfig(user, d, m, u, priority, weight)
+		pipe.AccessWindows = windows
+		pipe.AccessLocation = location
+		pipe.AllowedSources = allowed
+		pipe.DeniedSources = denied
+		pipe.Banner = withDefault(joinBanners(d.Banner, u.Server.Banner), defaultBanner)
+
+		if pipe.UpstreamHost, err = m.expandAddress(u.Server.Address); err != nil {
+			return fmt.Errorf("downstream %v: upstream %v: %w", d.Username, u.ID, err)
+		}
+
+		if pipe.MappedUsername, err = mapUsername(u, user, m); err != nil {
+			return fmt.Errorf("downstream %v: upstream %v: %w", d.Username, u.ID, err)
+		}
+
+		if pipe.Via, err = lookupJumpHops(p.db, &u.Server); err != nil {
+			return err
+		}
+
+		pipes = append(pipes, pipe)
+		return nil
+	}
+
+	if d.UpstreamID != 0 {
+		if err := add(&d.Upstream, 0, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range d.Routes {
+		r := &d.Routes[i]
+		if err := add(&r.Upstream, r.Priority, r.Weight); err != nil {
+			return nil, err
+		}
+	}
 
+	groupRoutes, err := lookupGroupRoutes(p.db, d.ID)
 	if err != nil {
-		return pipeConfig{}, err
+		return nil, err
 	}
 
-	pipe := pipeConfig{
-		Username:           user,
-		UpstreamHost:       d.Upstream.Server.Address,
-		MappedUsername:     d.Upstream.Username,
-		FromType:           d.AuthMapType,
-		FromPassword:       d.Password,
-		FromAuthorizedKeys: d.AuthorizedKeys,
-		// FromAllowAnyPublicKey: d.AllowAnyPublicKey,
-		ToType:       d.Upstream.AuthMapType,
-		ToPassword:   d.Upstream.Password,
-		ToPrivateKey: d.Upstream.PrivateKey,
-		// NoPassthrough:         d.NoPassthrough,
-		KnownHosts:    d.Upstream.Server.HostKey,
-		IgnoreHostkey: d.Upstream.Server.IgnoreHostKey,
+	for i := range groupRoutes {
+		r := &groupRoutes[i]
+		if err := add(&r.Upstream, r.Priority, r.Weight); err != nil {
+			return nil, err
+		}
 	}
 
-	return pipe, nil
+	if len(pipes) == 0 {
+		return nil, fmt.Errorf("no upstream configured for downstream %v", d.Username)
+	}
+
+	return pipes, nil
 }
 
-func lookupDownstreamWithFallback(db *gorm.DB, user string) (*downstream, error) {
+// decryptPipe opens upstream secrets stored encrypted at rest or as secret references.
+// Pipes are cached as stored, so this runs on a copy for every connection and references
+// resolve to the current secret. Pipes of a lookup_user query have no row ids, their
+// secrets are bound to the column only like in an export.
+func (p *plugin) decryptPipe(pipe *pipeConfig) (err error) {
+	pipe.ToPassword, err = p.keyring.decrypt(pipe.ToPassword, upstreamField("password", pipe.UpstreamID))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt upstream password of %v: %w", pipe.upstreamKey(), err)
+	}
+
+	pipe.ToPrivateKey.Data, err = p.keyring.decrypt(pipe.ToPrivateKey.Data, keydataField(pipe.ToPrivateKey.ID))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt upstream private key of %v: %w", pipe.upstreamKey(), err)
+	}
+
+	pipe.ToPassphrase, err = p.keyring.decrypt(pipe.ToPassphrase, upstreamField("private_key_passphrase", pipe.UpstreamID))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt upstream private key passphrase of %v: %w", pipe.upstreamKey(), err)
+	}
+
+	// only keydata holds references, a password is never mistaken for one
+	for _, secret := range []struct {
+		name  string
+		value *string
+	}{
+		{"private key", &pipe.ToPrivateKey.Data},
+		{"certificate", &pipe.ToCertificate.Data},
+	} {
+		if *secret.value, err = p.secrets.resolve(*secret.value); err != nil {
+			return fmt.Errorf("failed to resolve upstream %v of %v: %w", secret.name, pipe.upstreamKey(), err)
+		}
+	}
+
+	// the hops are shared with the cached pipe
+	pipe.Via = append([]jumpHop(nil), pipe.Via...)
+
+	for i := range pipe.Via {
+		hop := &pipe.Via[i]
+
+		for _, secret := range []struct {
+			name  string
+			value *string
+			field secretField
+		}{
+			{"password", &hop.Password, serverField("jump_password", hop.ServerID)},
+			{"private key", &hop.PrivateKey.Data, keydataField(hop.PrivateKey.ID)},
+		} {
+			if *secret.value, err = p.keyring.decrypt(*secret.value, secret.field); err != nil {
+				return fmt.Errorf("failed to decrypt jump %v of %v: %w", secret.name, hop.Name, err)
+			}
+		}
+
+		if hop.PrivateKey.Data, err = p.secrets.resolve(hop.PrivateKey.Data); err != nil {
+			return fmt.Errorf("failed to resolve jump private key of %v: %w", hop.Name, err)
+		}
+	}
+
+	// sshpiperd expects an unencrypted key, unlock it once here rather than on every auth
+	if pipe.ToPassphrase != "" {
+		pipe.ToPrivateKey.Data, err = unlockPrivateKey(pipe.ToPrivateKey.Data, pipe.ToPassphrase)
+		if err != nil {
+			return fmt.Errorf("failed to unlock upstream private key of %v: %w", pipe.upstreamKey(), err)
+		}
+
+		pipe.ToPassphrase = ""
+	}
+
+	return nil
+}
+
+// unlockPrivateKey returns the passphrase protected key as an unencrypted OpenSSH private key
+func unlockPrivateKey(data, passphrase string) (string, error) {
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase([]byte(data), []byte(passphrase))
+	if err != nil {
+		return "", err
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+func newPipeConfig(user string, d *downstream, m *userMatch, u *upstream, priority, weight int) pipeConfig {
+	return pipeConfig{
+		Username:              user,
+		Target:                withDefault(u.Name, u.Server.Name),
+		UpstreamHost:          u.Server.Address,
+		FromType:              d.AuthMapType,
+		FromPassword:          d.Password,
+		FromAuthorizedKeys:    d.AuthorizedKeys,
+		FromAllowAnyPublicKey: d.AllowAnyPublicKey,
+		FromTrustedUserCAKeys: d.TrustedUserCAKeys,
+		FromAllowedPrincipals: splitList(d.AllowedPrincipals),
+		ToType:                u.AuthMapType,
+		UpstreamID:            u.ID,
+		ToPassword:            u.Password,
+		ToPrivateKey:          u.PrivateKey,
+		ToPassphrase:          u.PrivateKeyPassphrase,
+		ToCertificate:         u.Certificate,
+		NoPassthrough:         d.NoPassthrough,
+		KnownHosts:            u.Server.HostKey,
+		IgnoreHostkey:         u.Server.IgnoreHostKey,
+		ServerID:              u.ServerID,
+		TrustOnFirstUse:       u.Server.TrustOnFirstUse,
+		Priority:              priority,
+		Weight:                weight,
+		ValidFrom:             d.ValidFrom,
+		ValidUntil:            d.ValidUntil,
+		AccessWindowsSpec:     d.AccessWindows,
+	}
+}
+
+// sortPipes orders pipes by ascending priority and shuffles pipes sharing
+// the same priority weighted-random, so load is spread by weight
+func sortPipes(pipes []pipeConfig) {
+	sort.SliceStable(pipes, func(i, j int) bool {
+		return pipes[i].Priority < pipes[j].Priority
+	})
+
+	for start := 0; start < len(pipes); {
+		end := start + 1
+		for end < len(pipes) && pipes[end].Priority == pipes[start].Priority {
+			end++
+		}
+
+		weightedShuffle(pipes[start:end])
+		start = end
+	}
+}
+
+func weightedShuffle(pipes []pipeConfig) {
+	for i := 0; i < len(pipes)-1; i++ {
+		total := 0
+		for _, c := range pipes[i:] {
+			total += max(c.Weight, 1)
+		}
+
+		n := rand.IntN(total)
+		for j := i; j < len(pipes); j++ {
+			n -= max(pipes[j].Weight, 1)
+			if n < 0 {
+				pipes[i], pipes[j] = pipes[j], pipes[i]
+				break
+			}
+		}
+	}
+}
+
+// lookupDownstreamWithFallback tries an exact username match first, then pattern rows,
+// then the downstream named by FALLBACK_USER
+func lookupDownstreamWithFallback(db *gorm.DB, user string) (*downstream, *userMatch, error) {
 	d, err := lookupDownstream(db, user)
 
-	if gorm.IsRecordNotFoundError(err) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		d, m, err := lookupDownstreamByPattern(db, user)
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return d, m, err
+		}
+
 		fallback, _ := lookupConfigValue(db, fallbackUserEntry)
 
 		if len(fallback) > 0 {
-			return lookupDownstream(db, fallback)
+			d, err := lookupDownstream(db, fallback)
+			return d, nil, err
 		}
 	}
 
-	return d, err
+	return d, nil, err
 }
 
 func lookupDownstream(db *gorm.DB, user string) (*downstream, error) {
 	d := downstream{}
 
-	if err := db.Preload("Upstream").
+	if err := preloadDownstream(db).
+		Where(&downstream{Username: user}).
+		Where("match_type = ?", matchTypeExact).
+		First(&d).Error; err != nil {
+
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// lookupDownstreamByPattern returns the first glob or regex downstream matching user,
+// ordered by MatchPriority then ID
+func lookupDownstreamByPattern(db *gorm.DB, user string) (*downstream, *userMatch, error) {
+	var patterns []downstream
+
+	if err := db.Select("id, username, match_type").
+		Where("match_type <> ?", matchTypeExact).
+		Order("match_priority asc").
+		Order("id asc").
+		Find(&patterns).Error; err != nil {
+
+		return nil, nil, err
+	}
+
+	for _, pattern := range patterns {
+		m, err := matchUser(pattern.MatchType, pattern.Username, user)
+		if err != nil {
+			log.Warnf("skipping downstream %v with invalid pattern %v: %v", pattern.ID, pattern.Username, err)
+			continue
+		}
+
+		if m == nil {
+			continue
+		}
+
+		d := downstream{}
+		if err := preloadDownstream(db).First(&d, pattern.ID).Error; err != nil {
+			return nil, nil, err
+		}
+
+		return &d, m, nil
+	}
+
+	return nil, nil, gorm.ErrRecordNotFound
+}
+
+func preloadDownstream(db *gorm.DB) *gorm.DB {
+	return db.Preload("Upstream").
 		Preload("Upstream.Server").
 		Preload("Upstream.Server.HostKey").
 		Preload("Upstream.PrivateKey").
+		Preload("Upstream.Certificate").
+		Preload("Routes").
+		Preload("Routes.Upstream").
+		Preload("Routes.Upstream.Server").
+		Preload("Routes.Upstream.Server.HostKey").
+		Preload("Routes.Upstream.PrivateKey").
+		Preload("Routes.Upstream.Certificate").
 		Preload("AuthorizedKeys").
-		Where(&downstream{Username: user}).First(&d).Error; err != nil {
+		Preload("TrustedUserCAKeys")
+}
+
+// lookupGroupRoutes returns the routes of all groups the downstream is a member of
+func lookupGroupRoutes(db *gorm.DB, downstreamID uint) ([]groupRoute, error) {
+	var routes []groupRoute
+
+	if err := db.Preload("Upstream").
+		Preload("Upstream.Server").
+		Preload("Upstream.Server.HostKey").
+		Preload("Upstream.PrivateKey").
+		Preload("Upstream.Certificate").
+		Where("group_id IN (?)", db.Model(&groupMember{}).Select("group_id").Where("downstream_id = ?", downstreamID)).
+		Order("id asc").
+		Find(&routes).Error; err != nil {
 
 		return nil, err
 	}
 
-	return &d, nil
+	return routes, nil
 }
 
 func lookupConfigValue(db *gorm.DB, entry string) (string, error) {
@@ -89,3 +461,34 @@ func lookupConfigValue(db *gorm.DB, entry string) (string, error) {
 
 	return c.Value, nil
 }
+
+// lookupKeydataByConfig loads the keydata named by a config entry, nil if the entry is not set
+func lookupKeydataByConfig(db *gorm.DB, entry string) (*keydata, error) {
+	name, err := lookupConfigValue(db, entry)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && name == "") {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	k := keydata{}
+	if err := db.Where(&keydata{Name: name}).First(&k).Error; err != nil {
+		return nil, fmt.Errorf("config %v refers to keydata %v: %w", entry, name, err)
+	}
+
+	return &k, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
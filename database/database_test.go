@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+type testConn struct {
+	user       string
+	remoteAddr string
+	uniqueID   string
+}
+
+func (c *testConn) User() string {
+	return c.user
+}
+
+func (c *testConn) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+func (c *testConn) UniqueID() string {
+	return c.uniqueID
+}
+
+func (c *testConn) GetMeta(key string) string {
+	return ""
+}
+
+func newTestPlugin(t *testing.T) *plugin {
+	p := &plugin{}
+
+	if err := p.Init(&sqliteplugin{
+		File: path.Join(t.TempDir(), "test.db"),
+	}); err != nil {
+		t.Fatalf("failed to init plugin: %v", err)
+	}
+
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func TestSortPipesByPriority(t *testing.T) {
+	pipes := []pipeConfig{
+		{UpstreamHost: "c", Priority: 2},
+		{UpstreamHost: "a1", Priority: 0, Weight: 10},
+		{UpstreamHost: "b", Priority: 1},
+		{UpstreamHost: "a2", Priority: 0},
+	}
+
+	sortPipes(pipes)
+
+	if len(pipes) != 4 {
+		t.Fatalf("expected 4 pipes, got %d", len(pipes))
+	}
+
+	for i, expected := range []int{0, 0, 1, 2} {
+		if pipes[i].Priority != expected {
+			t.Errorf("pipe %d: expected priority %d, got %d", i, expected, pipes[i].Priority)
+		}
+	}
+
+	if pipes[2].UpstreamHost != "b" || pipes[3].UpstreamHost != "c" {
+		t.Errorf("unexpected order %v, %v", pipes[2].UpstreamHost, pipes[3].UpstreamHost)
+	}
+}
+
+func TestWeightedShufflePrefersHeavierPipes(t *testing.T) {
+	first := map[string]int{}
+
+	for range 1000 {
+		pipes := []pipeConfig{
+			{UpstreamHost: "light", Weight: 1},
+			{UpstreamHost: "heavy", Weight: 9},
+		}
+
+		weightedShuffle(pipes)
+		first[pipes[0].UpstreamHost]++
+	}
+
+	if first["heavy"] < first["light"]*3 {
+		t.Errorf("heavy pipe should be picked first far more often, got %v", first)
+	}
+}
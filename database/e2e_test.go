@@ -192,6 +192,7 @@ func TestSqliteDatabase(t *testing.T) {
 			"sqlite3",
 			"--sqlite-file",
 			dbfile,
+			"--allow-plaintext-password",
 		)
 
 		if err != nil {
@@ -231,6 +232,89 @@ func TestSqliteDatabase(t *testing.T) {
 		testcommon.CheckSharedFileContent(t, targetfie, randtext)
 	})
 
+	t.Run("failover", func(t *testing.T) {
+
+		if err := sqlite3db.Create(&downstream{
+			Username:    "failover",
+			AuthMapType: authMapTypePassword,
+			Routes: []route{
+				{
+					Priority: 0,
+					Upstream: upstream{
+						Username:    "user",
+						AuthMapType: authMapTypePassword,
+						Server: server{
+							Address:       "127.0.0.1:1",
+							IgnoreHostKey: true,
+						},
+					},
+				},
+				{
+					Priority: 1,
+					Upstream: upstream{
+						Username:    "user",
+						AuthMapType: authMapTypePassword,
+						Server: server{
+							Address:       "host-password:2222",
+							IgnoreHostKey: true,
+						},
+					},
+				},
+			},
+		}).Error; err != nil {
+			t.Errorf("failed to create downstream: %v", err)
+		}
+
+		piperaddr, piperport := testcommon.NextAvailablePiperAddress()
+
+		piper, _, _, err := testcommon.RunCmd("/sshpiperd/sshpiperd",
+			"-p",
+			piperport,
+			"/sshpiperd/plugins/database",
+			"--driver",
+			"sqlite3",
+			"--sqlite-file",
+			dbfile,
+		)
+
+		if err != nil {
+			t.Errorf("failed to run sshpiperd: %v", err)
+		}
+
+		defer testcommon.KillCmd(piper)
+
+		testcommon.WaitForEndpointReady(piperaddr)
+
+		// the dead upstream is skipped within the first connection
+		randtext := uuid.New().String()
+		targetfie := uuid.New().String()
+
+		c, stdin, stdout, err := testcommon.RunCmd(
+			"ssh",
+			"-v",
+			"-o",
+			"StrictHostKeyChecking=no",
+			"-p",
+			piperport,
+			"-l",
+			"failover",
+			"127.0.0.1",
+			fmt.Sprintf(`sh -c "echo -n %v > /shared/%v"`, randtext, targetfie),
+		)
+
+		if err != nil {
+			t.Errorf("failed to ssh to %v", err)
+		}
+
+		defer testcommon.KillCmd(c)
+
+		testcommon.EnterPassword(stdin, stdout, "pass")
+
+		time.Sleep(time.Second)
+
+		testcommon.CheckSharedFileContent(t, targetfie, randtext)
+	})
+
 	t.Run("keytokey", func(t *testing.T) {
 
 		if err := testcommon.RunCmdAndWait("rm", "-f", path.Join(testdir, "keykey")); err != nil {
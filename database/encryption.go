@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	encryptedPrefix = "enc:"
+	nonceSize       = 12
+)
+
+// keyring holds the AES keys used to encrypt upstream passwords and private keys at rest.
+// Encrypted values are stored as enc:<key id>:<base64 nonce+ciphertext>, so old keys can
+// stay in the keyring for decryption while new values are encrypted with the primary key.
+type keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// secretField is the table, column and row a secret is stored at. Encrypted values are
+// bound to their field, a value copied to another row or column does not decrypt.
+type secretField struct {
+	table  string
+	column string
+	id     uint
+}
+
+func upstreamField(column string, id uint) secretField {
+	return secretField{table: "upstreams", column: column, id: id}
+}
+
+func serverField(column string, id uint) secretField {
+	return secretField{table: "servers", column: column, id: id}
+}
+
+func keydataField(id uint) secretField {
+	return secretField{table: "keydata", column: "data", id: id}
+}
+
+// exported is the field of a value in an export, which is bound to its column only
+// as row ids differ between databases
+func (f secretField) exported() secretField {
+	return secretField{table: f.table, column: f.column}
+}
+
+// additionalData is authenticated along with a value encrypted by key id for field f
+func (f secretField) additionalData(id string) []byte {
+	return []byte(fmt.Sprintf("%v\x00%v\x00%v\x00%v", id, f.table, f.column, f.id))
+}
+
+// loadKeyring parses keys in the form id:base64key, separated by commas or new lines,
+// the first key found is the primary key. Keys from file come before keys from list.
+func loadKeyring(file string, list string) (*keyring, error) {
+	var entries []string
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, strings.FieldsFunc(string(data), isKeySeparator)...)
+	}
+
+	entries = append(entries, strings.FieldsFunc(list, isKeySeparator)...)
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	k := &keyring{
+		keys: map[string][]byte{},
+	}
+
+	for _, entry := range entries {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("encryption key must be in the form id:base64key")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %v is not base64: %w", id, err)
+		}
+
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("encryption key %v: %w", id, err)
+		}
+
+		if _, found := k.keys[id]; found {
+			return nil, fmt.Errorf("duplicate encryption key id %v", id)
+		}
+
+		if k.primary == "" {
+			k.primary = id
+		}
+
+		k.keys[id] = key
+	}
+
+	return k, nil
+}
+
+func isKeySeparator(r rune) bool {
+	return r == ',' || r == '\n' || r == '\r'
+}
+
+func isEncrypted(text string) bool {
+	return strings.HasPrefix(text, encryptedPrefix)
+}
+
+// encrypt seals text stored at field with the primary key
+func (k *keyring) encrypt(text string, field secretField) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+
+	if k == nil {
+		return "", fmt.Errorf("no encryption key configured")
+	}
+
+	gcm, err := newGCM(k.keys[k.primary])
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, []byte(text), field.additionalData(k.primary))
+
+	return encryptedPrefix + k.primary + ":" + base64.StdEncoding.EncodeToString(append(nonce, ciphertext...)), nil
+}
+
+// decrypt opens an encrypted value stored at field, values without the enc: prefix are returned as is
+func (k *keyring) decrypt(text string, field secretField) (string, error) {
+	if !isEncrypted(text) {
+		return text, nil
+	}
+
+	if k == nil {
+		return "", fmt.Errorf("value is encrypted but no encryption key configured")
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(text, encryptedPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	key, found := k.keys[id]
+	if !found {
+		return "", fmt.Errorf("encryption key %v not found", id)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ciphertext) < nonceSize {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := gcm.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], field.additionalData(id))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// reencrypt decrypts text with any known key and encrypts it again with the primary key,
+// changed is false if text was already encrypted with the primary key
+func (k *keyring) reencrypt(text string, field secretField) (string, bool, error) {
+	if text == "" || strings.HasPrefix(text, encryptedPrefix+k.primary+":") {
+		return text, false, nil
+	}
+
+	plaintext, err := k.decrypt(text, field)
+	if err != nil {
+		return "", false, err
+	}
+
+	encrypted, err := k.encrypt(plaintext, field)
+	if err != nil {
+		return "", false, err
+	}
+
+	return encrypted, true, nil
+}
+
+// seal encrypts a secret stored at field if an encryption key is configured. An encrypted
+// secret comes from an export, it is opened with the exported field and sealed again.
+func (p *plugin) seal(secret string, field secretField) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+
+	if isEncrypted(secret) {
+		plaintext, err := p.keyring.decrypt(secret, field.exported())
+		if err != nil {
+			return "", err
+		}
+
+		secret = plaintext
+	}
+
+	if p.keyring == nil {
+		return secret, nil
+	}
+
+	return p.keyring.encrypt(secret, field)
+}
+
+// sealRow writes secrets to the columns of the saved row model in table. Rows are
+// saved without their secrets first, as sealed values are bound to the row id.
+func (p *plugin) sealRow(tx *gorm.DB, model interface{}, table string, id uint, secrets map[string]string) error {
+	values := map[string]interface{}{}
+
+	for column, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+
+		sealed, err := p.seal(secret, secretField{table: table, column: column, id: id})
+		if err != nil {
+			return fmt.Errorf("%v %v: %w", table, column, err)
+		}
+
+		values[column] = sealed
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	return tx.Model(model).Updates(values).Error
+}
+
+// exportSecret encrypts a secret stored at field again for an export
+func (p *plugin) exportSecret(secret string, field secretField) (string, error) {
+	if !isEncrypted(secret) {
+		return secret, nil
+	}
+
+	plaintext, err := p.keyring.decrypt(secret, field)
+	if err != nil {
+		return "", fmt.Errorf("%v %v of row %v: %w", field.table, field.column, field.id, err)
+	}
+
+	return p.keyring.encrypt(plaintext, field.exported())
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+func testEncryptionKey(t *testing.T, id string) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return fmt.Sprintf("%v:%v", id, base64.StdEncoding.EncodeToString(key))
+}
+
+func TestKeyringEncryptAndDecrypt(t *testing.T) {
+	oldkey := testEncryptionKey(t, "old")
+
+	old, err := loadKeyring("", oldkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	field := upstreamField("password", 1)
+
+	encrypted, err := old.encrypt("secret", field)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isEncrypted(encrypted) {
+		t.Errorf("expected encrypted value, got %v", encrypted)
+	}
+
+	// new primary key, old key kept for decryption
+	rotated, err := loadKeyring("", testEncryptionKey(t, "new")+","+oldkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := rotated.decrypt(encrypted, field)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted != "secret" {
+		t.Errorf("expected secret, got %v", decrypted)
+	}
+
+	reencrypted, changed, err := rotated.reencrypt(encrypted, field)
+	if err != nil || !changed {
+		t.Fatalf("expected reencrypt with new key, got %v, %v", changed, err)
+	}
+
+	if _, changed, _ := rotated.reencrypt(reencrypted, field); changed {
+		t.Errorf("value encrypted with primary key should not change")
+	}
+
+	if _, err := old.decrypt(reencrypted, field); err == nil {
+		t.Errorf("old keyring should not know the new key")
+	}
+
+	// a value is bound to its table, column and row
+	for _, other := range []secretField{
+		upstreamField("password", 2),
+		upstreamField("private_key_passphrase", 1),
+		serverField("password", 1),
+		field.exported(),
+	} {
+		if _, err := rotated.decrypt(reencrypted, other); err == nil {
+			t.Errorf("value of %v should not decrypt as %v", field, other)
+		}
+	}
+
+	if plain, err := (*keyring)(nil).decrypt("cleartext", field); err != nil || plain != "cleartext" {
+		t.Errorf("cleartext should pass through without keyring, got %v, %v", plain, err)
+	}
+
+	if _, err := (*keyring)(nil).decrypt(encrypted, field); err == nil {
+		t.Errorf("encrypted value without keyring should fail")
+	}
+}
+
+func TestReencryptCommand(t *testing.T) {
+	p := newTestPlugin(t)
+
+	if err := p.db.Create(&upstream{
+		Password:   "pass",
+		PrivateKey: keydata{Data: "private key"},
+		Server:     server{Address: "host:22"},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.db.Create(&downstream{Username: "user", UpstreamID: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := loadKeyring("", testEncryptionKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.keyring = keyring
+
+	mark, err := highWaterMark(p.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reencryptCommand(nil, p); err != nil {
+		t.Fatalf("reencrypt failed: %v", err)
+	}
+
+	// caches polling the database must see the rewritten rows
+	if after, err := highWaterMark(p.db); err != nil || after == mark {
+		t.Errorf("expected reencrypt to change the high-water mark, got %v, %v", after, err)
+	}
+
+	u := upstream{}
+	if err := p.db.Preload("PrivateKey").First(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if !isEncrypted(u.Password) || !isEncrypted(u.PrivateKey.Data) {
+		t.Errorf("expected encrypted values, got %v, %v", u.Password, u.PrivateKey.Data)
+	}
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.decryptPipe(&pipes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if pipes[0].ToPassword != "pass" || pipes[0].ToPrivateKey.Data != "private key" {
+		t.Errorf("expected decrypted values, got %v, %v", pipes[0].ToPassword, pipes[0].ToPrivateKey.Data)
+	}
+}
+
+func TestSealedValueCopiedToAnotherRow(t *testing.T) {
+	p := newTestPlugin(t)
+
+	for i, username := range []string{"alice", "mallory"} {
+		if err := p.db.Create(&upstream{Username: username, Password: username + "-pass", Server: server{Address: username + ":22"}}).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.db.Create(&downstream{Username: username, UpstreamID: i + 1}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keyring, err := loadKeyring("", testEncryptionKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.keyring = keyring
+
+	if err := reencryptCommand(nil, p); err != nil {
+		t.Fatalf("reencrypt failed: %v", err)
+	}
+
+	alice := upstream{}
+	if err := p.db.Where(&upstream{Username: "alice"}).First(&alice).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if !isEncrypted(alice.Password) {
+		t.Fatalf("expected encrypted password, got %v", alice.Password)
+	}
+
+	// a database writer copies the password of alice to the upstream of mallory
+	if err := p.db.Model(&upstream{}).Where(&upstream{Username: "mallory"}).Update("password", alice.Password).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "mallory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.decryptPipe(&pipes[0]); err == nil {
+		t.Errorf("expected a password copied from another row to fail, got %v", pipes[0].ToPassword)
+	}
+
+	pipes, err = p.loadPipeFromDB(&testConn{user: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.decryptPipe(&pipes[0]); err != nil || pipes[0].ToPassword != "alice-pass" {
+		t.Errorf("expected password of alice, got %v, %v", pipes[0].ToPassword, err)
+	}
+}
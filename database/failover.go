@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/sshpiper/libplugin"
+)
+
+// failover remembers which upstream candidate was picked for a connection and
+// which candidates failed recently, so the next attempt prefers the others.
+//
+// upstream auth and dial failures skip the candidate for the rest of the same
+// connection, while dial and pipe create errors also put the upstream host on
+// a cooldown shared by all connections.
+type failover struct {
+	selected  *cache.Cache // conn unique id or remote addr -> selection
+	failed    *cache.Cache // conn unique id -> map[upstreamKey]bool
+	unhealthy *cache.Cache // upstream host -> time of failure
+}
+
+// selectionTTL bounds how long the decrypted pipe of a connection is kept, sshpiperd
+// connects the upstream right after the downstream authenticated
+const selectionTTL = time.Minute
+
+// dialProbeTimeout is how long a candidate followed by others may take to accept a connection
+const dialProbeTimeout = 5 * time.Second
+
+// selection is the candidate picked for a connection
+type selection struct {
+	uniqueID   string
+	remoteAddr string
+	pipe       *pipeConfig
+
+	// fallback is true if another candidate follows pipe
+	fallback bool
+}
+
+func newFailover(cooldown time.Duration) *failover {
+	return &failover{
+		selected:  cache.New(selectionTTL, time.Minute),
+		failed:    cache.New(10*time.Minute, 10*time.Minute),
+		unhealthy: cache.New(cooldown, cooldown),
+	}
+}
+
+func (f *failover) selectPipe(conn libplugin.ConnMetadata, pipe *pipeConfig, fallback bool) {
+	s := selection{
+		uniqueID:   conn.UniqueID(),
+		remoteAddr: conn.RemoteAddr(),
+		pipe:       pipe,
+		fallback:   fallback,
+	}
+
+	f.selected.SetDefault(s.uniqueID, s)
+	f.selected.SetDefault(s.remoteAddr, s)
+}
+
+// selectedPipe returns the candidate picked for conn, nil once the pipe started or failed
+func (f *failover) selectedPipe(conn libplugin.ConnMetadata) *pipeConfig {
+	if item, found := f.selected.Get(conn.UniqueID()); found {
+		return item.(selection).pipe
+	}
+
+	return nil
+}
+
+// hasFallback reports whether another candidate follows the one picked for conn
+func (f *failover) hasFallback(conn libplugin.ConnMetadata) bool {
+	item, found := f.selected.Get(conn.UniqueID())
+	return found && item.(selection).fallback
+}
+
+// forget drops the decrypted pipe of a connection
+func (f *failover) forget(s selection) {
+	f.selected.Delete(s.uniqueID)
+	f.selected.Delete(s.remoteAddr)
+}
+
+// skip excludes the candidate of s from the retries of its connection
+func (f *failover) skip(s selection) {
+	failed := map[string]bool{s.pipe.upstreamKey(): true}
+	if item, found := f.failed.Get(s.uniqueID); found {
+		for k := range item.(map[string]bool) {
+			failed[k] = true
+		}
+	}
+
+	f.failed.SetDefault(s.uniqueID, failed)
+	f.forget(s)
+}
+
+func (f *failover) upstreamAuthFailed(conn libplugin.ConnMetadata) {
+	item, found := f.selected.Get(conn.UniqueID())
+	if !found {
+		return
+	}
+
+	s := item.(selection)
+	f.skip(s)
+
+	log.Infof("upstream %v auth failed for downstream %v, trying next candidate on retry", s.pipe.upstreamKey(), conn.User())
+}
+
+// dialFailed skips the candidate picked for conn and puts its host on the cooldown
+func (f *failover) dialFailed(conn libplugin.ConnMetadata, err error) {
+	item, found := f.selected.Get(conn.UniqueID())
+	if !found {
+		return
+	}
+
+	s := item.(selection)
+	f.skip(s)
+	f.unhealthy.SetDefault(s.pipe.UpstreamHost, time.Now())
+
+	log.Warnf("upstream %v marked unhealthy, trying next candidate for downstream %v: %v", s.pipe.UpstreamHost, conn.User(), err)
+}
+
+func (f *failover) pipeCreateFailed(remoteAddr string) {
+	item, found := f.selected.Get(remoteAddr)
+	if !found {
+		return
+	}
+
+	s := item.(selection)
+	f.forget(s)
+	f.unhealthy.SetDefault(s.pipe.UpstreamHost, time.Now())
+
+	log.Warnf("upstream %v marked unhealthy after failing to create pipe", s.pipe.UpstreamHost)
+}
+
+func (f *failover) pipeStarted(conn libplugin.ConnMetadata) {
+	f.selected.Delete(conn.UniqueID())
+	f.selected.Delete(conn.RemoteAddr())
+	f.failed.Delete(conn.UniqueID())
+}
+
+// connectUpstream returns u of a login, or retries the login with the next candidate while
+// the picked one cannot be dialed. The last candidate is left to sshpiperd to dial, so its
+// failure is reported as before. Jump routes are dialed here anyway to open their tunnel.
+func (p *plugin) connectUpstream(conn libplugin.ConnMetadata, u *libplugin.Upstream, retry func() (*libplugin.Upstream, error)) (*libplugin.Upstream, error) {
+	for {
+		pipe := p.failover.selectedPipe(conn)
+		if pipe == nil {
+			return u, nil
+		}
+
+		fallback := p.failover.hasFallback(conn)
+
+		if len(pipe.Via) > 0 {
+			tunneled, err := p.tunnelUpstream(conn, u)
+			if err == nil || !fallback {
+				return tunneled, err
+			}
+
+			p.failover.dialFailed(conn, err)
+		} else {
+			if !fallback {
+				return u, nil
+			}
+
+			err := probeDial(pipe.UpstreamHost)
+			if err == nil {
+				return u, nil
+			}
+
+			p.failover.dialFailed(conn, err)
+		}
+
+		next, err := retry()
+		if err != nil {
+			return nil, err
+		}
+
+		u = next
+	}
+}
+
+// probeDial checks that addr accepts connections
+func probeDial(addr string) error {
+	addr, err := sshAddress(addr)
+	if err != nil {
+		return err
+	}
+
+	c, err := net.DialTimeout("tcp", addr, dialProbeTimeout)
+	if err != nil {
+		return err
+	}
+
+	return c.Close()
+}
+
+// filter drops candidates whose upstream auth or dial already failed for this connection
+// and moves unhealthy upstreams behind the healthy ones
+func (f *failover) filter(conn libplugin.ConnMetadata, pipes []pipeConfig) []pipeConfig {
+	failed := map[string]bool{}
+	if item, found := f.failed.Get(conn.UniqueID()); found {
+		failed = item.(map[string]bool)
+	}
+
+	var healthy, unhealthy []pipeConfig
+
+	for _, pipe := range pipes {
+		if failed[pipe.upstreamKey()] {
+			continue
+		}
+
+		if _, found := f.unhealthy.Get(pipe.UpstreamHost); found {
+			unhealthy = append(unhealthy, pipe)
+			continue
+		}
+
+		healthy = append(healthy, pipe)
+	}
+
+	return append(healthy, unhealthy...)
+}
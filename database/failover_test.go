@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tg123/sshpiper/libplugin"
+)
+
+func TestConnectUpstreamSkipsUnreachableCandidate(t *testing.T) {
+	p := newTestPlugin(t)
+	p.failover = newFailover(time.Minute)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	if err := p.db.Create(&downstream{
+		Username: "bob",
+		Routes: []route{
+			{Upstream: upstream{Password: "pass", Server: server{Address: "127.0.0.1:1"}}},
+			{Upstream: upstream{Password: "pass", Server: server{Address: l.Addr().String()}}, Priority: 1},
+		},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &testConn{user: "bob", uniqueID: "1", remoteAddr: "10.0.0.1:50000"}
+
+	logins := 0
+	login := func() (*libplugin.Upstream, error) {
+		logins++
+
+		list, err := p.listPipe(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := list[0].From()[0].MatchConn(conn); err != nil {
+			return nil, err
+		}
+
+		return &libplugin.Upstream{}, nil
+	}
+
+	u, err := login()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.connectUpstream(conn, u, login); err != nil {
+		t.Fatal(err)
+	}
+
+	if pipe := p.failover.selectedPipe(conn); logins != 2 || pipe == nil || pipe.UpstreamHost != l.Addr().String() {
+		t.Errorf("expected the reachable candidate on the second login, got %+v after %v logins", pipe, logins)
+	}
+
+	if _, found := p.failover.unhealthy.Get("127.0.0.1:1"); !found {
+		t.Errorf("expected the unreachable candidate to be marked unhealthy")
+	}
+
+	// the decrypted pipe is dropped once the upstream rejected the login
+	p.failover.upstreamAuthFailed(conn)
+
+	if pipe := p.failover.selectedPipe(conn); pipe != nil {
+		t.Errorf("expected no pipe kept after upstream auth failure, got %+v", pipe)
+	}
+
+	if _, found := p.failover.selected.Get(conn.RemoteAddr()); found {
+		t.Errorf("expected no pipe kept by remote address after upstream auth failure")
+	}
+}
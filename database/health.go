@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// errDatabaseUnavailable replaces lookup errors while the database does not answer pings
+var errDatabaseUnavailable = errors.New("database unavailable")
+
+// databaseUnavailableBanner is shown to clients instead of a plain auth failure
+const databaseUnavailableBanner = "Login service temporarily unavailable, please try again later.\n"
+
+// database/sql keeps this many idle connections if not configured
+const defaultMaxIdleConns = 2
+
+// poolConfig tunes the connection pool of database/sql, zero values keep its defaults
+type poolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+func (c poolConfig) apply(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	if c.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(c.MaxOpenConns)
+	}
+
+	if c.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(c.MaxIdleConns)
+	}
+
+	if c.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(c.ConnMaxLifetime)
+	}
+
+	if c.ConnMaxIdleTime > 0 {
+		sqlDB.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+	}
+
+	return nil
+}
+
+// dbHealth pings the database, an outage is logged once and idle connections are
+// dropped, so connections opened after the database is back are new ones
+type dbHealth struct {
+	db       *gorm.DB
+	interval time.Duration
+	timeout  time.Duration
+	maxIdle  int
+
+	down atomic.Bool
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newDBHealth(db *gorm.DB, interval time.Duration, maxIdle int) *dbHealth {
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConns
+	}
+
+	timeout := 5 * time.Second
+	if interval > 0 && interval < timeout {
+		timeout = interval
+	}
+
+	return &dbHealth{
+		db:       db,
+		interval: interval,
+		timeout:  timeout,
+		maxIdle:  maxIdle,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start pings the database every interval until close, 0 only checks after failed lookups
+func (h *dbHealth) start() {
+	if h.interval <= 0 {
+		close(h.done)
+		return
+	}
+
+	go func() {
+		defer close(h.done)
+
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+				_ = h.check()
+			}
+		}
+	}()
+}
+
+func (h *dbHealth) close() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+
+	<-h.done
+}
+
+// check pings the database and updates the state
+func (h *dbHealth) check() error {
+	sqlDB, err := h.db.DB()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		err = sqlDB.PingContext(ctx)
+		cancel()
+	}
+
+	if err != nil {
+		if !h.down.Swap(true) {
+			log.Errorf("database unavailable, logins are rejected until it is back: %v", err)
+		}
+
+		if sqlDB != nil {
+			sqlDB.SetMaxIdleConns(-1)
+			sqlDB.SetMaxIdleConns(h.maxIdle)
+		}
+
+		return err
+	}
+
+	if h.down.Swap(false) {
+		log.Infof("database available again")
+	}
+
+	return nil
+}
+
+// unavailable reports the state of the last check, false if h is nil
+func (h *dbHealth) unavailable() bool {
+	return h != nil && h.down.Load()
+}
+
+// lookupFailed returns errDatabaseUnavailable if err of a lookup is caused by an unavailable database, err otherwise
+func (h *dbHealth) lookupFailed(err error) error {
+	if h == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	if h.check() != nil {
+		return errDatabaseUnavailable
+	}
+
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoolConfigApplied(t *testing.T) {
+	p := newTestPlugin(t)
+
+	if err := (poolConfig{MaxOpenConns: 7, ConnMaxLifetime: time.Minute}).apply(p.db); err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := p.db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := sqlDB.Stats().MaxOpenConnections; n != 7 {
+		t.Errorf("expected 7 max open connections, got %v", n)
+	}
+}
+
+func TestDatabaseUnavailable(t *testing.T) {
+	p := newTestPlugin(t)
+	p.health = newDBHealth(p.db, 0, 0)
+	p.health.start()
+
+	if err := p.db.Create(&downstream{
+		Username: "bob",
+		Upstream: upstream{Server: server{Address: "host:22"}},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.health.check(); err != nil || p.health.unavailable() {
+		t.Fatalf("expected database to be available: %v", err)
+	}
+
+	if _, err := p.loadPipeFromDB(&testConn{user: "alice"}); errors.Is(err, errDatabaseUnavailable) {
+		t.Errorf("expected unknown user not to be reported as unavailable database")
+	}
+
+	sqlDB, err := p.db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB.Close()
+
+	if _, err := p.loadPipeFromDB(&testConn{user: "bob"}); !errors.Is(err, errDatabaseUnavailable) {
+		t.Errorf("expected unavailable database, got %v", err)
+	}
+
+	if !p.health.unavailable() {
+		t.Errorf("expected failed lookup to mark the database unavailable")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/sshpiper/libplugin"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// errHostKeyRecorded rolls back recording a host key another connection recorded first
+var errHostKeyRecorded = errors.New("host key already recorded")
+
+// verifyHostKeyOnFirstUse verifies the host key of servers in trust on first use mode,
+// handled is false for other servers, which are verified by skel
+func (p *plugin) verifyHostKeyOnFirstUse(conn libplugin.ConnMetadata, hostname, netaddr string, key []byte) (handled bool, err error) {
+	pipe := p.failover.selectedPipe(conn)
+	if pipe == nil || !pipe.TrustOnFirstUse {
+		return false, nil
+	}
+
+	pub, err := ssh.ParsePublicKey(key)
+	if err != nil {
+		return true, err
+	}
+
+	// the cached pipe may predate the recorded key, read the server again
+	srv := server{}
+	if err := p.db.Preload("HostKey").First(&srv, pipe.ServerID).Error; err != nil {
+		return true, fmt.Errorf("server %v: %w", pipe.ServerID, err)
+	}
+
+	if strings.TrimSpace(srv.HostKey.Data) == "" {
+		err := p.recordHostKey(&srv, pub)
+		if err == nil {
+			log.Infof("recorded host key %v of %v on first use", ssh.FingerprintSHA256(pub), pipe.UpstreamHost)
+			p.audit.record(auditHostKeyRecorded, conn, "", nil)
+			return true, nil
+		}
+
+		if !errors.Is(err, errHostKeyRecorded) {
+			return true, fmt.Errorf("failed to record host key of %v: %w", pipe.UpstreamHost, err)
+		}
+
+		if err := p.db.Preload("HostKey").First(&srv, pipe.ServerID).Error; err != nil {
+			return true, fmt.Errorf("server %v: %w", pipe.ServerID, err)
+		}
+	}
+
+	if err := verifyPipeHostKey(pipe, srv.HostKey.Data, hostname, netaddr, key); err != nil {
+		log.Warnf("host key %v of %v does not match the key recorded on first use: %v", ssh.FingerprintSHA256(pub), pipe.UpstreamHost, err)
+		p.audit.record(auditHostKeyMismatch, conn, "", err)
+		return true, err
+	}
+
+	return true, nil
+}
+
+// recordHostKey stores pub as host key of srv unless the host key changed since srv was read
+func (p *plugin) recordHostKey(srv *server, pub ssh.PublicKey) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		k := keydata{
+			Data: string(ssh.MarshalAuthorizedKey(pub)),
+			Type: "publickey",
+		}
+
+		if err := tx.Create(&k).Error; err != nil {
+			return err
+		}
+
+		query := tx.Model(&server{}).Where("id = ?", srv.ID)
+		if srv.HostKeyID == 0 {
+			query = query.Where("host_key_id = 0 OR host_key_id IS NULL")
+		} else {
+			query = query.Where("host_key_id = ?", srv.HostKeyID)
+		}
+
+		result := query.Update("host_key_id", k.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return errHostKeyRecorded
+		}
+
+		return nil
+	})
+}
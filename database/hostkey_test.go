@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to convert host key: %v", err)
+	}
+
+	return key
+}
+
+func TestHostKeyTrustOnFirstUse(t *testing.T) {
+	p := newTestPlugin(t)
+	p.failover = newFailover(time.Minute)
+
+	if err := p.db.Create(&downstream{
+		Username: "bob",
+		Upstream: upstream{Server: server{Address: "host:22", TrustOnFirstUse: true}},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(id string, key ssh.PublicKey) error {
+		conn := &testConn{user: "bob", uniqueID: id, remoteAddr: "10.0.0.1:" + id}
+
+		pipes, err := p.loadPipeFromDB(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p.failover.selectPipe(conn, &pipes[0], false)
+
+		handled, err := p.verifyHostKeyOnFirstUse(conn, "host:22", "127.0.0.1:22", key.Marshal())
+		if !handled {
+			t.Fatalf("expected trust on first use server to be handled")
+		}
+
+		return err
+	}
+
+	first := newTestHostKey(t)
+
+	if err := verify("1", first); err != nil {
+		t.Fatalf("expected first key to be trusted: %v", err)
+	}
+
+	s := server{}
+	if err := p.db.Preload("HostKey").First(&s).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if s.HostKey.Data != string(ssh.MarshalAuthorizedKey(first)) {
+		t.Errorf("expected first key to be recorded, got %q", s.HostKey.Data)
+	}
+
+	if err := verify("2", first); err != nil {
+		t.Errorf("expected recorded key to verify: %v", err)
+	}
+
+	if err := verify("3", newTestHostKey(t)); err == nil {
+		t.Errorf("expected a different key to be rejected")
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/sshpiper/libplugin"
+	"github.com/tg123/sshpiper/libplugin/skel"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gorm.io/gorm"
+)
+
+// maxJumpHops bounds the jump chain of a server
+const maxJumpHops = 8
+
+// jumpHop is a jump server a pipe is tunneled through
+type jumpHop struct {
+	ServerID      uint
+	Name          string
+	Address       string
+	Username      string
+	Password      string
+	PrivateKey    keydata
+	HostKey       keydata
+	IgnoreHostKey bool
+}
+
+// lookupJumpHops returns the jump chain of srv, the jump server to dial first comes first
+func lookupJumpHops(db *gorm.DB, srv *server) ([]jumpHop, error) {
+	var hops []jumpHop
+
+	seen := map[uint]bool{srv.ID: true}
+
+	for id := srv.ViaServerID; id != 0; {
+		if len(hops) == maxJumpHops {
+			return nil, fmt.Errorf("server %v: more than %v jump servers", srv.Name, maxJumpHops)
+		}
+
+		via := server{}
+		if err := db.Preload("HostKey").Preload("JumpPrivateKey").First(&via, id).Error; err != nil {
+			return nil, fmt.Errorf("server %v: jump server %v: %w", srv.Name, id, err)
+		}
+
+		if seen[via.ID] {
+			return nil, fmt.Errorf("server %v: jump chain loops at %v", srv.Name, via.Name)
+		}
+
+		seen[via.ID] = true
+
+		if strings.TrimSpace(via.HostKey.Data) == "" && !via.IgnoreHostKey {
+			return nil, fmt.Errorf("server %v: jump server %v has no host key", srv.Name, via.Name)
+		}
+
+		// the chain is walked from the upstream back to the first hop
+		hops = append([]jumpHop{{
+			ServerID:      via.ID,
+			Name:          via.Name,
+			Address:       via.Address,
+			Username:      via.JumpUsername,
+			Password:      via.JumpPassword,
+			PrivateKey:    via.JumpPrivateKey,
+			HostKey:       via.HostKey,
+			IgnoreHostKey: via.IgnoreHostKey,
+		}}, hops...)
+
+		id = via.ViaServerID
+	}
+
+	return hops, nil
+}
+
+// sshAddress returns addr as host:port, port 22 if addr has none
+func sshAddress(addr string) (string, error) {
+	host, port, err := libplugin.SplitHostPortForSSH(addr)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// hostAddr is a net.Addr of a host name, so known hosts match by name when the
+// address dialed is the tunnel rather than the host
+type hostAddr string
+
+func (hostAddr) Network() string  { return "tcp" }
+func (a hostAddr) String() string { return string(a) }
+
+// verifyHostKey verifies pub against the host key data of host, see knownHostsData
+func verifyHostKey(data, host string, pub ssh.PublicKey) error {
+	addr, err := sshAddress(host)
+	if err != nil {
+		return err
+	}
+
+	callback, err := knownhosts.NewFromReader(bytes.NewReader(knownHostsData(data, addr)))
+	if err != nil {
+		return err
+	}
+
+	return callback(addr, hostAddr(addr), pub)
+}
+
+// verifyPipeHostKey verifies key against the host key data of pipe, tunneled pipes
+// are verified by the upstream address instead of the tunnel sshpiperd dialed
+func verifyPipeHostKey(pipe *pipeConfig, data, hostname, netaddr string, key []byte) error {
+	if len(pipe.Via) == 0 {
+		return skel.VerifyHostKeyFromKnownHosts(bytes.NewReader(knownHostsData(data, pipe.UpstreamHost)), hostname, netaddr, key)
+	}
+
+	pub, err := ssh.ParsePublicKey(key)
+	if err != nil {
+		return err
+	}
+
+	return verifyHostKey(data, pipe.UpstreamHost, pub)
+}
+
+// verifyTunneledHostKey verifies the host key of tunneled pipes, handled is false for other pipes
+func (p *plugin) verifyTunneledHostKey(conn libplugin.ConnMetadata, key []byte) (handled bool, err error) {
+	pipe := p.failover.selectedPipe(conn)
+	if pipe == nil || len(pipe.Via) == 0 {
+		return false, nil
+	}
+
+	pub, err := ssh.ParsePublicKey(key)
+	if err != nil {
+		return true, err
+	}
+
+	return true, verifyHostKey(pipe.KnownHosts.Data, pipe.UpstreamHost, pub)
+}
+
+// clientConfig returns the ssh client config logging in to hop as user unless the hop has its own username
+func (h *jumpHop) clientConfig(user string, timeout time.Duration) (*ssh.ClientConfig, error) {
+	addr, err := sshAddress(h.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:    withDefault(h.Username, user),
+		Timeout: timeout,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return verifyHostKey(h.HostKey.Data, addr, key)
+		},
+	}
+
+	if h.IgnoreHostKey {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+
+	if data := strings.TrimSpace(h.PrivateKey.Data); data != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("private key: %w", err)
+		}
+
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+
+	if h.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(h.Password))
+	}
+
+	if len(config.Auth) == 0 {
+		return nil, fmt.Errorf("no jump password or private key")
+	}
+
+	return config, nil
+}
+
+// jumpChain are the clients of the jump servers of a tunnel, each dialed through the one before
+type jumpChain []*ssh.Client
+
+// dialJumpChain logs in to every hop in order, user is the upstream username
+func dialJumpChain(hops []jumpHop, user string, timeout time.Duration) (jumpChain, error) {
+	var chain jumpChain
+
+	for i := range hops {
+		hop := &hops[i]
+
+		client, err := chain.login(hop, user, timeout)
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("jump server %v: %w", hop.Name, err)
+		}
+
+		chain = append(chain, client)
+	}
+
+	return chain, nil
+}
+
+func (c jumpChain) login(hop *jumpHop, user string, timeout time.Duration) (*ssh.Client, error) {
+	config, err := hop.clientConfig(user, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := sshAddress(hop.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if len(c) == 0 {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	} else {
+		conn, err = c.dial(addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return handshake(conn, addr, config, timeout)
+}
+
+// handshake logs in to addr over conn, the ssh client config timeout only bounds dialing,
+// so conn is closed if the handshake takes longer than timeout
+func handshake(conn net.Conn, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() { conn.Close() })
+	}
+
+	sshconn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			sshconn.Close()
+		}
+
+		return nil, fmt.Errorf("ssh handshake timed out after %v", timeout)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(sshconn, chans, reqs), nil
+}
+
+// dial opens a connection to addr from the last jump server
+func (c jumpChain) dial(addr string) (net.Conn, error) {
+	return c[len(c)-1].Dial("tcp", addr)
+}
+
+// Close logs out of the jump servers, last first
+func (c jumpChain) Close() {
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i].Close()
+	}
+}
+
+// tunnelUpstream points u at a tunnel through the jump servers of the selected pipe. It is
+// called once the downstream is authenticated and u is the upstream sshpiperd connects to,
+// so the jump servers are not logged in to for logins that fail or are still pending.
+func (p *plugin) tunnelUpstream(conn libplugin.ConnMetadata, u *libplugin.Upstream) (*libplugin.Upstream, error) {
+	pipe := p.failover.selectedPipe(conn)
+	if pipe == nil || len(pipe.Via) == 0 {
+		return u, nil
+	}
+
+	addr, err := p.openTunnel(pipe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tunnel to %v: %w", pipe.UpstreamHost, err)
+	}
+
+	host, port, err := libplugin.SplitHostPortForSSH(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Host, u.Port = host, int32(port)
+
+	return u, nil
+}
+
+// openTunnel dials the jump chain of pipe and returns a local address forwarding the
+// first connection of sshpiperd to the upstream, for sshpiperd to dial instead of the upstream
+func (p *plugin) openTunnel(pipe *pipeConfig) (string, error) {
+	if p.jumpErr != nil {
+		return "", p.jumpErr
+	}
+
+	target, err := sshAddress(pipe.UpstreamHost)
+	if err != nil {
+		return "", err
+	}
+
+	chain, err := dialJumpChain(pipe.Via, pipe.MappedUsername, p.jumpTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		chain.Close()
+		return "", err
+	}
+
+	pid := p.tunnelPeer
+	if pid == 0 {
+		pid = os.Getppid()
+	}
+
+	go forwardOnce(l.(*net.TCPListener), chain, target, pid, p.jumpTimeout)
+
+	return l.Addr().String(), nil
+}
+
+// checkTunnelPeer returns why jump tunnels cannot tell connections of process pid from
+// others. The peer is found by its socket in /proc/net/tcp, which only lists IPv4, and the
+// descriptors in /proc/<pid>/fd, so this needs Linux and the permission to read the
+// descriptors of pid. The tunnels only accept sshpiperd as the direct parent of the plugin.
+func checkTunnelPeer(pid int) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("jump tunnels need procfs of linux to verify sshpiperd, not %v", runtime.GOOS)
+	}
+
+	if _, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid)); err != nil {
+		return fmt.Errorf("jump tunnels cannot verify sshpiperd: %w", err)
+	}
+
+	// a tunnel connection of this process must be recognized
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	defer l.Close()
+
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return err
+	}
+
+	defer dialed.Close()
+
+	accepted, err := l.Accept()
+	if err != nil {
+		return err
+	}
+
+	defer accepted.Close()
+
+	ok, err := dialedBy(accepted, os.Getpid())
+	if err != nil {
+		return fmt.Errorf("jump tunnels cannot verify their peer: %w", err)
+	}
+
+	if !ok {
+		return fmt.Errorf("jump tunnels cannot verify their peer, own connection not found")
+	}
+
+	return nil
+}
+
+// checkJumpRoutes refuses to start if servers are reached through jump servers while
+// tunnels cannot verify sshpiperd, tunnels opened later fail with the same error
+func (p *plugin) checkJumpRoutes() error {
+	pid := p.tunnelPeer
+	if pid == 0 {
+		pid = os.Getppid()
+	}
+
+	p.jumpErr = checkTunnelPeer(pid)
+	if p.jumpErr == nil || p.queries != nil {
+		return nil
+	}
+
+	var routes int64
+	if err := p.db.Model(&server{}).Where("via_server_id <> 0").Count(&routes).Error; err != nil {
+		return err
+	}
+
+	if routes > 0 {
+		return fmt.Errorf("%v servers are reached through jump servers: %w", routes, p.jumpErr)
+	}
+
+	log.Warnf("jump servers are not supported: %v", p.jumpErr)
+
+	return nil
+}
+
+// forwardOnce forwards the first connection of process pid accepted by l to target through
+// chain, then closes both, no such connection within timeout closes them too
+func forwardOnce(l *net.TCPListener, chain jumpChain, target string, pid int, timeout time.Duration) {
+	defer chain.Close()
+
+	if timeout > 0 {
+		_ = l.SetDeadline(time.Now().Add(timeout))
+	}
+
+	local, err := acceptFrom(l, pid)
+	l.Close()
+
+	if err != nil {
+		log.Warnf("jump tunnel to %v not used: %v", target, err)
+		return
+	}
+
+	defer local.Close()
+
+	remote, err := chain.dial(target)
+	if err != nil {
+		log.Warnf("failed to dial %v from the last jump server: %v", target, err)
+		return
+	}
+
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		_, _ = io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		_, _ = io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+
+	<-done
+}
+
+// acceptFrom returns the first connection of l dialed by process pid, other connections
+// are closed as they would reach the upstream with the jump credentials of the operator
+func acceptFrom(l net.Listener, pid int) (net.Conn, error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ok, err := dialedBy(conn, pid)
+		if ok {
+			return conn, nil
+		}
+
+		if err == nil {
+			err = fmt.Errorf("not dialed by process %v", pid)
+		}
+
+		log.Warnf("rejected jump tunnel connection from %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+	}
+}
+
+// dialedBy reports whether the loopback connection conn was dialed by process pid, by
+// looking up the inode of the peer socket in /proc/net/tcp among the descriptors of pid.
+// Without procfs no connection is accepted, so jump chains need Linux, see checkTunnelPeer.
+func dialedBy(conn net.Conn, pid int) (bool, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return false, fmt.Errorf("not a tcp connection")
+	}
+
+	peer, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false, fmt.Errorf("not a tcp connection")
+	}
+
+	// the socket of the peer is bound to its address and connected to ours
+	inode, err := tcpSocketInode(peer, local)
+	if err != nil {
+		return false, err
+	}
+
+	dir := fmt.Sprintf("/proc/%d/fd", pid)
+
+	fds, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+
+	socket := "socket:[" + inode + "]"
+
+	for _, fd := range fds {
+		if link, err := os.Readlink(filepath.Join(dir, fd.Name())); err == nil && link == socket {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// tcpSocketInode returns the inode of the IPv4 socket bound to local and connected to remote
+func tcpSocketInode(local, remote *net.TCPAddr) (string, error) {
+	data, err := os.ReadFile("/proc/net/tcp")
+	if err != nil {
+		return "", err
+	}
+
+	localAddr, remoteAddr := procNetAddr(local), procNetAddr(remote)
+
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+
+		if fields[1] == localAddr && fields[2] == remoteAddr {
+			return fields[9], nil
+		}
+	}
+
+	return "", fmt.Errorf("no socket %v connected to %v", local, remote)
+}
+
+// procNetAddr formats an IPv4 address as /proc/net/tcp does, the address in host byte order
+func procNetAddr(addr *net.TCPAddr) string {
+	var ip uint32
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		ip = binary.NativeEndian.Uint32(ip4)
+	}
+
+	return fmt.Sprintf("%08X:%04X", ip, addr.Port)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tg123/sshpiper/libplugin"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestJumpServer starts an ssh server forwarding direct-tcpip channels for user jump with password
+func newTestJumpServer(t *testing.T, password string) (string, ssh.PublicKey) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if conn.User() == "jump" && string(pass) == password {
+				return nil, nil
+			}
+
+			return nil, fmt.Errorf("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveTestJump(conn, config)
+		}
+	}()
+
+	return l.Addr().String(), signer.PublicKey()
+}
+
+func serveTestJump(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for ch := range chans {
+		if ch.ChannelType() != "direct-tcpip" {
+			_ = ch.Reject(ssh.UnknownChannelType, ch.ChannelType())
+			continue
+		}
+
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+
+		if err := ssh.Unmarshal(ch.ExtraData(), &target); err != nil {
+			_ = ch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			_ = ch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		c, creqs, err := ch.Accept()
+		if err != nil {
+			upstream.Close()
+			continue
+		}
+
+		go ssh.DiscardRequests(creqs)
+
+		go func() {
+			_, _ = io.Copy(c, upstream)
+			c.Close()
+		}()
+
+		go func() {
+			_, _ = io.Copy(upstream, c)
+			upstream.Close()
+		}()
+	}
+}
+
+func newTestEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestJumpChainTunnel(t *testing.T) {
+	first, firstKey := newTestJumpServer(t, "one")
+	second, secondKey := newTestJumpServer(t, "two")
+
+	if runtime.GOOS != "linux" {
+		t.Skip("jump tunnels verify their peer by procfs")
+	}
+
+	p := &plugin{jumpTimeout: 5 * time.Second, tunnelPeer: os.Getpid()}
+	pipe := &pipeConfig{
+		UpstreamHost:   newTestEchoServer(t),
+		MappedUsername: "bob",
+		Via: []jumpHop{
+			{Name: "first", Address: first, Username: "jump", Password: "one", HostKey: keydata{Data: string(ssh.MarshalAuthorizedKey(firstKey))}},
+			{Name: "second", Address: second, Username: "jump", Password: "two", HostKey: keydata{Data: string(ssh.MarshalAuthorizedKey(secondKey))}},
+		},
+	}
+
+	addr, err := p.openTunnel(pipe)
+	if err != nil {
+		t.Fatalf("failed to open tunnel: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected echo through the tunnel, got %q, %v", buf, err)
+	}
+
+	// a connection of another process must not reach the upstream
+	p.tunnelPeer = os.Getppid()
+
+	addr, err = p.openTunnel(pipe)
+	if err != nil {
+		t.Fatalf("failed to open tunnel: %v", err)
+	}
+
+	foreign, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foreign.Close()
+
+	_ = foreign.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := foreign.Write([]byte("ping")); err == nil {
+		if _, err := io.ReadFull(foreign, buf); err == nil {
+			t.Errorf("expected connection of another process to be rejected, got %q", buf)
+		}
+	}
+
+	p.tunnelPeer = os.Getpid()
+	p.failover = newFailover(time.Minute)
+
+	client := &testConn{user: "bob", uniqueID: "jump"}
+	p.failover.selectPipe(client, pipe, false)
+
+	u, err := p.tunnelUpstream(client, &libplugin.Upstream{Host: "unreachable", Port: 22})
+	if err != nil || u.Host != "127.0.0.1" || u.Port == 22 {
+		t.Errorf("expected upstream to point at the tunnel, got %+v, %v", u, err)
+	}
+
+	pipe.Via[1].HostKey.Data = string(ssh.MarshalAuthorizedKey(newTestHostKey(t)))
+	if _, err := p.openTunnel(pipe); err == nil {
+		t.Errorf("expected host key mismatch of the second jump server to fail")
+	}
+
+	pipe.Via[1].HostKey.Data = string(ssh.MarshalAuthorizedKey(secondKey))
+	pipe.Via[1].Password = "wrong"
+	if _, err := p.openTunnel(pipe); err == nil {
+		t.Errorf("expected wrong jump password to fail")
+	}
+}
+
+func TestLookupJumpHopsLoop(t *testing.T) {
+	p := newTestPlugin(t)
+
+	a := server{Name: "a", Address: "a:22", IgnoreHostKey: true}
+	b := server{Name: "b", Address: "b:22", IgnoreHostKey: true}
+
+	if err := p.db.Create(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	b.ViaServerID = int(a.ID)
+	if err := p.db.Create(&b).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if hops, err := lookupJumpHops(p.db, &b); err != nil || len(hops) != 1 || hops[0].Name != "a" {
+		t.Errorf("expected a as jump server of b, got %+v, %v", hops, err)
+	}
+
+	if err := p.db.Model(&a).UpdateColumn("via_server_id", b.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lookupJumpHops(p.db, &b); err == nil {
+		t.Errorf("expected jump chain loop to fail")
+	}
+}
+
+func TestJumpHandshakeTimeout(t *testing.T) {
+	// accepts connections but never sends an ssh version
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	hops := []jumpHop{{Name: "silent", Address: l.Addr().String(), Password: "one", IgnoreHostKey: true}}
+
+	start := time.Now()
+
+	if _, err := dialJumpChain(hops, "bob", 200*time.Millisecond); err == nil {
+		t.Errorf("expected silent jump server to fail")
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected handshake to time out, took %v", elapsed)
+	}
+}
+
+func TestCheckJumpRoutes(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("jump tunnels verify their peer by procfs")
+	}
+
+	p := newTestPlugin(t)
+
+	// no such process
+	p.tunnelPeer = 1 << 30
+
+	if err := p.checkJumpRoutes(); err != nil {
+		t.Errorf("expected no jump routes to start, got %v", err)
+	}
+
+	if _, err := p.openTunnel(&pipeConfig{UpstreamHost: "host:22"}); err == nil {
+		t.Errorf("expected tunnel to fail without peer verification")
+	}
+
+	a := server{Name: "a", Address: "a:22", IgnoreHostKey: true}
+	if err := p.db.Create(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.db.Create(&server{Name: "b", Address: "b:22", IgnoreHostKey: true, ViaServerID: int(a.ID)}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.checkJumpRoutes(); err == nil {
+		t.Errorf("expected jump routes to be refused without peer verification")
+	}
+
+	p.tunnelPeer = os.Getpid()
+
+	if err := p.checkJumpRoutes(); err != nil {
+		t.Errorf("expected jump routes with peer verification to start, got %v", err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/sshpiper/libplugin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errLockedOut = errors.New("too many failed login attempts, try again later")
+
+// lockoutStore counts failed logins per subject, an ip or username. A subject
+// reaching maxFailures within window is locked for duration.
+type lockoutStore interface {
+	lockedUntil(subject string, now time.Time) (time.Time, error)
+	fail(subject string, now time.Time, maxFailures int, window, duration time.Duration) (time.Time, error)
+	reset(subject string) error
+}
+
+// lockout rejects authentication from ips and for usernames with too many
+// recent failures, before the credentials are checked
+type lockout struct {
+	store lockoutStore
+
+	maxIPFailures   int
+	maxUserFailures int
+	window          time.Duration
+	duration        time.Duration
+
+	now func() time.Time
+
+	rejectedKeys *cache.Cache // conn unique id -> true once a public key of the connection was rejected
+}
+
+func newLockout(store lockoutStore, maxIPFailures, maxUserFailures int, window, duration time.Duration) *lockout {
+	return &lockout{
+		store:           store,
+		maxIPFailures:   maxIPFailures,
+		maxUserFailures: maxUserFailures,
+		window:          window,
+		duration:        duration,
+		now:             time.Now,
+		rejectedKeys:    cache.New(10*time.Minute, time.Minute),
+	}
+}
+
+func (l *lockout) subjects(conn libplugin.ConnMetadata) map[string]int {
+	subjects := map[string]int{}
+
+	if l.maxIPFailures > 0 {
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr())
+		if err != nil {
+			ip = conn.RemoteAddr()
+		}
+
+		subjects["ip:"+ip] = l.maxIPFailures
+	}
+
+	if l.maxUserFailures > 0 && conn.User() != "" {
+		subjects["user:"+conn.User()] = l.maxUserFailures
+	}
+
+	return subjects
+}
+
+// check returns errLockedOut if the ip or username of conn is locked,
+// store errors are logged and do not lock anyone out
+func (l *lockout) check(conn libplugin.ConnMetadata) error {
+	now := l.now()
+
+	for subject := range l.subjects(conn) {
+		until, err := l.store.lockedUntil(subject, now)
+		if err != nil {
+			log.Warnf("failed to check lockout of %v: %v", subject, err)
+			continue
+		}
+
+		if until.After(now) {
+			log.Warnf("rejecting %v from %v, %v locked until %v", conn.User(), conn.RemoteAddr(), subject, until.Format(time.RFC3339))
+			return errLockedOut
+		}
+	}
+
+	return nil
+}
+
+func (l *lockout) failed(conn libplugin.ConnMetadata) {
+	now := l.now()
+
+	for subject, maxFailures := range l.subjects(conn) {
+		until, err := l.store.fail(subject, now, maxFailures, l.window, l.duration)
+		if err != nil {
+			log.Warnf("failed to record failed login of %v: %v", subject, err)
+			continue
+		}
+
+		if until.After(now) {
+			log.Warnf("%v locked until %v after %v failed logins", subject, until.Format(time.RFC3339), maxFailures)
+		}
+	}
+}
+
+// succeeded forgets the failures of the username, failures of the ip are kept so
+// one valid account does not reset the count of an ip guessing others
+func (l *lockout) succeeded(conn libplugin.ConnMetadata) {
+	if l.maxUserFailures <= 0 {
+		return
+	}
+
+	if err := l.store.reset("user:" + conn.User()); err != nil {
+		log.Warnf("failed to reset failed logins of %v: %v", conn.User(), err)
+	}
+}
+
+// publicKeyFailed counts rejected public keys once per connection, clients offer
+// every key of their agent in turn before the right one
+func (l *lockout) publicKeyFailed(conn libplugin.ConnMetadata) {
+	if err := l.rejectedKeys.Add(conn.UniqueID(), true, cache.DefaultExpiration); err != nil {
+		return
+	}
+
+	l.failed(conn)
+}
+
+// instrument checks the lockout before password and public key auth and counts their
+// failures. Keyboard-interactive auth is not throttled, the target menu completes logins
+// whose password already passed the lockout.
+func (l *lockout) instrument(config *libplugin.SshPiperPluginConfig) {
+	originNewConnection := config.NewConnectionCallback
+
+	config.NewConnectionCallback = func(conn libplugin.ConnMetadata) error {
+		if err := l.check(conn); err != nil {
+			return err
+		}
+
+		if originNewConnection != nil {
+			return originNewConnection(conn)
+		}
+
+		return nil
+	}
+
+	if originPassword := config.PasswordCallback; originPassword != nil {
+		config.PasswordCallback = func(conn libplugin.ConnMetadata, password []byte) (*libplugin.Upstream, error) {
+			if err := l.check(conn); err != nil {
+				return nil, err
+			}
+
+			u, err := originPassword(conn, password)
+			l.result(conn, err, l.failed)
+			return u, err
+		}
+	}
+
+	if originPublicKey := config.PublicKeyCallback; originPublicKey != nil {
+		config.PublicKeyCallback = func(conn libplugin.ConnMetadata, key []byte) (*libplugin.Upstream, error) {
+			if err := l.check(conn); err != nil {
+				return nil, err
+			}
+
+			u, err := originPublicKey(conn, key)
+			l.result(conn, err, l.publicKeyFailed)
+			return u, err
+		}
+	}
+}
+
+func (l *lockout) result(conn libplugin.ConnMetadata, err error, failed func(libplugin.ConnMetadata)) {
+	switch {
+	case errors.Is(err, errTargetSelectionRequired):
+		// the login is completed by the target menu
+	case errors.Is(err, errDatabaseUnavailable):
+		// not the fault of the client
+	case err != nil:
+		failed(conn)
+	default:
+		l.succeeded(conn)
+	}
+}
+
+// lockoutState is the failure count of a subject
+type lockoutState struct {
+	failures       int
+	firstFailureAt time.Time
+	lockedUntil    time.Time
+}
+
+// next returns the state after a failure at now
+func (s lockoutState) next(now time.Time, maxFailures int, window, duration time.Duration) lockoutState {
+	if s.failures == 0 || now.Sub(s.firstFailureAt) > window {
+		s.failures = 0
+		s.firstFailureAt = now
+	}
+
+	s.failures++
+
+	if s.failures >= maxFailures {
+		s.failures = 0
+		s.lockedUntil = now.Add(duration)
+	}
+
+	return s
+}
+
+// memoryLockoutStore keeps failures in memory of this sshpiperd
+type memoryLockoutStore struct {
+	mu      sync.Mutex
+	entries *cache.Cache // subject -> lockoutState
+}
+
+func newMemoryLockoutStore() *memoryLockoutStore {
+	return &memoryLockoutStore{
+		entries: cache.New(time.Hour, 10*time.Minute),
+	}
+}
+
+func (m *memoryLockoutStore) lockedUntil(subject string, now time.Time) (time.Time, error) {
+	if v, found := m.entries.Get(subject); found {
+		return v.(lockoutState).lockedUntil, nil
+	}
+
+	return time.Time{}, nil
+}
+
+func (m *memoryLockoutStore) fail(subject string, now time.Time, maxFailures int, window, duration time.Duration) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := lockoutState{}
+	if v, found := m.entries.Get(subject); found {
+		s = v.(lockoutState)
+	}
+
+	s = s.next(now, maxFailures, window, duration)
+	m.entries.Set(subject, s, max(window, duration))
+
+	return s.lockedUntil, nil
+}
+
+func (m *memoryLockoutStore) reset(subject string) error {
+	m.entries.Delete(subject)
+	return nil
+}
+
+// dbLockoutStore keeps failures in the login_lockouts table, shared by all sshpiperd using the database
+type dbLockoutStore struct {
+	db *gorm.DB
+
+	mu        sync.Mutex
+	cleanedAt time.Time
+}
+
+func (d *dbLockoutStore) lockedUntil(subject string, now time.Time) (time.Time, error) {
+	l := loginLockout{}
+	err := d.db.Where(&loginLockout{Subject: subject}).First(&l).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return time.Time{}, nil
+	}
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if l.LockedUntil == nil {
+		return time.Time{}, nil
+	}
+
+	return *l.LockedUntil, nil
+}
+
+func (d *dbLockoutStore) fail(subject string, now time.Time, maxFailures int, window, duration time.Duration) (time.Time, error) {
+	var until time.Time
+
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		// a concurrent first failure of the subject inserts the same row
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "subject"}},
+			DoNothing: true,
+		}).Create(&loginLockout{Subject: subject}).Error; err != nil {
+			return err
+		}
+
+		// locks the row until the transaction ends, concurrent failures of the subject wait here
+		if err := tx.Model(&loginLockout{}).Where(&loginLockout{Subject: subject}).Update("updated_at", now).Error; err != nil {
+			return err
+		}
+
+		l := loginLockout{}
+		if err := tx.Where(&loginLockout{Subject: subject}).First(&l).Error; err != nil {
+			return err
+		}
+
+		s := lockoutState{
+			failures:       l.Failures,
+			firstFailureAt: l.FirstFailureAt,
+		}.next(now, maxFailures, window, duration)
+
+		l.Failures = s.failures
+		l.FirstFailureAt = s.firstFailureAt
+
+		if !s.lockedUntil.IsZero() {
+			l.LockedUntil = &s.lockedUntil
+		}
+
+		until = s.lockedUntil
+
+		return tx.Save(&l).Error
+	})
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("login lockout %v: %w", subject, err)
+	}
+
+	if err := d.deleteExpired(now, window); err != nil {
+		log.Warnf("failed to delete expired login lockouts: %v", err)
+	}
+
+	return until, nil
+}
+
+// deleteExpired removes rows whose failures are older than window and whose lock is over,
+// at most once per window, so guessed usernames do not pile up
+func (d *dbLockoutStore) deleteExpired(now time.Time, window time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.cleanedAt) < window {
+		return nil
+	}
+
+	d.cleanedAt = now
+
+	return d.db.
+		Where("first_failure_at < ?", now.Add(-window)).
+		Where("(locked_until IS NULL OR locked_until < ?)", now).
+		Delete(&loginLockout{}).Error
+}
+
+func (d *dbLockoutStore) reset(subject string) error {
+	return d.db.Where(&loginLockout{Subject: subject}).Delete(&loginLockout{}).Error
+}
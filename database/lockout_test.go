@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tg123/sshpiper/libplugin"
+)
+
+func TestLockout(t *testing.T) {
+	p := newTestPlugin(t)
+
+	for name, store := range map[string]lockoutStore{
+		"memory":   newMemoryLockoutStore(),
+		"database": &dbLockoutStore{db: p.db},
+	} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+			l := newLockout(store, 5, 3, time.Minute, 10*time.Minute)
+			l.now = func() time.Time { return now }
+
+			config := &libplugin.SshPiperPluginConfig{
+				PasswordCallback: func(conn libplugin.ConnMetadata, password []byte) (*libplugin.Upstream, error) {
+					if string(password) != "secret" {
+						return nil, errors.New("wrong password")
+					}
+
+					return &libplugin.Upstream{}, nil
+				},
+			}
+
+			l.instrument(config)
+
+			alice := &testConn{user: "alice", remoteAddr: "10.0.0.1:50000"}
+			carol := &testConn{user: "carol", remoteAddr: "10.0.0.1:50001"}
+			bob := &testConn{user: "bob", remoteAddr: "10.0.0.2:50000"}
+
+			// a success resets the username count
+			for _, password := range []string{"wrong", "wrong", "secret", "wrong", "wrong"} {
+				_, _ = config.PasswordCallback(alice, []byte(password))
+			}
+
+			if _, err := config.PasswordCallback(alice, []byte("secret")); err != nil {
+				t.Fatalf("expected alice not to be locked yet: %v", err)
+			}
+
+			// 3 failures lock bob from any ip
+			for i := 0; i < 3; i++ {
+				_, _ = config.PasswordCallback(bob, []byte("wrong"))
+			}
+
+			if _, err := config.PasswordCallback(bob, []byte("secret")); !errors.Is(err, errLockedOut) {
+				t.Errorf("expected bob to be locked, got %v", err)
+			}
+
+			// the ip of alice reaches 5 failures together with a failure of carol
+			_, _ = config.PasswordCallback(carol, []byte("wrong"))
+
+			if err := config.NewConnectionCallback(alice); !errors.Is(err, errLockedOut) {
+				t.Errorf("expected ip to be locked, got %v", err)
+			}
+
+			now = now.Add(11 * time.Minute)
+
+			if _, err := config.PasswordCallback(alice, []byte("secret")); err != nil {
+				t.Errorf("expected lockout to expire: %v", err)
+			}
+
+			if _, err := config.PasswordCallback(bob, []byte("secret")); err != nil {
+				t.Errorf("expected lockout to expire: %v", err)
+			}
+		})
+	}
+}
+
+func TestDatabaseLockoutDeletesExpired(t *testing.T) {
+	p := newTestPlugin(t)
+	store := &dbLockoutStore{db: p.db}
+
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	for _, subject := range []string{"user:guess1", "user:guess2"} {
+		if _, err := store.fail(subject, now, 3, time.Minute, 10*time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.fail("user:bob", now, 3, time.Minute, 10*time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the failures of the guesses are out of the window, bob is still locked
+	now = now.Add(2 * time.Minute)
+
+	if _, err := store.fail("user:alice", now, 3, time.Minute, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	var subjects []string
+	if err := p.db.Model(&loginLockout{}).Order("subject").Pluck("subject", &subjects).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(subjects, []string{"user:alice", "user:bob"}) {
+		t.Errorf("expected expired rows deleted, got %v", subjects)
+	}
+
+	if until, err := store.lockedUntil("user:bob", now); err != nil || !until.After(now) {
+		t.Errorf("expected bob to stay locked, got %v, %v", until, err)
+	}
+}
+
+func TestLockoutCountsRejectedKeysOncePerConnection(t *testing.T) {
+	l := newLockout(newMemoryLockoutStore(), 3, 0, time.Minute, 10*time.Minute)
+
+	config := &libplugin.SshPiperPluginConfig{
+		PublicKeyCallback: func(conn libplugin.ConnMetadata, key []byte) (*libplugin.Upstream, error) {
+			if string(key) != "right" {
+				return nil, errors.New("unknown key")
+			}
+
+			return &libplugin.Upstream{}, nil
+		},
+	}
+
+	l.instrument(config)
+
+	// two connections offering several agent keys before the right one
+	for _, id := range []string{"first", "second"} {
+		conn := &testConn{user: "alice", remoteAddr: "10.0.0.1:50000", uniqueID: id}
+
+		for _, key := range []string{"a", "b", "c", "d", "right"} {
+			_, _ = config.PublicKeyCallback(conn, []byte(key))
+		}
+	}
+
+	if err := config.NewConnectionCallback(&testConn{user: "alice", remoteAddr: "10.0.0.1:50002", uniqueID: "third"}); err != nil {
+		t.Errorf("expected ip not to be locked after two connections, got %v", err)
+	}
+}
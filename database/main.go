@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/tg123/sshpiper/libplugin"
 	"github.com/tg123/sshpiper/libplugin/skel"
@@ -10,206 +12,203 @@ import (
 
 func main() {
 
+	if runCommand(os.Args) {
+		return
+	}
+
 	libplugin.CreateAndRunPluginTemplate(&libplugin.PluginTemplate{
 		Name:  "database plugin for sshpiperd",
 		Usage: "sshpiperd database plugin, support sqlite3, mysql, postgres, mssql",
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:     "driver",
-				Usage:    "database driver, one of sqlite3, mysql, postgres, mssql",
-				EnvVars:  []string{"SSHPIPERD_DATABASE_DRIVER"},
-				Required: true,
-			},
+		Flags: append(databaseFlags(),
 			&cli.BoolFlag{
-				Name:    "enable-database-log",
-				Usage:   "enable database log",
-				EnvVars: []string{"SSHPIPERD_DATABASE_ENABLE_DATABASE_LOG"},
+				Name:    "allow-plaintext-password",
+				Usage:   "accept downstream passwords stored in plaintext rather than as bcrypt, argon2id or sha512 crypt hashes",
+				EnvVars: []string{"SSHPIPERD_DATABASE_ALLOW_PLAINTEXT_PASSWORD"},
 			},
-
-			// sqlite3
 			&cli.StringFlag{
-				Name:     "sqlite-file",
-				Required: false,
-				EnvVars:  []string{"SSHPIPERD_DATABASE_SQLITE_FILE"},
+				Name:    "secret-schemes",
+				Usage:   "comma separated schemes of private key and certificate references resolved on connect, of file, env, exec, none by default. exec runs commands named in the database",
+				EnvVars: []string{"SSHPIPERD_DATABASE_SECRET_SCHEMES"},
 			},
-
-			// mysql
 			&cli.StringFlag{
-				Name:    "mysql-host",
-				Value:   "127.0.0.1",
-				Usage:   "MySQL host",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_HOST"},
+				Name:    "secret-path-prefix",
+				Usage:   "absolute directory file references and exec commands must be below, required by the file and exec schemes",
+				EnvVars: []string{"SSHPIPERD_DATABASE_SECRET_PATH_PREFIX"},
 			},
 			&cli.StringFlag{
-				Name:    "mysql-user",
-				Value:   "root",
-				Usage:   "MySQL user",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_USER"},
+				Name:    "secret-env-allowlist",
+				Usage:   "comma separated environment variables env references may read, required by the env scheme",
+				EnvVars: []string{"SSHPIPERD_DATABASE_SECRET_ENV_ALLOWLIST"},
 			},
 			&cli.StringFlag{
-				Name:    "mysql-password",
-				Value:   "",
-				Usage:   "MySQL password",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_PASSWORD"},
+				Name:    "query-file",
+				Usage:   "yaml file of SQL queries looking up users in an existing schema instead of the plugin tables, see queryConfig",
+				EnvVars: []string{"SSHPIPERD_DATABASE_QUERY_FILE"},
 			},
-			&cli.UintFlag{
-				Name:    "mysql-port",
-				Value:   3306,
-				Usage:   "MySQL port",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_PORT"},
+			&cli.DurationFlag{
+				Name:    "health-check-interval",
+				Value:   10 * time.Second,
+				Usage:   "ping the database at this interval to detect outages and drop stale connections, 0 only checks after failed lookups",
+				EnvVars: []string{"SSHPIPERD_DATABASE_HEALTH_CHECK_INTERVAL"},
 			},
-			&cli.StringFlag{
-				Name:    "mysql-dbname",
-				Value:   "sshpiper",
-				Usage:   "MySQL database name",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MYSQL_DBNAME"},
+			&cli.BoolFlag{
+				Name:    "target-menu",
+				Usage:   "let downstreams with upstreams of several names pick one from a keyboard-interactive menu after a password login, public key logins must use target-separator",
+				EnvVars: []string{"SSHPIPERD_DATABASE_TARGET_MENU"},
 			},
-
-			// postgres
 			&cli.StringFlag{
-				Name:    "postgres-host",
-				Value:   "127.0.0.1",
-				Usage:   "PostgreSQL host",
-				EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_HOST"},
+				Name:    "target-separator",
+				Usage:   "pick the upstream named target by logging in as user<separator>target, e.g. +, empty disables",
+				EnvVars: []string{"SSHPIPERD_DATABASE_TARGET_SEPARATOR"},
 			},
-			&cli.StringFlag{
-				Name:    "postgres-user",
-				Value:   "postgres",
-				Usage:   "PostgreSQL user",
-				EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_USER"},
+			&cli.DurationFlag{
+				Name:    "jump-timeout",
+				Value:   30 * time.Second,
+				Usage:   "timeout to dial and log in to each jump server and for sshpiperd to use the tunnel, jump servers need linux to verify that the parent sshpiperd uses the tunnel",
+				EnvVars: []string{"SSHPIPERD_DATABASE_JUMP_TIMEOUT"},
 			},
-			&cli.StringFlag{
-				Name:    "postgres-password",
-				Value:   "",
-				Usage:   "PostgreSQL password",
-				EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_PASSWORD"},
+			&cli.DurationFlag{
+				Name:    "upstream-failure-cooldown",
+				Value:   30 * time.Second,
+				Usage:   "how long an upstream failed to connect is tried after other candidates",
+				EnvVars: []string{"SSHPIPERD_DATABASE_UPSTREAM_FAILURE_COOLDOWN"},
 			},
-			&cli.UintFlag{
-				Name:    "postgres-port",
-				Value:   5432,
-				Usage:   "PostgreSQL port",
-				EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_PORT"},
+			&cli.DurationFlag{
+				Name:    "cache-ttl",
+				Usage:   "cache resolved pipes per login user for this long, 0 disables the cache",
+				EnvVars: []string{"SSHPIPERD_DATABASE_CACHE_TTL"},
 			},
-			&cli.StringFlag{
-				Name:    "postgres-dbname",
-				Value:   "sshpiper",
-				Usage:   "PostgreSQL database name",
-				EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_DBNAME"},
+			&cli.DurationFlag{
+				Name:    "cache-negative-ttl",
+				Value:   5 * time.Second,
+				Usage:   "cache login users without downstream for this long, 0 disables negative caching",
+				EnvVars: []string{"SSHPIPERD_DATABASE_CACHE_NEGATIVE_TTL"},
 			},
-			&cli.StringFlag{
-				Name:    "postgres-sslmode",
-				Value:   "require",
-				Usage:   "PostgreSQL SSL mode",
-				EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_SSLMODE"},
+			&cli.DurationFlag{
+				Name:    "cache-poll-interval",
+				Value:   5 * time.Second,
+				Usage:   "flush the cache when any table changed, checked at this interval, 0 disables polling",
+				EnvVars: []string{"SSHPIPERD_DATABASE_CACHE_POLL_INTERVAL"},
 			},
 			&cli.StringFlag{
-				Name:    "postgres-sslcert",
-				Value:   "",
-				Usage:   "PostgreSQL SSL cert path",
-				EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_SSLCERT"},
+				Name:    "cache-notify-channel",
+				Usage:   "postgres only, flush the cache on NOTIFY to this channel, e.g. sent by triggers on the tables",
+				EnvVars: []string{"SSHPIPERD_DATABASE_CACHE_NOTIFY_CHANNEL"},
 			},
-			&cli.StringFlag{
-				Name:    "postgres-sslkey",
-				Value:   "",
-				Usage:   "PostgreSQL SSL key path",
-				EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_SSLKEY"},
+			&cli.IntFlag{
+				Name:    "lockout-ip-failures",
+				Usage:   "lock a client ip after this many failed password attempts within --lockout-window, rejected public keys count once per connection and keyboard-interactive is not counted, 0 disables",
+				EnvVars: []string{"SSHPIPERD_DATABASE_LOCKOUT_IP_FAILURES"},
 			},
-			&cli.StringFlag{
-				Name:    "postgres-sslrootcert",
-				Value:   "",
-				Usage:   "PostgreSQL SSL root cert path",
-				EnvVars: []string{"SSHPIPERD_DATABASE_POSTGRES_SSLROOTCERT"},
+			&cli.IntFlag{
+				Name:    "lockout-user-failures",
+				Usage:   "lock a username after this many failed password attempts within --lockout-window, rejected public keys count once per connection, 0 disables",
+				EnvVars: []string{"SSHPIPERD_DATABASE_LOCKOUT_USER_FAILURES"},
 			},
-
-			// mssql
-			&cli.StringFlag{
-				Name:    "mssql-host",
-				Value:   "127.0.0.1",
-				Usage:   "SQL Server host",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_HOST"},
+			&cli.DurationFlag{
+				Name:    "lockout-window",
+				Value:   5 * time.Minute,
+				Usage:   "failed attempts older than this are forgotten",
+				EnvVars: []string{"SSHPIPERD_DATABASE_LOCKOUT_WINDOW"},
 			},
-			&cli.StringFlag{
-				Name:    "mssql-user",
-				Value:   "sa",
-				Usage:   "SQL Server user",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_USER"},
+			&cli.DurationFlag{
+				Name:    "lockout-duration",
+				Value:   15 * time.Minute,
+				Usage:   "how long a locked ip or username is rejected",
+				EnvVars: []string{"SSHPIPERD_DATABASE_LOCKOUT_DURATION"},
 			},
 			&cli.StringFlag{
-				Name:    "mssql-password",
-				Value:   "",
-				Usage:   "SQL Server password",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_PASSWORD"},
+				Name:    "lockout-store",
+				Value:   "memory",
+				Usage:   "where failed attempts are counted, memory or database to share lockouts between sshpiperd replicas",
+				EnvVars: []string{"SSHPIPERD_DATABASE_LOCKOUT_STORE"},
 			},
-			&cli.UintFlag{
-				Name:    "mssql-port",
-				Value:   1433,
-				Usage:   "SQL Server port",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_PORT"},
+			&cli.BoolFlag{
+				Name:    "audit-log",
+				Usage:   "record connections, auth results and pipe events in the audit_events table",
+				EnvVars: []string{"SSHPIPERD_DATABASE_AUDIT_LOG"},
 			},
-			&cli.StringFlag{
-				Name:    "mssql-dbname",
-				Value:   "sshpiper",
-				Usage:   "SQL Server database name",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_DBNAME"},
+			&cli.IntFlag{
+				Name:    "audit-log-batch-size",
+				Value:   100,
+				Usage:   "audit events written per insert",
+				EnvVars: []string{"SSHPIPERD_DATABASE_AUDIT_LOG_BATCH_SIZE"},
 			},
-			&cli.StringFlag{
-				Name:    "mssql-instance",
-				Value:   "",
-				Usage:   "SQL Server database instance",
-				EnvVars: []string{"SSHPIPERD_DATABASE_MSSQL_INSTANCE"},
+			&cli.DurationFlag{
+				Name:    "audit-log-flush-interval",
+				Value:   time.Second,
+				Usage:   "write buffered audit events at least this often",
+				EnvVars: []string{"SSHPIPERD_DATABASE_AUDIT_LOG_FLUSH_INTERVAL"},
 			},
-		},
+		),
 		CreateConfig: func(c *cli.Context) (*libplugin.SshPiperPluginConfig, error) {
 
-			var backend createdb
-
-			switch c.String("driver") {
-			case "sqlite3":
-				backend = &sqliteplugin{
-					File: c.String("sqlite-file"),
-				}
-
-			case "mysql":
-				backend = &mysqlplugin{
-					Host:     c.String("mysql-host"),
-					User:     c.String("mysql-user"),
-					Password: c.String("mysql-password"),
-					Port:     c.Uint("mysql-port"),
-					Dbname:   c.String("mysql-dbname"),
-				}
-			case "postgres":
-				backend = &postgresplugin{
-					Host:        c.String("postgres-host"),
-					User:        c.String("postgres-user"),
-					Password:    c.String("postgres-password"),
-					Port:        c.Uint("postgres-port"),
-					Dbname:      c.String("postgres-dbname"),
-					SslMode:     c.String("postgres-sslmode"),
-					SslCert:     c.String("postgres-sslcert"),
-					SslKey:      c.String("postgres-sslkey"),
-					SslRootCert: c.String("postgres-sslrootcert"),
-				}
-			case "mssql":
-				backend = &mssqlplugin{
-					Host:     c.String("mssql-host"),
-					User:     c.String("mssql-user"),
-					Password: c.String("mssql-password"),
-					Port:     c.Uint("mssql-port"),
-					Dbname:   c.String("mssql-dbname"),
-					Instance: c.String("mssql-instance"),
-				}
-			default:
-				return nil, fmt.Errorf("unknown driver %s", c.String("driver"))
+			secrets, err := parseSecretSchemes(c.String("secret-schemes"), c.String("secret-path-prefix"), splitList(c.String("secret-env-allowlist")))
+			if err != nil {
+				return nil, err
 			}
 
 			p := &plugin{
-				logmode: c.Bool("enable-database-log"),
+				failover:               newFailover(c.Duration("upstream-failure-cooldown")),
+				allowPlaintextPassword: c.Bool("allow-plaintext-password"),
+				secrets:                secrets,
+				targetMenu:             c.Bool("target-menu"),
+				targetSeparator:        c.String("target-separator"),
+				jumpTimeout:            c.Duration("jump-timeout"),
 			}
 
-			if err := p.Init(backend); err != nil {
+			pollInterval := c.Duration("cache-poll-interval")
+
+			if file := c.String("query-file"); file != "" {
+				if p.queries, err = loadQueryConfig(file); err != nil {
+					return nil, err
+				}
+
+				// these keep state in the plugin tables
+				if c.Bool("audit-log") || c.String("lockout-store") == "database" {
+					return nil, fmt.Errorf("--audit-log and --lockout-store database are not supported with --query-file")
+				}
+
+				// polling reads the plugin tables, cached pipes expire by --cache-ttl only
+				pollInterval = 0
+			}
+
+			if ttl := c.Duration("cache-ttl"); ttl > 0 {
+				p.cache = newPipeCache(ttl, c.Duration("cache-negative-ttl"), pollInterval, c.String("cache-notify-channel"))
+			}
+
+			if err := initPlugin(c, p); err != nil {
+				return nil, err
+			}
+
+			if err := p.checkJumpRoutes(); err != nil {
+				p.Close()
 				return nil, err
 			}
 
+			p.health = newDBHealth(p.db, c.Duration("health-check-interval"), p.pool.MaxIdleConns)
+			p.health.start()
+
+			if c.Int("lockout-ip-failures") > 0 || c.Int("lockout-user-failures") > 0 {
+				var store lockoutStore
+
+				switch c.String("lockout-store") {
+				case "memory":
+					store = newMemoryLockoutStore()
+				case "database":
+					store = &dbLockoutStore{db: p.db}
+				default:
+					p.Close()
+					return nil, fmt.Errorf("unknown lockout store %v", c.String("lockout-store"))
+				}
+
+				p.lockout = newLockout(store, c.Int("lockout-ip-failures"), c.Int("lockout-user-failures"), c.Duration("lockout-window"), c.Duration("lockout-duration"))
+			}
+
+			if c.Bool("audit-log") {
+				p.audit = newAuditLog(p.db, c.Int("audit-log-batch-size"), c.Duration("audit-log-flush-interval"))
+			}
+
 			skelPlugin := skel.NewSkelPlugin(p.listPipe)
 			config := skelPlugin.CreateConfig()
 
@@ -220,9 +219,123 @@ func main() {
 					return []string{"password", "publickey"}, nil
 				}
 
+				if p.targetMenuPending(conn) {
+					return []string{"keyboard-interactive"}, nil
+				}
+
 				return origin(conn)
 			}
 
+			originPublicKey := config.PublicKeyCallback
+
+			config.PublicKeyCallback = func(conn libplugin.ConnMetadata, presented []byte) (*libplugin.Upstream, error) {
+				key, err := p.acceptPublicKey(conn, presented)
+				if err != nil {
+					return nil, err
+				}
+
+				u, err := originPublicKey(conn, key)
+				if err != nil {
+					return nil, err
+				}
+
+				if err := p.checkPublicKeyTarget(conn); err != nil {
+					return nil, err
+				}
+
+				return p.connectUpstream(conn, u, func() (*libplugin.Upstream, error) {
+					return originPublicKey(conn, key)
+				})
+			}
+
+			originPassword := config.PasswordCallback
+
+			config.PasswordCallback = func(conn libplugin.ConnMetadata, password []byte) (*libplugin.Upstream, error) {
+				u, err := originPassword(conn, password)
+				if err != nil {
+					return nil, err
+				}
+
+				deferred, err := p.deferToTargetMenu(conn, password)
+				if err != nil {
+					return nil, err
+				}
+
+				if deferred {
+					return nil, errTargetSelectionRequired
+				}
+
+				return p.connectUpstream(conn, u, func() (*libplugin.Upstream, error) {
+					return originPassword(conn, password)
+				})
+			}
+
+			if p.targetMenu {
+				// completes password logins through the callback above, before the lockout and audit log wrap it
+				password := config.PasswordCallback
+
+				config.KeyboardInteractiveCallback = func(conn libplugin.ConnMetadata, client libplugin.KeyboardInteractiveChallenge) (*libplugin.Upstream, error) {
+					return p.selectTarget(conn, client, password)
+				}
+			}
+
+			originBanner := config.BannerCallback
+
+			config.BannerCallback = func(conn libplugin.ConnMetadata) string {
+				if p.health.unavailable() {
+					return databaseUnavailableBanner
+				}
+
+				if reason := p.accessTimeBanner(conn); reason != "" {
+					return reason
+				}
+
+				if banner := p.banner(conn); banner != "" {
+					return banner
+				}
+
+				if originBanner != nil {
+					return originBanner(conn)
+				}
+
+				return ""
+			}
+
+			originVerifyHostKey := config.VerifyHostKeyCallback
+
+			config.VerifyHostKeyCallback = func(conn libplugin.ConnMetadata, hostname, netaddr string, key []byte) error {
+				if handled, err := p.verifyHostKeyOnFirstUse(conn, hostname, netaddr, key); handled {
+					return err
+				}
+
+				if handled, err := p.verifyTunneledHostKey(conn, key); handled {
+					return err
+				}
+
+				return originVerifyHostKey(conn, hostname, netaddr, key)
+			}
+
+			config.UpstreamAuthFailureCallback = func(conn libplugin.ConnMetadata, method string, err error, allowmethods []string) {
+				p.failover.upstreamAuthFailed(conn)
+			}
+
+			config.PipeCreateErrorCallback = func(remoteAddr string, err error) {
+				p.failover.pipeCreateFailed(remoteAddr)
+			}
+
+			config.PipeStartCallback = func(conn libplugin.ConnMetadata) {
+				p.failover.pipeStarted(conn)
+			}
+
+			if p.lockout != nil {
+				p.lockout.instrument(config)
+			}
+
+			// after the lockout, so rejected attempts are recorded
+			if p.audit != nil {
+				p.audit.instrument(config)
+			}
+
 			return config, nil
 		},
 	})
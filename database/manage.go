@@ -0,0 +1,1228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tg123/sshpiper/libplugin"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+var authMapTypeNames = map[authMapType]string{
+	authMapTypePassword:             "password",
+	authMapTypePrivateKey:           "privatekey",
+	authMapTypePasswordOrPrivateKey: "password-or-privatekey",
+}
+
+var matchTypeNames = map[matchType]string{
+	matchTypeExact: "exact",
+	matchTypeGlob:  "glob",
+	matchTypeRegex: "regex",
+}
+
+var usernameMappingNames = map[usernameMapping]string{
+	usernameMappingAuto:     "auto",
+	usernameMappingKeep:     "keep",
+	usernameMappingFixed:    "fixed",
+	usernameMappingTemplate: "template",
+}
+
+// configEntries are the config table entries understood by the plugin
+var configEntries = []string{
+	fallbackUserEntry,
+	trustedUserCAKeysEntry,
+	allowedSourcesEntry,
+	deniedSourcesEntry,
+	bannerEntry,
+}
+
+func parseName[T comparable](names map[T]string, name string) (T, error) {
+	for v, n := range names {
+		if n == name {
+			return v, nil
+		}
+	}
+
+	var zero T
+	var valid []string
+	for _, n := range names {
+		valid = append(valid, n)
+	}
+
+	return zero, fmt.Errorf("unknown value %v, expected one of %v", name, strings.Join(valid, ", "))
+}
+
+func manageCommands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:  "pipe",
+			Usage: "manage downstream to upstream pipes",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "add",
+					Usage: "add a pipe, adding to an existing downstream creates another upstream candidate and rejects downstream flags",
+					Flags: append(append(databaseFlags(),
+						&cli.StringFlag{Name: "username", Usage: "downstream username or pattern", Required: true},
+						&cli.StringFlag{Name: "match", Value: "exact", Usage: "how username is matched, one of exact, glob, regex"},
+						&cli.IntFlag{Name: "match-priority", Usage: "order of glob and regex downstreams, lower first"},
+						&cli.StringFlag{Name: "auth", Value: "password", Usage: "downstream auth, one of password, privatekey, password-or-privatekey"},
+						&cli.StringFlag{Name: "password", Usage: "downstream password, bcrypt hashed unless already a hash, empty accepts any password for auth password and is rejected for password-or-privatekey"},
+						&cli.StringFlag{Name: "authorized-keys-file", Usage: "downstream authorized_keys file"},
+						&cli.TimestampFlag{Name: "valid-from", Layout: time.RFC3339, Usage: "downstream may not log in before, RFC 3339"},
+						&cli.TimestampFlag{Name: "valid-until", Layout: time.RFC3339, Usage: "downstream may not log in from, RFC 3339"},
+						&cli.StringFlag{Name: "access-windows", Usage: "weekly hours the downstream may log in, e.g. \"Mon-Fri 08:00-18:00; Sat 10:00-12:00\""},
+						&cli.StringFlag{Name: "access-timezone", Usage: "IANA time zone of --access-windows, UTC if empty"},
+						&cli.StringFlag{Name: "allowed-sources", Usage: "comma separated CIDRs or IPs the downstream may log in from, empty uses config ALLOWED_SOURCES"},
+						&cli.StringFlag{Name: "denied-sources", Usage: "comma separated CIDRs or IPs the downstream may not log in from"},
+						&cli.StringFlag{Name: "banner", Usage: "text/template shown before login, with .Username, .Target, .UpstreamHost and .ValidUntil"},
+						&cli.StringFlag{Name: "groups", Usage: "comma separated groups the downstream joins, the upstream flags are optional then"},
+					), upstreamFlags()...),
+					Action: withPlugin(pipeAddCommand),
+				},
+				{
+					Name:   "list",
+					Usage:  "list pipes",
+					Flags:  append(databaseFlags(), &cli.BoolFlag{Name: "json", Usage: "print json"}),
+					Action: withPlugin(pipeListCommand),
+				},
+				{
+					Name:      "rm",
+					Usage:     "remove a downstream and all its upstream candidates, with their unnamed servers and keys",
+					ArgsUsage: "<username>",
+					Flags:     databaseFlags(),
+					Action:    withPlugin(pipeRmCommand),
+				},
+			},
+		},
+		{
+			Name:  "group",
+			Usage: "manage groups granting their members a set of upstreams",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "add",
+					Usage: "add a group, adding to an existing group with --server or --address creates another upstream candidate",
+					Flags: append(append(databaseFlags(),
+						&cli.StringFlag{Name: "name", Usage: "group name", Required: true},
+					), upstreamFlags()...),
+					Action: withPlugin(groupAddCommand),
+				},
+				{
+					Name:   "list",
+					Usage:  "list groups with their members and upstreams",
+					Flags:  append(databaseFlags(), &cli.BoolFlag{Name: "json", Usage: "print json"}),
+					Action: withPlugin(groupListCommand),
+				},
+				{
+					Name:      "rm",
+					Usage:     "remove a group, its upstream candidates with their unnamed servers and keys, and memberships",
+					ArgsUsage: "<name>",
+					Flags:     databaseFlags(),
+					Action:    withPlugin(groupRmCommand),
+				},
+				{
+					Name:      "join",
+					Usage:     "add a downstream to a group",
+					ArgsUsage: "<name> <username>",
+					Flags:     databaseFlags(),
+					Action:    withPlugin(groupJoinCommand),
+				},
+				{
+					Name:      "leave",
+					Usage:     "remove a downstream from a group",
+					ArgsUsage: "<name> <username>",
+					Flags:     databaseFlags(),
+					Action:    withPlugin(groupLeaveCommand),
+				},
+			},
+		},
+		{
+			Name:  "key",
+			Usage: "manage keydata",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "import",
+					Usage:     "import a private key, authorized_keys or known_hosts file, print its id",
+					ArgsUsage: "<file>",
+					Flags: append(databaseFlags(),
+						&cli.StringFlag{Name: "name", Usage: "key name, e.g. for " + trustedUserCAKeysEntry},
+						&cli.StringFlag{Name: "type", Usage: "key type, detected from the file if empty"},
+					),
+					Action: withPlugin(keyImportCommand),
+				},
+			},
+		},
+		{
+			Name:  "server",
+			Usage: "manage upstream servers",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "add",
+					Usage: "add a server, print its id",
+					Flags: append(databaseFlags(),
+						&cli.StringFlag{Name: "name", Usage: "server name", Required: true},
+						&cli.StringFlag{Name: "address", Usage: "address host[:port]", Required: true},
+						&cli.StringFlag{Name: "host-key-file", Usage: "host key, public key or known_hosts file"},
+						&cli.BoolFlag{Name: "ignore-host-key", Usage: "do not verify host key"},
+						&cli.BoolFlag{Name: "trust-on-first-use", Usage: "record the first host key seen if --host-key-file is not given"},
+						&cli.StringFlag{Name: "banner", Usage: "text/template shown to downstreams entering this server, e.g. \"{{.Username}}, this is production\""},
+						&cli.StringFlag{Name: "via-server", Usage: "name of an existing server this server is reached through"},
+						&cli.StringFlag{Name: "jump-username", Usage: "username logging in to this server when it is a jump server, the upstream username if empty"},
+						&cli.StringFlag{Name: "jump-password", Usage: "password logging in to this server when it is a jump server"},
+						&cli.StringFlag{Name: "jump-private-key-file", Usage: "private key logging in to this server when it is a jump server"},
+					),
+					Action: withPlugin(serverAddCommand),
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "manage config entries",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "set",
+					Usage:     "set a config entry, one of " + strings.Join(configEntries, ", "),
+					ArgsUsage: "<entry> <value>",
+					Flags:     databaseFlags(),
+					Action:    withPlugin(configSetCommand),
+				},
+			},
+		},
+	}
+}
+
+// upstreamFlags are read by newUpstreamFromFlags and setUpstreamServer
+func upstreamFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "upstream-name", Usage: "upstream name, offered as target by --target-menu and user+target logins, the server name if empty"},
+		&cli.StringFlag{Name: "upstream-username", Usage: "upstream username, or a text/template of the downstream .Username for --upstream-username-mapping template"},
+		&cli.StringFlag{Name: "upstream-username-mapping", Value: "auto", Usage: "one of auto (--upstream-username if set, the downstream username otherwise), keep, fixed, template"},
+		&cli.StringFlag{Name: "upstream-auth", Value: "password", Usage: "upstream auth, one of password, privatekey"},
+		&cli.StringFlag{Name: "upstream-password", Usage: "upstream password, empty passes the downstream password through"},
+		&cli.StringFlag{Name: "upstream-private-key-file", Usage: "upstream private key file"},
+		&cli.StringFlag{Name: "upstream-private-key-ref", Usage: "upstream private key resolved on connect, file:///path, env://NAME or exec:///command args"},
+		&cli.StringFlag{Name: "upstream-private-key-passphrase", Usage: "passphrase of --upstream-private-key-file"},
+		&cli.StringFlag{Name: "upstream-certificate-file", Usage: "OpenSSH user certificate of --upstream-private-key-file presented to the upstream"},
+		&cli.StringFlag{Name: "server", Usage: "name of an existing server"},
+		&cli.StringFlag{Name: "address", Usage: "upstream address host[:port], creates a new server"},
+		&cli.StringFlag{Name: "host-key-file", Usage: "upstream host key, public key or known_hosts file"},
+		&cli.BoolFlag{Name: "ignore-host-key", Usage: "do not verify upstream host key"},
+		&cli.BoolFlag{Name: "trust-on-first-use", Usage: "record the first upstream host key seen if --host-key-file is not given"},
+		&cli.StringFlag{Name: "server-banner", Usage: "banner template of the server created by --address, see server add --banner"},
+		&cli.IntFlag{Name: "priority", Usage: "candidate priority, lower first"},
+		&cli.IntFlag{Name: "weight", Value: 1, Usage: "candidate weight among candidates of the same priority"},
+	}
+}
+
+// newDownstreamFlags are the pipe add flags only used when the downstream is created
+var newDownstreamFlags = []string{
+	"match-priority",
+	"auth",
+	"password",
+	"authorized-keys-file",
+	"valid-from",
+	"valid-until",
+	"access-windows",
+	"access-timezone",
+	"allowed-sources",
+	"denied-sources",
+	"banner",
+}
+
+func pipeAddCommand(c *cli.Context, p *plugin) error {
+	match, err := parseName(matchTypeNames, c.String("match"))
+	if err != nil {
+		return err
+	}
+
+	if match != matchTypeExact {
+		if _, err := compileUserPattern(match, c.String("username")); err != nil {
+			return fmt.Errorf("invalid username pattern: %w", err)
+		}
+	}
+
+	if _, err := parseAccessWindows(c.String("access-windows")); err != nil {
+		return err
+	}
+
+	if _, err := time.LoadLocation(c.String("access-timezone")); err != nil {
+		return err
+	}
+
+	if _, err := parseSourceList(c.String("allowed-sources")); err != nil {
+		return err
+	}
+
+	if _, err := parseSourceList(c.String("denied-sources")); err != nil {
+		return err
+	}
+
+	if err := validateBanner(c.String("banner")); err != nil {
+		return err
+	}
+
+	fromType, err := parseName(authMapTypeNames, c.String("auth"))
+	if err != nil {
+		return err
+	}
+
+	authorizedKeys, err := readKeyFile(c.String("authorized-keys-file"), validateAuthorizedKeys)
+	if err != nil {
+		return err
+	}
+
+	globalCAKeys, err := lookupKeydataByConfig(p.db, trustedUserCAKeysEntry)
+	if err != nil {
+		return err
+	}
+
+	if err := checkDownstreamCredentials(fromType, c.String("password"), authorizedKeys != "" || globalCAKeys != nil); err != nil {
+		return err
+	}
+
+	password, err := hashPassword(c.String("password"))
+	if err != nil {
+		return err
+	}
+
+	groups := splitList(c.String("groups"))
+
+	// members of a group may get all their upstreams from it
+	var u *upstream
+	if len(groups) == 0 || c.String("server") != "" || c.String("address") != "" {
+		if u, err = p.newUpstreamFromFlags(c); err != nil {
+			return err
+		}
+	}
+
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		if u != nil {
+			if err := setUpstreamServer(tx, c, u); err != nil {
+				return err
+			}
+		}
+
+		d := downstream{}
+		err := tx.Where(&downstream{Username: c.String("username")}).First(&d).Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			d = downstream{
+				Username:       c.String("username"),
+				MatchType:      match,
+				MatchPriority:  c.Int("match-priority"),
+				AuthMapType:    fromType,
+				Password:       password,
+				ValidFrom:      c.Timestamp("valid-from"),
+				ValidUntil:     c.Timestamp("valid-until"),
+				AccessWindows:  c.String("access-windows"),
+				AccessTimezone: c.String("access-timezone"),
+				AllowedSources: c.String("allowed-sources"),
+				DeniedSources:  c.String("denied-sources"),
+				Banner:         c.String("banner"),
+			}
+
+			if u != nil {
+				if err := p.createUpstream(tx, u); err != nil {
+					return err
+				}
+
+				d.UpstreamID = int(u.ID)
+			}
+
+			if authorizedKeys != "" {
+				d.AuthorizedKeys = keydata{Data: authorizedKeys, Type: "publickey"}
+			}
+
+			if err := tx.Create(&d).Error; err != nil {
+				return err
+			}
+
+			if err := joinGroups(tx, &d, groups); err != nil {
+				return err
+			}
+
+			if u != nil {
+				fmt.Fprintf(c.App.Writer, "added downstream %v piped to %v@%v\n", d.Username, u.Username, u.Server.Address)
+			} else {
+				fmt.Fprintf(c.App.Writer, "added downstream %v member of %v\n", d.Username, strings.Join(groups, ", "))
+			}
+
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if d.MatchType != match {
+			return fmt.Errorf("downstream %v already exists with match %v, not %v", d.Username, matchTypeNames[d.MatchType], matchTypeNames[match])
+		}
+
+		for _, name := range newDownstreamFlags {
+			if c.IsSet(name) {
+				return fmt.Errorf("downstream %v already exists, --%v only applies to a new downstream", d.Username, name)
+			}
+		}
+
+		if err := joinGroups(tx, &d, groups); err != nil {
+			return err
+		}
+
+		if u == nil {
+			fmt.Fprintf(c.App.Writer, "added downstream %v to %v\n", d.Username, strings.Join(groups, ", "))
+			return nil
+		}
+
+		if err := p.createUpstream(tx, u); err != nil {
+			return err
+		}
+
+		r := route{
+			DownstreamID: int(d.ID),
+			UpstreamID:   int(u.ID),
+			Priority:     c.Int("priority"),
+			Weight:       c.Int("weight"),
+		}
+
+		if err := tx.Create(&r).Error; err != nil {
+			return err
+		}
+
+		fmt.Fprintf(c.App.Writer, "added upstream candidate %v@%v to downstream %v\n", u.Username, u.Server.Address, d.Username)
+		return nil
+	})
+}
+
+// newUpstreamFromFlags builds an upstream from upstreamFlags, its server is set by setUpstreamServer
+func (p *plugin) newUpstreamFromFlags(c *cli.Context) (*upstream, error) {
+	toType, err := parseName(authMapTypeNames, c.String("upstream-auth"))
+	if err != nil {
+		return nil, err
+	}
+
+	if toType != authMapTypePassword && toType != authMapTypePrivateKey {
+		return nil, fmt.Errorf("upstream auth must be password or privatekey")
+	}
+
+	mapping, err := parseName(usernameMappingNames, c.String("upstream-username-mapping"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateUsernameMapping(mapping, c.String("upstream-username")); err != nil {
+		return nil, err
+	}
+
+	u := &upstream{
+		Name:            c.String("upstream-name"),
+		Username:        c.String("upstream-username"),
+		UsernameMapping: mapping,
+		AuthMapType:     toType,
+		Password:        c.String("upstream-password"),
+	}
+
+	passphrase := c.String("upstream-private-key-passphrase")
+
+	privateKey, err := readKeyFile(c.String("upstream-private-key-file"), privateKeyValidator(passphrase))
+	if err != nil {
+		return nil, err
+	}
+
+	if ref := c.String("upstream-private-key-ref"); ref != "" {
+		if privateKey != "" {
+			return nil, fmt.Errorf("--upstream-private-key-file and --upstream-private-key-ref are exclusive")
+		}
+
+		if !isSecretRef(ref) {
+			return nil, fmt.Errorf("--upstream-private-key-ref %v is not a file://, env:// or exec:// reference", ref)
+		}
+
+		privateKey = ref
+	}
+
+	if toType == authMapTypePrivateKey && privateKey == "" {
+		return nil, fmt.Errorf("--upstream-private-key-file or --upstream-private-key-ref is required for upstream auth privatekey")
+	}
+
+	certificate, err := readKeyFile(c.String("upstream-certificate-file"), validateCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	// a referenced key is only known on connect
+	if certificate != "" && !isSecretRef(privateKey) {
+		if err := validateCertificateOf(certificate, privateKey, passphrase); err != nil {
+			return nil, fmt.Errorf("%v: %w", c.String("upstream-certificate-file"), err)
+		}
+	}
+
+	if certificate != "" {
+		u.Certificate = keydata{Data: certificate, Type: "certificate"}
+	}
+
+	if privateKey != "" {
+		u.PrivateKey = keydata{Data: privateKey, Type: "privatekey"}
+		u.PrivateKeyPassphrase = passphrase
+	}
+
+	return u, nil
+}
+
+// createUpstream inserts u along with its new server and keys, then seals its secrets
+func (p *plugin) createUpstream(tx *gorm.DB, u *upstream) error {
+	password, passphrase, privateKey := u.Password, u.PrivateKeyPassphrase, u.PrivateKey.Data
+	u.Password, u.PrivateKeyPassphrase, u.PrivateKey.Data = "", "", ""
+
+	if err := tx.Create(u).Error; err != nil {
+		return err
+	}
+
+	if err := p.sealRow(tx, &u.PrivateKey, "keydata", u.PrivateKey.ID, map[string]string{"data": privateKey}); err != nil {
+		return err
+	}
+
+	return p.sealRow(tx, u, "upstreams", u.ID, map[string]string{
+		"password":               password,
+		"private_key_passphrase": passphrase,
+	})
+}
+
+// setUpstreamServer sets the server named by --server, or a new server from --address
+func setUpstreamServer(tx *gorm.DB, c *cli.Context, u *upstream) error {
+	if name := c.String("server"); name != "" {
+		if err := tx.Where(&server{Name: name}).First(&u.Server).Error; err != nil {
+			return fmt.Errorf("server %v: %w", name, err)
+		}
+
+		return nil
+	}
+
+	s, err := newServer(c, "", c.String("server-banner"))
+	if err != nil {
+		return err
+	}
+
+	u.Server = *s
+	return nil
+}
+
+// joinGroups adds d to the named groups it is not a member of yet
+func joinGroups(tx *gorm.DB, d *downstream, names []string) error {
+	for _, name := range names {
+		g := group{}
+		if err := tx.Where(&group{Name: name}).First(&g).Error; err != nil {
+			return fmt.Errorf("group %v: %w", name, err)
+		}
+
+		m := groupMember{}
+		if err := tx.Where(&groupMember{GroupID: int(g.ID), DownstreamID: int(d.ID)}).FirstOrCreate(&m).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type pipeRow struct {
+	ID               uint   `json:"id"`
+	Username         string `json:"username"`
+	Match            string `json:"match"`
+	Auth             string `json:"auth"`
+	UpstreamUsername string `json:"upstream_username"`
+	UpstreamAuth     string `json:"upstream_auth"`
+	Address          string `json:"address"`
+	Priority         int    `json:"priority"`
+	Weight           int    `json:"weight"`
+	Group            string `json:"group,omitempty"`
+}
+
+func pipeListCommand(c *cli.Context, p *plugin) error {
+	var downstreams []downstream
+	if err := preloadDownstream(p.db).Order("id asc").Find(&downstreams).Error; err != nil {
+		return err
+	}
+
+	var groups []group
+	if err := p.db.Find(&groups).Error; err != nil {
+		return err
+	}
+
+	groupNames := map[int]string{}
+	for _, g := range groups {
+		groupNames[int(g.ID)] = g.Name
+	}
+
+	rows := []pipeRow{}
+
+	for _, d := range downstreams {
+		add := func(u *upstream, priority, weight int, group string) {
+			rows = append(rows, pipeRow{
+				ID:               d.ID,
+				Username:         d.Username,
+				Match:            matchTypeNames[d.MatchType],
+				Auth:             authMapTypeNames[d.AuthMapType],
+				UpstreamUsername: u.Username,
+				UpstreamAuth:     authMapTypeNames[u.AuthMapType],
+				Address:          u.Server.Address,
+				Priority:         priority,
+				Weight:           weight,
+				Group:            group,
+			})
+		}
+
+		if d.UpstreamID != 0 {
+			add(&d.Upstream, 0, 1, "")
+		}
+
+		for _, r := range d.Routes {
+			add(&r.Upstream, r.Priority, r.Weight, "")
+		}
+
+		groupRoutes, err := lookupGroupRoutes(p.db, d.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range groupRoutes {
+			add(&r.Upstream, r.Priority, r.Weight, groupNames[r.GroupID])
+		}
+	}
+
+	if c.Bool("json") {
+		return printJSON(c.App.Writer, rows)
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tMATCH\tAUTH\tUPSTREAM\tUPSTREAM AUTH\tPRIORITY\tWEIGHT\tGROUP")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v@%v\t%v\t%v\t%v\t%v\n", r.ID, r.Username, r.Match, r.Auth, r.UpstreamUsername, r.Address, r.UpstreamAuth, r.Priority, r.Weight, r.Group)
+	}
+
+	return w.Flush()
+}
+
+func pipeRmCommand(c *cli.Context, p *plugin) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one username")
+	}
+
+	username := c.Args().First()
+
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		var downstreams []downstream
+		if err := tx.Where(&downstream{Username: username}).Find(&downstreams).Error; err != nil {
+			return err
+		}
+
+		if len(downstreams) == 0 {
+			return fmt.Errorf("downstream %v not found", username)
+		}
+
+		s := syncer{tx: tx, plugin: p, pruneServers: true}
+
+		for _, d := range downstreams {
+			if err := s.clearDownstream(&d); err != nil {
+				return err
+			}
+
+			// usernames are unique, a soft deleted row would block adding the username again
+			if err := tx.Unscoped().Delete(&d).Error; err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(c.App.Writer, "removed downstream %v\n", username)
+		return nil
+	})
+}
+
+func groupAddCommand(c *cli.Context, p *plugin) error {
+	var u *upstream
+	if c.String("server") != "" || c.String("address") != "" {
+		var err error
+		if u, err = p.newUpstreamFromFlags(c); err != nil {
+			return err
+		}
+	}
+
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		g := group{}
+		err := tx.Where(&group{Name: c.String("name")}).First(&g).Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			g = group{Name: c.String("name")}
+			if err := tx.Create(&g).Error; err != nil {
+				return err
+			}
+
+			fmt.Fprintf(c.App.Writer, "added group %v\n", g.Name)
+		} else if err != nil {
+			return err
+		} else if u == nil {
+			return fmt.Errorf("group %v already exists", g.Name)
+		}
+
+		if u == nil {
+			return nil
+		}
+
+		if err := setUpstreamServer(tx, c, u); err != nil {
+			return err
+		}
+
+		if err := p.createUpstream(tx, u); err != nil {
+			return err
+		}
+
+		r := groupRoute{
+			GroupID:    int(g.ID),
+			UpstreamID: int(u.ID),
+			Priority:   c.Int("priority"),
+			Weight:     c.Int("weight"),
+		}
+
+		if err := tx.Create(&r).Error; err != nil {
+			return err
+		}
+
+		fmt.Fprintf(c.App.Writer, "added upstream candidate %v@%v to group %v\n", u.Username, u.Server.Address, g.Name)
+		return nil
+	})
+}
+
+type groupRow struct {
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	Upstreams []pipeRow `json:"upstreams"`
+}
+
+func groupListCommand(c *cli.Context, p *plugin) error {
+	var groups []group
+	if err := p.db.Preload("Routes").
+		Preload("Routes.Upstream").
+		Preload("Routes.Upstream.Server").
+		Order("name asc").
+		Find(&groups).Error; err != nil {
+
+		return err
+	}
+
+	rows := []groupRow{}
+
+	for _, g := range groups {
+		row := groupRow{Name: g.Name, Members: []string{}, Upstreams: []pipeRow{}}
+
+		if err := p.db.Model(&downstream{}).
+			Where("id IN (?)", p.db.Model(&groupMember{}).Select("downstream_id").Where("group_id = ?", g.ID)).
+			Order("username asc").
+			Pluck("username", &row.Members).Error; err != nil {
+
+			return err
+		}
+
+		for _, r := range g.Routes {
+			row.Upstreams = append(row.Upstreams, pipeRow{
+				ID:               r.ID,
+				UpstreamUsername: r.Upstream.Username,
+				UpstreamAuth:     authMapTypeNames[r.Upstream.AuthMapType],
+				Address:          r.Upstream.Server.Address,
+				Priority:         r.Priority,
+				Weight:           r.Weight,
+			})
+		}
+
+		rows = append(rows, row)
+	}
+
+	if c.Bool("json") {
+		return printJSON(c.App.Writer, rows)
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tMEMBERS\tUPSTREAM\tUPSTREAM AUTH\tPRIORITY\tWEIGHT")
+	for _, g := range rows {
+		members := strings.Join(g.Members, ",")
+
+		if len(g.Upstreams) == 0 {
+			fmt.Fprintf(w, "%v\t%v\t\t\t\t\n", g.Name, members)
+		}
+
+		for _, u := range g.Upstreams {
+			fmt.Fprintf(w, "%v\t%v\t%v@%v\t%v\t%v\t%v\n", g.Name, members, u.UpstreamUsername, u.Address, u.UpstreamAuth, u.Priority, u.Weight)
+		}
+	}
+
+	return w.Flush()
+}
+
+func groupRmCommand(c *cli.Context, p *plugin) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one group name")
+	}
+
+	name := c.Args().First()
+
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		g := group{}
+		if err := tx.Where(&group{Name: name}).First(&g).Error; err != nil {
+			return fmt.Errorf("group %v: %w", name, err)
+		}
+
+		s := syncer{tx: tx, plugin: p, pruneServers: true}
+		if err := s.clearGroupRoutes(&g); err != nil {
+			return err
+		}
+
+		if err := tx.Where("group_id = ?", g.ID).Delete(&groupMember{}).Error; err != nil {
+			return err
+		}
+
+		// group names are unique, a soft deleted row would block adding the name again
+		if err := tx.Unscoped().Delete(&g).Error; err != nil {
+			return err
+		}
+
+		fmt.Fprintf(c.App.Writer, "removed group %v\n", name)
+		return nil
+	})
+}
+
+// groupMembership returns the group and downstream named by the arguments of join and leave
+func groupMembership(c *cli.Context, db *gorm.DB) (*group, *downstream, error) {
+	if c.NArg() != 2 {
+		return nil, nil, fmt.Errorf("expected group name and username")
+	}
+
+	g := group{}
+	if err := db.Where(&group{Name: c.Args().Get(0)}).First(&g).Error; err != nil {
+		return nil, nil, fmt.Errorf("group %v: %w", c.Args().Get(0), err)
+	}
+
+	d := downstream{}
+	if err := db.Where(&downstream{Username: c.Args().Get(1)}).First(&d).Error; err != nil {
+		return nil, nil, fmt.Errorf("downstream %v: %w", c.Args().Get(1), err)
+	}
+
+	return &g, &d, nil
+}
+
+func groupJoinCommand(c *cli.Context, p *plugin) error {
+	g, d, err := groupMembership(c, p.db)
+	if err != nil {
+		return err
+	}
+
+	if err := joinGroups(p.db, d, []string{g.Name}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.App.Writer, "added downstream %v to group %v\n", d.Username, g.Name)
+	return nil
+}
+
+func groupLeaveCommand(c *cli.Context, p *plugin) error {
+	g, d, err := groupMembership(c, p.db)
+	if err != nil {
+		return err
+	}
+
+	result := p.db.Where("group_id = ? AND downstream_id = ?", g.ID, d.ID).Delete(&groupMember{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("downstream %v is not a member of group %v", d.Username, g.Name)
+	}
+
+	fmt.Fprintf(c.App.Writer, "removed downstream %v from group %v\n", d.Username, g.Name)
+	return nil
+}
+
+func keyImportCommand(c *cli.Context, p *plugin) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one file")
+	}
+
+	data, err := os.ReadFile(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	k := keydata{
+		Name: c.String("name"),
+		Data: string(data),
+		Type: c.String("type"),
+	}
+
+	detected := ""
+	switch {
+	case isPrivateKey(k.Data):
+		detected = "privatekey"
+	case validateCertificate(k.Data) == nil:
+		detected = "certificate"
+	case validateAuthorizedKeys(k.Data) == nil:
+		detected = "publickey"
+	case validateKnownHosts(k.Data) == nil:
+		detected = "knownhosts"
+	default:
+		return fmt.Errorf("%v is not a private key, certificate, authorized_keys or known_hosts file", c.Args().First())
+	}
+
+	if k.Type == "" {
+		k.Type = detected
+	}
+
+	if err := p.saveKeydata(p.db, &k); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.App.Writer, k.ID)
+	return nil
+}
+
+func serverAddCommand(c *cli.Context, p *plugin) error {
+	s, err := newServer(c, c.String("name"), c.String("banner"))
+	if err != nil {
+		return err
+	}
+
+	if err := p.db.Where(&server{Name: s.Name}).First(&server{}).Error; err == nil {
+		return fmt.Errorf("server %v already exists", s.Name)
+	}
+
+	if err := p.setJumpFromFlags(c, s); err != nil {
+		return err
+	}
+
+	if err := p.saveServer(p.db, s); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.App.Writer, s.ID)
+	return nil
+}
+
+func configSetCommand(c *cli.Context, p *plugin) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("expected entry and value")
+	}
+
+	entry, value := c.Args().Get(0), c.Args().Get(1)
+
+	switch entry {
+	case fallbackUserEntry:
+		if err := p.db.Where(&downstream{Username: value}).First(&downstream{}).Error; err != nil {
+			return fmt.Errorf("downstream %v: %w", value, err)
+		}
+	case trustedUserCAKeysEntry:
+		if err := p.db.Where(&keydata{Name: value}).First(&keydata{}).Error; err != nil {
+			return fmt.Errorf("keydata %v: %w", value, err)
+		}
+	case allowedSourcesEntry, deniedSourcesEntry:
+		if _, err := parseSourceList(value); err != nil {
+			return err
+		}
+	case bannerEntry:
+		if err := validateBanner(value); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown config entry %v, expected one of %v", entry, strings.Join(configEntries, ", "))
+	}
+
+	cfg := config{}
+	if err := p.db.Where(&config{Entry: entry}).Assign(config{Value: value}).FirstOrCreate(&cfg).Error; err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.App.Writer, "%v = %v\n", entry, value)
+	return nil
+}
+
+func newServer(c *cli.Context, name, banner string) (*server, error) {
+	address := c.String("address")
+	if address == "" {
+		return nil, fmt.Errorf("--address is required")
+	}
+
+	if _, _, err := libplugin.SplitHostPortForSSH(address); err != nil {
+		return nil, fmt.Errorf("invalid address %v: %w", address, err)
+	}
+
+	hostKey, err := readKeyFile(c.String("host-key-file"), validateHostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateBanner(banner); err != nil {
+		return nil, err
+	}
+
+	if hostKey == "" && !c.Bool("ignore-host-key") && !c.Bool("trust-on-first-use") {
+		return nil, fmt.Errorf("one of --host-key-file, --ignore-host-key or --trust-on-first-use is required")
+	}
+
+	s := &server{
+		Name:            name,
+		Address:         address,
+		IgnoreHostKey:   c.Bool("ignore-host-key"),
+		TrustOnFirstUse: c.Bool("trust-on-first-use"),
+		Banner:          banner,
+	}
+
+	if hostKey != "" {
+		s.HostKey = keydata{Data: hostKey, Type: "knownhosts"}
+	}
+
+	return s, nil
+}
+
+// setJumpFromFlags sets the jump server of s from --via-server, and the credentials
+// logging in to s as jump server
+func (p *plugin) setJumpFromFlags(c *cli.Context, s *server) error {
+	if name := c.String("via-server"); name != "" {
+		via := server{}
+		if err := p.db.Where(&server{Name: name}).First(&via).Error; err != nil {
+			return fmt.Errorf("server %v: %w", name, err)
+		}
+
+		s.ViaServerID = int(via.ID)
+	}
+
+	privateKey, err := readKeyFile(c.String("jump-private-key-file"), validatePrivateKey)
+	if err != nil {
+		return err
+	}
+
+	if privateKey != "" {
+		s.JumpPrivateKey = keydata{Data: privateKey, Type: "privatekey"}
+	}
+
+	s.JumpUsername = c.String("jump-username")
+	s.JumpPassword = c.String("jump-password")
+
+	return nil
+}
+
+// saveServer saves s along with its new keys, then seals its jump credentials
+func (p *plugin) saveServer(tx *gorm.DB, s *server) error {
+	password, privateKey := s.JumpPassword, s.JumpPrivateKey.Data
+	s.JumpPassword, s.JumpPrivateKey.Data = "", ""
+
+	if err := tx.Save(s).Error; err != nil {
+		return err
+	}
+
+	if err := p.sealRow(tx, &s.JumpPrivateKey, "keydata", s.JumpPrivateKey.ID, map[string]string{"data": privateKey}); err != nil {
+		return err
+	}
+
+	return p.sealRow(tx, s, "servers", s.ID, map[string]string{"jump_password": password})
+}
+
+// saveKeydata saves k, a private key is sealed once the row exists
+func (p *plugin) saveKeydata(tx *gorm.DB, k *keydata) error {
+	data := k.Data
+	secret := isPrivateKey(data) || isEncrypted(data)
+	if secret {
+		k.Data = ""
+	}
+
+	if err := tx.Save(k).Error; err != nil {
+		return err
+	}
+
+	if !secret {
+		return nil
+	}
+
+	return p.sealRow(tx, k, "keydata", k.ID, map[string]string{"data": data})
+}
+
+// checkDownstreamCredentials rejects a downstream auth without the credentials it needs,
+// publicKeys reports whether authorized keys or trusted user CA keys accept a public key
+func checkDownstreamCredentials(fromType authMapType, password string, publicKeys bool) error {
+	if fromType != authMapTypePassword && !publicKeys {
+		return fmt.Errorf("auth %v requires authorized keys or trusted user CA keys", authMapTypeNames[fromType])
+	}
+
+	// an empty password accepts any password, which would make the public key optional
+	if fromType == authMapTypePasswordOrPrivateKey && password == "" {
+		return fmt.Errorf("auth %v requires a password", authMapTypeNames[fromType])
+	}
+
+	return nil
+}
+
+// hashPassword bcrypt hashes a downstream password unless it is already a supported hash
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+
+	if ok, err := verifyPassword(password, nil, false); ok || err != errPlaintextPasswordNotAllowed {
+		return password, nil
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashed), nil
+}
+
+func readKeyFile(path string, validate func(string) error) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if err := validate(string(data)); err != nil {
+		return "", fmt.Errorf("%v: %w", path, err)
+	}
+
+	return string(data), nil
+}
+
+func validatePrivateKey(data string) error {
+	_, err := ssh.ParsePrivateKey([]byte(data))
+	return err
+}
+
+// privateKeyValidator validates a private key protected by passphrase, or unprotected if passphrase is empty
+func privateKeyValidator(passphrase string) func(string) error {
+	if passphrase == "" {
+		return validatePrivateKey
+	}
+
+	return func(data string) error {
+		_, err := ssh.ParsePrivateKeyWithPassphrase([]byte(data), []byte(passphrase))
+		return err
+	}
+}
+
+// isPrivateKey accepts unprotected and passphrase protected private keys
+func isPrivateKey(data string) bool {
+	err := validatePrivateKey(data)
+
+	var missing *ssh.PassphraseMissingError
+	return err == nil || errors.As(err, &missing)
+}
+
+func parseCertificate(data string) (*ssh.Certificate, error) {
+	pub, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("expected a single certificate")
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("not an OpenSSH user certificate")
+	}
+
+	return cert, nil
+}
+
+func validateCertificate(data string) error {
+	_, err := parseCertificate(data)
+	return err
+}
+
+// validateCertificateOf checks that the certificate certifies the public key of the private key
+func validateCertificateOf(certificate, privateKey, passphrase string) error {
+	if privateKey == "" {
+		return fmt.Errorf("a certificate requires an upstream private key")
+	}
+
+	cert, err := parseCertificate(certificate)
+	if err != nil {
+		return err
+	}
+
+	var signer ssh.Signer
+	if passphrase == "" {
+		signer, err = ssh.ParsePrivateKey([]byte(privateKey))
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return fmt.Errorf("certificate is not for the upstream private key")
+	}
+
+	return nil
+}
+
+func validateAuthorizedKeys(data string) error {
+	rest := []byte(strings.TrimSpace(data))
+	if len(rest) == 0 {
+		return fmt.Errorf("no keys found")
+	}
+
+	for len(rest) > 0 {
+		_, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return err
+		}
+
+		rest = next
+	}
+
+	return nil
+}
+
+func validateKnownHosts(data string) error {
+	rest := []byte(strings.TrimSpace(data))
+	if len(rest) == 0 {
+		return fmt.Errorf("no keys found")
+	}
+
+	for len(rest) > 0 {
+		_, _, _, _, next, err := ssh.ParseKnownHosts(rest)
+		if err != nil {
+			return err
+		}
+
+		rest = next
+	}
+
+	return nil
+}
+
+// validateHostKey accepts the formats understood by skelpipeToWrapper.KnownHosts
+func validateHostKey(data string) error {
+	if validateKnownHosts(data) == nil || validateAuthorizedKeys(data) == nil || validatePrivateKey(data) == nil {
+		return nil
+	}
+
+	return fmt.Errorf("not a public key or known_hosts file")
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
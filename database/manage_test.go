@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func runTestCommand(t *testing.T, dbfile string, args ...string) (string, error) {
+	var out bytes.Buffer
+
+	app := &cli.App{
+		Name:     "database",
+		Commands: commands(),
+		Writer:   &out,
+	}
+
+	if len(args) < 2 {
+		t.Fatalf("expected command and subcommand, got %v", args)
+	}
+
+	full := append([]string{"database"}, args[:2]...)
+	full = append(full, "--driver", "sqlite3", "--sqlite-file", dbfile)
+	full = append(full, args[2:]...)
+
+	err := app.Run(full)
+	return out.String(), err
+}
+
+func TestManagePipeCommands(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "test.db")
+
+	if _, err := runTestCommand(t, dbfile, "server", "add", "--name", "backup", "--address", "backup:2222", "--ignore-host-key"); err != nil {
+		t.Fatalf("server add failed: %v", err)
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "add", "--username", "bob", "--password", "secret",
+		"--upstream-username", "app", "--upstream-password", "pass", "--address", "primary", "--ignore-host-key"); err != nil {
+		t.Fatalf("pipe add failed: %v", err)
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "add", "--username", "bob",
+		"--upstream-username", "app", "--server", "backup", "--priority", "1"); err != nil {
+		t.Fatalf("pipe add candidate failed: %v", err)
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "add", "--username", "bob", "--password", "changed",
+		"--upstream-username", "app", "--server", "backup"); err == nil {
+		t.Errorf("expected downstream flags of an existing downstream to fail")
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "add", "--username", "bob", "--match", "glob",
+		"--upstream-username", "app", "--server", "backup"); err == nil || !strings.Contains(err.Error(), "match exact") {
+		t.Errorf("expected downstream with another match type to conflict, got %v", err)
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "add", "--username", "eve", "--address", "host:port", "--ignore-host-key"); err == nil {
+		t.Errorf("expected invalid address to fail")
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "add", "--username", "eve", "--address", "host"); err == nil {
+		t.Errorf("expected missing host key to fail")
+	}
+
+	if _, err := runTestCommand(t, dbfile, "config", "set", fallbackUserEntry, "nobody"); err == nil {
+		t.Errorf("expected unknown fallback user to fail")
+	}
+
+	if _, err := runTestCommand(t, dbfile, "config", "set", fallbackUserEntry, "bob"); err != nil {
+		t.Errorf("config set failed: %v", err)
+	}
+
+	out, err := runTestCommand(t, dbfile, "pipe", "list", "--json")
+	if err != nil {
+		t.Fatalf("pipe list failed: %v", err)
+	}
+
+	var rows []pipeRow
+	if err := json.Unmarshal([]byte(out), &rows); err != nil {
+		t.Fatalf("invalid json %v: %v", out, err)
+	}
+
+	if len(rows) != 2 || rows[0].Address != "primary" || rows[1].Address != "backup:2222" || rows[1].Priority != 1 {
+		t.Errorf("unexpected rows %+v", rows)
+	}
+
+	p := &plugin{}
+	if err := p.Init(&sqliteplugin{File: dbfile}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := downstream{}
+	if err := p.db.Where(&downstream{Username: "bob"}).First(&d).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(d.Password), []byte("secret")) != nil {
+		t.Errorf("expected bcrypt hashed password, got %v", d.Password)
+	}
+
+	p.Close()
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "rm", "bob"); err != nil {
+		t.Fatalf("pipe rm failed: %v", err)
+	}
+
+	out, err = runTestCommand(t, dbfile, "pipe", "list")
+	if err != nil {
+		t.Fatalf("pipe list failed: %v", err)
+	}
+
+	if strings.Contains(out, "bob") {
+		t.Errorf("expected bob removed, got %v", out)
+	}
+
+	p = &plugin{}
+	if err := p.Init(&sqliteplugin{File: dbfile}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Close()
+
+	var upstreams int64
+	if err := p.db.Model(&upstream{}).Count(&upstreams).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var servers []string
+	if err := p.db.Model(&server{}).Pluck("address", &servers).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if upstreams != 0 || len(servers) != 1 || servers[0] != "backup:2222" {
+		t.Errorf("expected upstreams and unnamed servers of bob removed, got %v upstreams, servers %v", upstreams, servers)
+	}
+}
+
+func TestManageGroupCommands(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "test.db")
+
+	if _, err := runTestCommand(t, dbfile, "group", "add", "--name", "dev", "--address", "dev1", "--ignore-host-key"); err != nil {
+		t.Fatalf("group add failed: %v", err)
+	}
+
+	if _, err := runTestCommand(t, dbfile, "group", "add", "--name", "dev", "--address", "dev2", "--ignore-host-key", "--priority", "1"); err != nil {
+		t.Fatalf("group add candidate failed: %v", err)
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "add", "--username", "alice", "--groups", "ops"); err == nil {
+		t.Errorf("expected unknown group to fail")
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "add", "--username", "alice", "--groups", "dev"); err != nil {
+		t.Fatalf("pipe add with groups failed: %v", err)
+	}
+
+	out, err := runTestCommand(t, dbfile, "group", "list", "--json")
+	if err != nil {
+		t.Fatalf("group list failed: %v", err)
+	}
+
+	var rows []groupRow
+	if err := json.Unmarshal([]byte(out), &rows); err != nil {
+		t.Fatalf("invalid json %v: %v", out, err)
+	}
+
+	if len(rows) != 1 || len(rows[0].Members) != 1 || rows[0].Members[0] != "alice" || len(rows[0].Upstreams) != 2 {
+		t.Errorf("unexpected rows %+v", rows)
+	}
+
+	out, err = runTestCommand(t, dbfile, "pipe", "list", "--json")
+	if err != nil {
+		t.Fatalf("pipe list failed: %v", err)
+	}
+
+	var pipeRows []pipeRow
+	if err := json.Unmarshal([]byte(out), &pipeRows); err != nil {
+		t.Fatalf("invalid json %v: %v", out, err)
+	}
+
+	if len(pipeRows) != 2 || pipeRows[0].Username != "alice" || pipeRows[0].Group != "dev" || pipeRows[1].Address != "dev2" {
+		t.Errorf("expected group routes of alice in pipe list, got %+v", pipeRows)
+	}
+
+	p := &plugin{}
+	if err := p.Init(&sqliteplugin{File: dbfile}); err != nil {
+		t.Fatal(err)
+	}
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 2 || pipes[0].UpstreamHost != "dev1" || pipes[1].UpstreamHost != "dev2" {
+		t.Errorf("unexpected pipes %+v", pipes)
+	}
+
+	p.Close()
+
+	if _, err := runTestCommand(t, dbfile, "group", "leave", "dev", "alice"); err != nil {
+		t.Fatalf("group leave failed: %v", err)
+	}
+
+	if _, err := runTestCommand(t, dbfile, "group", "leave", "dev", "alice"); err == nil {
+		t.Errorf("expected leaving twice to fail")
+	}
+
+	if _, err := runTestCommand(t, dbfile, "group", "rm", "dev"); err != nil {
+		t.Fatalf("group rm failed: %v", err)
+	}
+
+	out, err = runTestCommand(t, dbfile, "group", "list")
+	if err != nil {
+		t.Fatalf("group list failed: %v", err)
+	}
+
+	if strings.Contains(out, "dev") {
+		t.Errorf("expected dev removed, got %v", out)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tg123/sshpiper/libplugin"
+)
+
+type matchType int
+
+const (
+	matchTypeExact = iota
+	matchTypeGlob
+	matchTypeRegex
+)
+
+// userMatch holds the capture groups of a downstream matched by pattern,
+// they can be referenced as $1 or ${name} in upstream username and server address
+type userMatch struct {
+	re       *regexp.Regexp
+	user     string
+	submatch []int
+}
+
+func (m *userMatch) expand(template string) string {
+	if m == nil {
+		return template
+	}
+
+	return string(m.re.ExpandString(nil, template, m.user, m.submatch))
+}
+
+// expandAddress expands an upstream address template like expand. Captures it uses may only
+// hold host name characters, so the login user cannot move the upstream to another port or
+// smuggle in a user@ or path.
+func (m *userMatch) expandAddress(template string) (string, error) {
+	if m == nil {
+		return template, nil
+	}
+
+	// expand from a copy of the captures where invalid ones are replaced by a marker
+	var src strings.Builder
+	submatch := make([]int, len(m.submatch))
+
+	for i := 0; i+1 < len(m.submatch); i += 2 {
+		if m.submatch[i] < 0 {
+			submatch[i], submatch[i+1] = -1, -1
+			continue
+		}
+
+		capture := m.user[m.submatch[i]:m.submatch[i+1]]
+		if !isHostnameCapture(capture) {
+			capture = "\x00"
+		}
+
+		submatch[i] = src.Len()
+		src.WriteString(capture)
+		submatch[i+1] = src.Len()
+	}
+
+	addr := string(m.re.ExpandString(nil, template, src.String(), submatch))
+	if strings.Contains(addr, "\x00") {
+		return "", fmt.Errorf("login %v puts characters other than letters, digits, '.', '-' and '_' into address %v", m.user, template)
+	}
+
+	if _, _, err := libplugin.SplitHostPortForSSH(addr); err != nil {
+		return "", fmt.Errorf("invalid address %v: %w", addr, err)
+	}
+
+	return addr, nil
+}
+
+func isHostnameCapture(s string) bool {
+	for _, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func compileUserPattern(t matchType, pattern string) (*regexp.Regexp, error) {
+	switch t {
+	case matchTypeGlob:
+		return regexp.Compile(globToRegexp(pattern))
+	case matchTypeRegex:
+		// the whole login must match, like a glob
+		return regexp.Compile("^(?:" + pattern + ")$")
+	}
+
+	return nil, fmt.Errorf("unsupported match type %d", t)
+}
+
+func matchUser(t matchType, pattern, user string) (*userMatch, error) {
+	re, err := compileUserPattern(t, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	submatch := re.FindStringSubmatchIndex(user)
+	if submatch == nil {
+		return nil, nil
+	}
+
+	return &userMatch{
+		re:       re,
+		user:     user,
+		submatch: submatch,
+	}, nil
+}
+
+// globToRegexp converts a glob into an anchored regexp where each * and ? is a capture group
+func globToRegexp(glob string) string {
+	var b strings.Builder
+
+	b.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString("(.*)")
+		case '?':
+			b.WriteString("(.)")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta(glob[i:]))
+				i = len(glob)
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+			negate := strings.HasPrefix(class, "!")
+			if negate {
+				class = class[1:]
+			}
+
+			// \, [ and ^ are literal in a glob class but start escapes, [:name:] classes and negation in a regexp one
+			class = strings.NewReplacer(`\`, `\\`, "[", `\[`, "^", `\^`).Replace(class)
+			if negate {
+				class = "^" + class
+			}
+
+			b.WriteString("([" + class + "])")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+
+	return b.String()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchUserGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		user    string
+		match   bool
+		expand  string
+	}{
+		{"ci-*", "ci-build", true, "build"},
+		{"ci-*", "xci-build", false, ""},
+		{"web?", "web1", true, "1"},
+		{"db[0-9]", "db7", true, "7"},
+		{"db[!0-9]", "db7", false, ""},
+		{"a.b", "axb", false, ""},
+		{`x[\n]`, `x\`, true, `\`},
+		{`x[\n]`, "x\n", false, ""},
+		{"x[[:]", "x:", true, ":"},
+		{"x[[:alpha:]]", "x[]", true, "["},
+		{"x[[:alpha:]]", "xa", false, ""},
+		{"x[^a]", "xa", true, "a"},
+	} {
+		m, err := matchUser(matchTypeGlob, tc.pattern, tc.user)
+		if err != nil {
+			t.Fatalf("pattern %v: %v", tc.pattern, err)
+		}
+
+		if (m != nil) != tc.match {
+			t.Errorf("pattern %v user %v: expected match %v", tc.pattern, tc.user, tc.match)
+			continue
+		}
+
+		if m != nil && m.expand("$1") != tc.expand {
+			t.Errorf("pattern %v user %v: expected $1 = %v, got %v", tc.pattern, tc.user, tc.expand, m.expand("$1"))
+		}
+	}
+}
+
+func TestMatchUserRegexExpand(t *testing.T) {
+	m, err := matchUser(matchTypeRegex, `^team-(?P<team>\w+)$`, "team-infra")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m == nil {
+		t.Fatal("expected match")
+	}
+
+	if got := m.expand("$1@build-${team}.internal:22"); got != "infra@build-infra.internal:22" {
+		t.Errorf("unexpected expansion %v", got)
+	}
+
+	for pattern, user := range map[string]string{`team-\w+`: "xteam-infra", `ci|deploy`: "ci-admin"} {
+		if m, err := matchUser(matchTypeRegex, pattern, user); err != nil || m != nil {
+			t.Errorf("expected regex %v to match whole logins only, %v matched: %v", pattern, user, err)
+		}
+	}
+
+	var nomatch *userMatch
+	if got := nomatch.expand("$1"); got != "$1" {
+		t.Errorf("exact match should not expand, got %v", got)
+	}
+}
+
+func TestMatchUserExpandAddress(t *testing.T) {
+	m, err := matchUser(matchTypeGlob, "dev-*", "dev-web1.lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := m.expandAddress("$1.internal:2222"); err != nil || got != "web1.lab.internal:2222" {
+		t.Errorf("unexpected expansion %v, %v", got, err)
+	}
+
+	for _, user := range []string{"dev-evil.com:22#", "dev-x/y", "dev-root@evil.com", "dev-a b", "dev-[::1]"} {
+		m, err := matchUser(matchTypeGlob, "dev-*", user)
+		if err != nil || m == nil {
+			t.Fatalf("expected %v to match, got %v", user, err)
+		}
+
+		if got, err := m.expandAddress("$1.internal:2222"); err == nil {
+			t.Errorf("expected login %v to be rejected, got %v", user, got)
+		}
+	}
+
+	// captures not used in the address are not restricted
+	m, err = matchUser(matchTypeRegex, `^(\w+)\+(.*)$`, "web1+a:b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := m.expandAddress("$1:22"); err != nil || got != "web1:22" {
+		t.Errorf("unexpected expansion %v, %v", got, err)
+	}
+}
+
+func TestLookupDownstreamByPattern(t *testing.T) {
+	p := newTestPlugin(t)
+
+	for _, d := range []downstream{
+		{Username: "ci-special", Upstream: upstream{Username: "special", Server: server{Address: "special:22"}}},
+		{Username: "ci-*", MatchType: matchTypeGlob, MatchPriority: 10, Upstream: upstream{Username: "$1", Server: server{Address: "build-$1.internal:22"}}},
+		{Username: "ci-(.*)", MatchType: matchTypeRegex, MatchPriority: 20, Upstream: upstream{Username: "never", Server: server{Address: "never:22"}}},
+		{Username: `^team-(\w+)$`, MatchType: matchTypeRegex, Upstream: upstream{Username: "root", Server: server{Address: "$1.internal"}}},
+	} {
+		if err := p.db.Create(&d).Error; err != nil {
+			t.Fatalf("failed to create downstream: %v", err)
+		}
+	}
+
+	for user, expected := range map[string]string{
+		"ci-special": "special@special:22",
+		"ci-foo":     "foo@build-foo.internal:22",
+		"team-infra": "root@infra.internal",
+	} {
+		pipes, err := p.loadPipeFromDB(&testConn{user: user})
+		if err != nil {
+			t.Errorf("user %v: %v", user, err)
+			continue
+		}
+
+		if got := pipes[0].upstreamKey(); got != expected {
+			t.Errorf("user %v: expected %v, got %v", user, expected, got)
+		}
+	}
+
+	if _, err := p.loadPipeFromDB(&testConn{user: "nobody"}); err == nil {
+		t.Errorf("unknown user should not match")
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// schemaMigration records an applied migration
+type schemaMigration struct {
+	Version   int    `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"type:varchar(100)"`
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// migration changes the schema from version-1 to version, down reverts it.
+// Steps are idempotent so databases created by AutoMigrate before versioned
+// migrations existed are adopted by running all of them.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+// migrations use the frozen models below, never the models in model.go,
+// so later model changes do not alter what an old migration does
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create keydata, servers, upstreams, downstreams and configs",
+		up: func(tx *gorm.DB) error {
+			return createTables(tx, new(keydataV1), new(serverV1), new(upstreamV1), new(downstreamV1), new(configV1))
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(new(configV1), new(downstreamV1), new(upstreamV1), new(serverV1), new(keydataV1))
+		},
+	},
+	{
+		version: 2,
+		name:    "create routes",
+		up: func(tx *gorm.DB) error {
+			return createTables(tx, new(routeV2))
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(new(routeV2))
+		},
+	},
+	{
+		version: 3,
+		name:    "add downstream trusted_user_ca_keys_id and allowed_principals",
+		up: func(tx *gorm.DB) error {
+			return addColumns(tx, new(downstreamV3), "TrustedUserCAKeysID", "AllowedPrincipals")
+		},
+		down: func(tx *gorm.DB) error {
+			return dropColumns(tx, new(downstreamV3), "TrustedUserCAKeysID", "AllowedPrincipals")
+		},
+	},
+	{
+		version: 4,
+		name:    "add downstream match_type and match_priority",
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, new(downstreamV4), "MatchType", "MatchPriority"); err != nil {
+				return err
+			}
+
+			return backfillColumns(tx, "downstreams", map[string]interface{}{
+				"match_type":     matchTypeExact,
+				"match_priority": 0,
+			})
+		},
+		down: func(tx *gorm.DB) error {
+			return dropColumns(tx, new(downstreamV4), "MatchType", "MatchPriority")
+		},
+	},
+	{
+		version: 5,
+		name:    "add downstream allow_any_public_key and no_passthrough",
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, new(downstreamV5), "AllowAnyPublicKey", "NoPassthrough"); err != nil {
+				return err
+			}
+
+			return backfillColumns(tx, "downstreams", map[string]interface{}{
+				"allow_any_public_key": false,
+				"no_passthrough":       false,
+			})
+		},
+		down: func(tx *gorm.DB) error {
+			return dropColumns(tx, new(downstreamV5), "AllowAnyPublicKey", "NoPassthrough")
+		},
+	},
+	{
+		version: 6,
+		name:    "widen downstream and upstream password to varchar(255)",
+		up: func(tx *gorm.DB) error {
+			if err := alterVarchar(tx, new(downstreamV6), "Password", 255); err != nil {
+				return err
+			}
+
+			return alterVarchar(tx, new(upstreamV6), "Password", 255)
+		},
+		down: func(tx *gorm.DB) error {
+			if err := alterVarchar(tx, new(downstreamV1), "Password", 60); err != nil {
+				return err
+			}
+
+			return alterVarchar(tx, new(upstreamV1), "Password", 60)
+		},
+	},
+	{
+		version: 7,
+		name:    "add downstream valid_from, valid_until, access_windows and access_timezone",
+		up: func(tx *gorm.DB) error {
+			return addColumns(tx, new(downstreamV7), "ValidFrom", "ValidUntil", "AccessWindows", "AccessTimezone")
+		},
+		down: func(tx *gorm.DB) error {
+			return dropColumns(tx, new(downstreamV7), "ValidFrom", "ValidUntil", "AccessWindows", "AccessTimezone")
+		},
+	},
+	{
+		version: 8,
+		name:    "add downstream allowed_sources and denied_sources, widen config value",
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, new(downstreamV8), "AllowedSources", "DeniedSources"); err != nil {
+				return err
+			}
+
+			return alterVarchar(tx, new(configV8), "Value", 255)
+		},
+		down: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, new(downstreamV8), "AllowedSources", "DeniedSources"); err != nil {
+				return err
+			}
+
+			return alterVarchar(tx, new(configV1), "Value", 100)
+		},
+	},
+	{
+		version: 9,
+		name:    "create audit_events",
+		up: func(tx *gorm.DB) error {
+			return createTables(tx, new(auditEventV9))
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(new(auditEventV9))
+		},
+	},
+	{
+		version: 10,
+		name:    "create login_lockouts",
+		up: func(tx *gorm.DB) error {
+			return createTables(tx, new(loginLockoutV10))
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(new(loginLockoutV10))
+		},
+	},
+	{
+		version: 11,
+		name:    "add upstream private_key_passphrase and certificate_id",
+		up: func(tx *gorm.DB) error {
+			return addColumns(tx, new(upstreamV11), "PrivateKeyPassphrase", "CertificateID")
+		},
+		down: func(tx *gorm.DB) error {
+			return dropColumns(tx, new(upstreamV11), "PrivateKeyPassphrase", "CertificateID")
+		},
+	},
+	{
+		version: 12,
+		name:    "add server trust_on_first_use",
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, new(serverV12), "TrustOnFirstUse"); err != nil {
+				return err
+			}
+
+			return backfillColumns(tx, "servers", map[string]interface{}{"trust_on_first_use": false})
+		},
+		down: func(tx *gorm.DB) error {
+			return dropColumns(tx, new(serverV12), "TrustOnFirstUse")
+		},
+	},
+	{
+		version: 13,
+		name:    "create groups, group_routes and group_members",
+		up: func(tx *gorm.DB) error {
+			return createTables(tx, new(groupV13), new(groupRouteV13), new(groupMemberV13))
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(new(groupMemberV13), new(groupRouteV13), new(groupV13))
+		},
+	},
+	{
+		version: 14,
+		name:    "add downstream and server banner",
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, new(downstreamV14), "Banner"); err != nil {
+				return err
+			}
+
+			return addColumns(tx, new(serverV14), "Banner")
+		},
+		down: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, new(downstreamV14), "Banner"); err != nil {
+				return err
+			}
+
+			return dropColumns(tx, new(serverV14), "Banner")
+		},
+	},
+	{
+		version: 15,
+		name:    "add upstream username_mapping, widen upstream username to varchar(255)",
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, new(upstreamV15), "UsernameMapping"); err != nil {
+				return err
+			}
+
+			if err := backfillColumns(tx, "upstreams", map[string]interface{}{"username_mapping": usernameMappingAuto}); err != nil {
+				return err
+			}
+
+			return alterVarchar(tx, new(upstreamV15), "Username", 255)
+		},
+		down: func(tx *gorm.DB) error {
+			if err := dropColumns(tx, new(upstreamV15), "UsernameMapping"); err != nil {
+				return err
+			}
+
+			return alterVarchar(tx, new(upstreamV1), "Username", 45)
+		},
+	},
+	{
+		version: 16,
+		name:    "add server via_server_id and jump credentials",
+		up: func(tx *gorm.DB) error {
+			return addColumns(tx, new(serverV16), "ViaServerID", "JumpUsername", "JumpPassword", "JumpPrivateKeyID")
+		},
+		down: func(tx *gorm.DB) error {
+			return dropColumns(tx, new(serverV16), "ViaServerID", "JumpUsername", "JumpPassword", "JumpPrivateKeyID")
+		},
+	},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// schemaVersion returns the latest applied migration, 0 for an empty database
+func schemaVersion(db *gorm.DB) (int, error) {
+	if err := db.Migrator().AutoMigrate(new(schemaMigration)); err != nil {
+		return 0, err
+	}
+
+	var version int
+	if err := db.Model(new(schemaMigration)).Select("coalesce(max(version), 0)").Row().Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func checkSchemaVersion(db *gorm.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if version != latestSchemaVersion() {
+		return fmt.Errorf("database schema is at version %v, expected %v, run the migrate command", version, latestSchemaVersion())
+	}
+
+	return nil
+}
+
+// migrateTo applies or reverts migrations until the schema is at version target
+func migrateTo(db *gorm.DB, target int) error {
+	if target < 0 || target > latestSchemaVersion() {
+		return fmt.Errorf("unknown schema version %v, latest is %v", target, latestSchemaVersion())
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+
+			return tx.Create(&schemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+		}); err != nil {
+			return fmt.Errorf("migration %v %v: %w", m.version, m.name, err)
+		}
+
+		log.Infof("applied migration %v: %v", m.version, m.name)
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+
+			return tx.Delete(&schemaMigration{Version: m.version}).Error
+		}); err != nil {
+			return fmt.Errorf("reverting migration %v %v: %w", m.version, m.name, err)
+		}
+
+		log.Infof("reverted migration %v: %v", m.version, m.name)
+	}
+
+	return nil
+}
+
+// createTables creates missing tables, existing tables are left as they are
+func createTables(tx *gorm.DB, models ...interface{}) error {
+	for _, model := range models {
+		if tx.Migrator().HasTable(model) {
+			continue
+		}
+
+		if err := tx.Migrator().CreateTable(model); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	for _, field := range fields {
+		if tx.Migrator().HasColumn(model, field) {
+			continue
+		}
+
+		if err := tx.Migrator().AddColumn(model, field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dropColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	for _, field := range fields {
+		if !tx.Migrator().HasColumn(model, field) {
+			continue
+		}
+
+		if err := tx.Migrator().DropColumn(model, field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backfillColumns sets columns that AutoMigrate added as NULL to existing rows
+func backfillColumns(tx *gorm.DB, table string, values map[string]interface{}) error {
+	for column, value := range values {
+		if err := tx.Table(table).Where(column+" IS NULL").UpdateColumn(column, value).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// alterVarchar changes a varchar column to the type of field in model, unless it already has size
+func alterVarchar(tx *gorm.DB, model interface{}, field string, size int64) error {
+	// sqlite does not enforce varchar sizes
+	if tx.Dialector.Name() == "sqlite" {
+		return nil
+	}
+
+	types, err := tx.Migrator().ColumnTypes(model)
+	if err != nil {
+		return err
+	}
+
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+
+	column := stmt.Schema.LookUpField(field).DBName
+
+	for _, t := range types {
+		if t.Name() != column {
+			continue
+		}
+
+		if length, ok := t.Length(); ok && length == size {
+			return nil
+		}
+	}
+
+	return tx.Migrator().AlterColumn(model, field)
+}
+
+// frozen models, as of the migration version in their name
+
+type keydataV1 struct {
+	gorm.Model
+
+	Name string `gorm:"type:varchar(45)"`
+	Data string `gorm:"type:text"`
+	Type string `gorm:"type:varchar(45)"`
+}
+
+func (keydataV1) TableName() string { return "keydata" }
+
+type serverV1 struct {
+	gorm.Model
+
+	Name          string `gorm:"type:varchar(45)"`
+	Address       string `gorm:"type:varchar(100)"`
+	HostKeyID     int
+	IgnoreHostKey bool
+}
+
+func (serverV1) TableName() string { return "servers" }
+
+type upstreamV1 struct {
+	gorm.Model
+
+	Name         string `gorm:"type:varchar(45)"`
+	ServerID     int
+	Username     string `gorm:"type:varchar(45)"`
+	Password     string `gorm:"type:varchar(60)"`
+	PrivateKeyID int
+	AuthMapType  int
+}
+
+func (upstreamV1) TableName() string { return "upstreams" }
+
+type downstreamV1 struct {
+	gorm.Model
+
+	Name             string `gorm:"type:varchar(45)"`
+	Username         string `gorm:"type:varchar(45);uniqueIndex:uix_downstreams_username"`
+	Password         string `gorm:"type:varchar(60)"`
+	AuthMapType      int
+	UpstreamID       int
+	AuthorizedKeysID int
+}
+
+func (downstreamV1) TableName() string { return "downstreams" }
+
+type configV1 struct {
+	gorm.Model
+
+	Entry string `gorm:"type:varchar(45);uniqueIndex:uix_configs_entry"`
+	Value string `gorm:"type:varchar(100)"`
+}
+
+func (configV1) TableName() string { return "configs" }
+
+type routeV2 struct {
+	gorm.Model
+
+	DownstreamID int `gorm:"index"`
+	UpstreamID   int
+	Priority     int
+	Weight       int
+}
+
+func (routeV2) TableName() string { return "routes" }
+
+type downstreamV3 struct {
+	TrustedUserCAKeysID int
+	AllowedPrincipals   string `gorm:"type:varchar(255)"`
+}
+
+func (downstreamV3) TableName() string { return "downstreams" }
+
+type downstreamV4 struct {
+	MatchType     int `gorm:"default:0"`
+	MatchPriority int `gorm:"default:0"`
+}
+
+func (downstreamV4) TableName() string { return "downstreams" }
+
+type downstreamV5 struct {
+	AllowAnyPublicKey bool `gorm:"default:false"`
+	NoPassthrough     bool `gorm:"default:false"`
+}
+
+func (downstreamV5) TableName() string { return "downstreams" }
+
+type downstreamV6 struct {
+	Password string `gorm:"type:varchar(255)"`
+}
+
+func (downstreamV6) TableName() string { return "downstreams" }
+
+type upstreamV6 struct {
+	Password string `gorm:"type:varchar(255)"`
+}
+
+func (upstreamV6) TableName() string { return "upstreams" }
+
+type downstreamV7 struct {
+	ValidFrom      *time.Time
+	ValidUntil     *time.Time
+	AccessWindows  string `gorm:"type:varchar(255)"`
+	AccessTimezone string `gorm:"type:varchar(64)"`
+}
+
+func (downstreamV7) TableName() string { return "downstreams" }
+
+type downstreamV8 struct {
+	AllowedSources string `gorm:"type:varchar(255)"`
+	DeniedSources  string `gorm:"type:varchar(255)"`
+}
+
+func (downstreamV8) TableName() string { return "downstreams" }
+
+type configV8 struct {
+	Value string `gorm:"type:varchar(255)"`
+}
+
+func (configV8) TableName() string { return "configs" }
+
+type auditEventV9 struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index:idx_audit_events_created_at"`
+
+	Event      string `gorm:"type:varchar(32)"`
+	ConnID     string `gorm:"type:varchar(64);index:idx_audit_events_conn_id"`
+	RemoteAddr string `gorm:"type:varchar(64)"`
+	Username   string `gorm:"type:varchar(45)"`
+	Upstream   string `gorm:"type:varchar(255)"`
+	AuthMethod string `gorm:"type:varchar(32)"`
+	Error      string `gorm:"type:varchar(255)"`
+}
+
+func (auditEventV9) TableName() string { return "audit_events" }
+
+type loginLockoutV10 struct {
+	ID        uint `gorm:"primaryKey"`
+	UpdatedAt time.Time
+
+	Subject        string `gorm:"type:varchar(128);uniqueIndex:idx_login_lockouts_subject"`
+	Failures       int
+	FirstFailureAt time.Time
+	LockedUntil    *time.Time
+}
+
+func (loginLockoutV10) TableName() string { return "login_lockouts" }
+
+type upstreamV11 struct {
+	PrivateKeyPassphrase string `gorm:"type:varchar(255)"`
+	CertificateID        int
+}
+
+func (upstreamV11) TableName() string { return "upstreams" }
+
+type serverV12 struct {
+	TrustOnFirstUse bool `gorm:"default:false"`
+}
+
+func (serverV12) TableName() string { return "servers" }
+
+type groupV13 struct {
+	gorm.Model
+
+	Name string `gorm:"type:varchar(45);uniqueIndex:idx_groups_name"`
+}
+
+func (groupV13) TableName() string { return "groups" }
+
+type groupRouteV13 struct {
+	gorm.Model
+
+	GroupID    int `gorm:"index:idx_group_routes_group_id"`
+	UpstreamID int
+	Priority   int
+	Weight     int
+}
+
+func (groupRouteV13) TableName() string { return "group_routes" }
+
+type groupMemberV13 struct {
+	gorm.Model
+
+	GroupID      int `gorm:"index:idx_group_members_group_id"`
+	DownstreamID int `gorm:"index:idx_group_members_downstream_id"`
+}
+
+func (groupMemberV13) TableName() string { return "group_members" }
+
+type downstreamV14 struct {
+	Banner string `gorm:"type:text"`
+}
+
+func (downstreamV14) TableName() string { return "downstreams" }
+
+type serverV14 struct {
+	Banner string `gorm:"type:text"`
+}
+
+func (serverV14) TableName() string { return "servers" }
+
+type upstreamV15 struct {
+	Username        string `gorm:"type:varchar(255)"`
+	UsernameMapping int    `gorm:"default:0"`
+}
+
+func (upstreamV15) TableName() string { return "upstreams" }
+
+type serverV16 struct {
+	ViaServerID      int
+	JumpUsername     string `gorm:"type:varchar(45)"`
+	JumpPassword     string `gorm:"type:varchar(255)"`
+	JumpPrivateKeyID int
+}
+
+func (serverV16) TableName() string { return "servers" }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := (&sqliteplugin{File: path.Join(t.TempDir(), "test.db")}).create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { closeDB(db) })
+
+	return db
+}
+
+func TestMigrateAdoptsAutoMigratedSchema(t *testing.T) {
+	db := newTestDB(t)
+
+	// a database created by AutoMigrate before versioned migrations, with a
+	// column added later left NULL on existing rows
+	if err := createTables(db, new(keydataV1), new(serverV1), new(upstreamV1), new(downstreamV1), new(configV1), new(routeV2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Migrator().AddColumn(new(downstreamV4), "MatchType"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Exec("INSERT INTO downstreams (username, match_type) VALUES ('legacy', NULL)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateTo(db, latestSchemaVersion()); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+
+	version, err := schemaVersion(db)
+	if err != nil || version != latestSchemaVersion() {
+		t.Fatalf("expected version %v, got %v, %v", latestSchemaVersion(), version, err)
+	}
+
+	var count int64
+	if err := db.Model(&downstream{}).Where("match_type = ? AND no_passthrough = ?", matchTypeExact, false).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("expected legacy row to be backfilled, got %d rows", count)
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := migrateTo(db, latestSchemaVersion()); err != nil {
+		t.Fatalf("migrate up failed: %v", err)
+	}
+
+	if err := checkSchemaVersion(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateTo(db, 3); err != nil {
+		t.Fatalf("migrate down failed: %v", err)
+	}
+
+	if db.Migrator().HasColumn(new(downstreamV4), "MatchType") {
+		t.Errorf("expected match_type to be dropped")
+	}
+
+	if !db.Migrator().HasColumn(new(downstreamV3), "AllowedPrincipals") {
+		t.Errorf("expected allowed_principals to be kept")
+	}
+
+	if err := checkSchemaVersion(db); err == nil {
+		t.Errorf("expected outdated schema to fail the check")
+	}
+
+	if err := migrateTo(db, 0); err != nil {
+		t.Fatalf("migrate down failed: %v", err)
+	}
+
+	if db.Migrator().HasTable(new(downstreamV1)) {
+		t.Errorf("expected downstreams to be dropped")
+	}
+
+	if err := migrateTo(db, latestSchemaVersion()); err != nil {
+		t.Fatalf("migrate up again failed: %v", err)
+	}
+
+	if err := db.Create(&downstream{Username: "bob", Upstream: upstream{Server: server{Address: "host"}}}).Error; err != nil {
+		t.Errorf("expected models to fit the migrated schema: %v", err)
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	dbfile := path.Join(t.TempDir(), "test.db")
+
+	if _, err := runTestCommand(t, dbfile, "migrate", "up", "--to", "4"); err != nil {
+		t.Fatalf("migrate up failed: %v", err)
+	}
+
+	out, err := runTestCommand(t, dbfile, "migrate", "status")
+	if err != nil {
+		t.Fatalf("migrate status failed: %v", err)
+	}
+
+	if !strings.Contains(out, "pending") {
+		t.Errorf("expected pending migrations, got %v", out)
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "list", "--auto-migrate=false"); err == nil {
+		t.Errorf("expected outdated schema to fail without auto migrate")
+	}
+
+	if _, err := runTestCommand(t, dbfile, "pipe", "list"); err != nil {
+		t.Errorf("expected auto migrate to apply pending migrations: %v", err)
+	}
+
+	out, err = runTestCommand(t, dbfile, "migrate", "status")
+	if err != nil || strings.Contains(out, "pending") {
+		t.Errorf("expected all migrations applied, got %v, %v", out, err)
+	}
+}
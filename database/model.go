@@ -1,7 +1,9 @@
 package main
 
 import (
-	"github.com/jinzhu/gorm"
+	"time"
+
+	"gorm.io/gorm"
 )
 
 type authMapType int
@@ -9,10 +11,19 @@ type authMapType int
 const (
 	authMapTypePassword = iota
 	authMapTypePrivateKey
+
+	// downstream only, accept either a password or a public key
+	authMapTypePasswordOrPrivateKey
 )
 
 const fallbackUserEntry = "FALLBACK_USER"
 
+// trustedUserCAKeysEntry names a keydata row holding CA keys trusted for all downstreams
+const trustedUserCAKeysEntry = "TRUSTED_USER_CA_KEYS"
+
+// The schema is created by the versioned migrations in migrate.go, a column
+// added to a model below needs a new migration.
+
 type keydata struct {
 	gorm.Model
 
@@ -30,6 +41,23 @@ type server struct {
 	HostKeyID     int
 	HostKey       keydata
 	IgnoreHostKey bool
+	// TrustOnFirstUse records the first host key seen into HostKey when none is stored,
+	// later connections are verified against it
+	TrustOnFirstUse bool
+
+	// Banner is shown to downstreams entering this server after the banner of the downstream, see bannerData
+	Banner string `gorm:"type:text"`
+
+	// ViaServerID is the jump server this server is reached through, which may have a jump server
+	// itself. The plugin dials the chain and hands sshpiperd a local tunnel to Address.
+	ViaServerID int
+	// JumpUsername, JumpPassword and JumpPrivateKey log in to this server when it is a jump
+	// server of another, JumpUsername defaults to the upstream username. JumpPassword and
+	// JumpPrivateKey are optionally encrypted, see keyring. A jump server needs HostKey or IgnoreHostKey.
+	JumpUsername     string `gorm:"type:varchar(45)"`
+	JumpPassword     string `gorm:"type:varchar(255)"`
+	JumpPrivateKeyID int
+	JumpPrivateKey   keydata
 }
 
 type upstream struct {
@@ -39,34 +67,147 @@ type upstream struct {
 	ServerID int
 	Server   server
 
-	Username     string `gorm:"type:varchar(45)"`
-	Password     string `gorm:"type:varchar(60)"`
+	Username     string `gorm:"type:varchar(255)"` // see UsernameMapping
+	Password     string `gorm:"type:varchar(255)"` // optionally encrypted, see keyring
 	PrivateKeyID int
 	PrivateKey   keydata
-	AuthMapType  authMapType
+	// PrivateKeyPassphrase unlocks PrivateKey, optionally encrypted, see keyring
+	PrivateKeyPassphrase string `gorm:"type:varchar(255)"`
+	// Certificate is an OpenSSH user certificate of PrivateKey presented to the upstream
+	CertificateID int
+	Certificate   keydata
+	AuthMapType   authMapType
 	// KnownHosts   keydata
+
+	// UsernameMapping decides how the downstream username maps to the upstream login
+	UsernameMapping usernameMapping
 }
 
 type downstream struct {
 	gorm.Model
 
-	Name              string `gorm:"type:varchar(45)"`
-	Username          string `gorm:"type:varchar(45);unique_index"`
-	Password          string `gorm:"type:varchar(60)"`
-	AuthMapType       authMapType
-	// AllowAnyPublicKey bool
-	// NoPassthrough     bool
+	Name     string `gorm:"type:varchar(45)"`
+	Username string `gorm:"type:varchar(45);uniqueIndex"`
+	// Password is a bcrypt, argon2id or sha512 crypt hash, or plaintext if allowed by --allow-plaintext-password
+	Password    string `gorm:"type:varchar(255)"`
+	AuthMapType authMapType
+
+	// MatchType decides how Username is compared with the login user, glob and regex
+	// rows are evaluated by ascending MatchPriority once no exact row matched.
+	// Both must match the whole login, a regex is anchored as ^(?:Username)$.
+	MatchType     matchType
+	MatchPriority int
+
+	// AllowAnyPublicKey accepts any public key from the downstream, e.g. for honeypot or lab hosts
+	AllowAnyPublicKey bool
+	// NoPassthrough sends the upstream password instead of forwarding the downstream password
+	NoPassthrough bool
 
 	UpstreamID int
 	Upstream   upstream
 
+	// Routes are additional upstream candidates, tried in ascending Priority
+	// order and picked weighted-random among rows with the same Priority.
+	// Upstream above, when set, is treated as a candidate with Priority 0 and Weight 1.
+	Routes []route
+
 	AuthorizedKeysID int
 	AuthorizedKeys   keydata
+
+	TrustedUserCAKeysID int
+	TrustedUserCAKeys   keydata
+	// AllowedPrincipals is a comma separated list of certificate principals accepted
+	// for this downstream, empty means the principal must be the login username
+	AllowedPrincipals string `gorm:"type:varchar(255)"`
+
+	// ValidFrom and ValidUntil limit when the downstream may log in, nil is unlimited
+	ValidFrom  *time.Time
+	ValidUntil *time.Time
+	// AccessWindows are weekly hours the downstream may log in, e.g. "Mon-Fri 08:00-18:00; Sat 10:00-12:00",
+	// in AccessTimezone (IANA name, UTC if empty), empty allows any time
+	AccessWindows  string `gorm:"type:varchar(255)"`
+	AccessTimezone string `gorm:"type:varchar(64)"`
+
+	// AllowedSources and DeniedSources are comma separated CIDRs or IP addresses checked
+	// against the client address before authentication. Deny wins, an empty AllowedSources
+	// falls back to the ALLOWED_SOURCES config entry, empty there too allows any source.
+	AllowedSources string `gorm:"type:varchar(255)"`
+	DeniedSources  string `gorm:"type:varchar(255)"`
+
+	// Banner is a text/template shown before login, see bannerData. The BANNER
+	// config entry is shown instead if neither the downstream nor the server has one.
+	Banner string `gorm:"type:text"`
+}
+
+type route struct {
+	gorm.Model
+
+	DownstreamID int `gorm:"index"`
+	UpstreamID   int
+	Upstream     upstream
+
+	Priority int
+	Weight   int
+}
+
+// group binds a set of upstreams to its members, so access is granted by adding a
+// groupMember rather than a route to every downstream of a team
+type group struct {
+	gorm.Model
+
+	Name string `gorm:"type:varchar(45);uniqueIndex"`
+
+	// Routes are upstream candidates of every member, ordered with the routes of the downstream
+	Routes []groupRoute
+}
+
+type groupRoute struct {
+	gorm.Model
+
+	GroupID    int `gorm:"index"`
+	UpstreamID int
+	Upstream   upstream
+
+	Priority int
+	Weight   int
+}
+
+// groupMember puts a downstream into a group
+type groupMember struct {
+	gorm.Model
+
+	GroupID      int `gorm:"index"`
+	DownstreamID int `gorm:"index"`
 }
 
 type config struct {
 	gorm.Model
 
-	Entry string `gorm:"type:varchar(45);unique_index"`
-	Value string `gorm:"type:varchar(100)"`
+	Entry string `gorm:"type:varchar(45);uniqueIndex"`
+	Value string `gorm:"type:varchar(255)"`
+}
+
+// auditEvent is a row of the audit log written by auditLog, never read by the plugin
+type auditEvent struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	Event      string `gorm:"type:varchar(32)"`
+	ConnID     string `gorm:"type:varchar(64);index"`
+	RemoteAddr string `gorm:"type:varchar(64)"`
+	Username   string `gorm:"type:varchar(45)"`
+	Upstream   string `gorm:"type:varchar(255)"`
+	AuthMethod string `gorm:"type:varchar(32)"`
+	Error      string `gorm:"type:varchar(255)"`
+}
+
+// loginLockout counts failed logins of an ip or username when lockout state is kept in the database
+type loginLockout struct {
+	ID        uint `gorm:"primaryKey"`
+	UpdatedAt time.Time
+
+	Subject        string `gorm:"type:varchar(128);uniqueIndex"`
+	Failures       int
+	FirstFailureAt time.Time
+	LockedUntil    *time.Time
 }
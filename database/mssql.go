@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"net/url"
 
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/mssql" // gorm dialect
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
 )
 
 type mssqlplugin struct {
@@ -31,7 +31,7 @@ func (p *mssqlplugin) create() (*gorm.DB, error) {
 		RawQuery: query.Encode(),
 	}
 
-	db, err := gorm.Open("mssql", u.String())
+	db, err := gorm.Open(sqlserver.Open(u.String()), gormConfig())
 	if err != nil {
 		return nil, err
 	}
@@ -4,8 +4,8 @@ import (
 	"fmt"
 
 	mysqldriver "github.com/go-sql-driver/mysql"
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/mysql" // gorm dialiect
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
 )
 
 type mysqlplugin struct {
@@ -26,7 +26,7 @@ func (p *mysqlplugin) create() (*gorm.DB, error) {
 	config.DBName = p.Dbname
 	config.ParseTime = true
 
-	db, err := gorm.Open("mysql", config.FormatDSN())
+	db, err := gorm.Open(mysql.Open(config.FormatDSN()), gormConfig())
 	if err != nil {
 		return nil, err
 	}
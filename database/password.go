@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errPlaintextPasswordNotAllowed = errors.New("downstream password is stored in plaintext, which is not allowed")
+
+// verifyPassword checks password against a stored downstream password, the hash scheme
+// is detected by prefix: bcrypt ($2a$, $2b$, $2y$), argon2id ($argon2id$) or sha512 crypt ($6$).
+// Anything else is compared as plaintext if allowPlaintext is set.
+func verifyPassword(stored string, password []byte, allowPlaintext bool) (bool, error) {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(stored), password)
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+
+		return err == nil, err
+
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return verifyArgon2id(stored, password)
+
+	case strings.HasPrefix(stored, "$6$"):
+		hashed, err := sha512Crypt(password, stored)
+		if err != nil {
+			return false, err
+		}
+
+		return subtle.ConstantTimeCompare([]byte(hashed), []byte(stored)) == 1, nil
+	}
+
+	if !allowPlaintext {
+		return false, errPlaintextPasswordNotAllowed
+	}
+
+	return subtle.ConstantTimeCompare(password, []byte(stored)) == 1, nil
+}
+
+// Limits of argon2id parameters read from a stored hash, so a malformed row fails
+// instead of panicking or exhausting memory during auth
+const (
+	argon2MaxMemory = 1 << 20 // KiB
+	argon2MaxTime   = 64
+	argon2MinKeyLen = 16
+	argon2MaxKeyLen = 64
+)
+
+// verifyArgon2id checks password against the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func verifyArgon2id(stored string, password []byte) (bool, error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	if time < 1 || time > argon2MaxTime || threads < 1 || memory < 8*uint32(threads) || memory > argon2MaxMemory {
+		return false, fmt.Errorf("unsupported argon2id parameters m=%d,t=%d,p=%d", memory, time, threads)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+
+	if len(hash) < argon2MinKeyLen || len(hash) > argon2MaxKeyLen {
+		return false, fmt.Errorf("unsupported argon2id hash length %d", len(hash))
+	}
+
+	computed := argon2.IDKey(password, salt, time, memory, threads, uint32(len(hash)))
+
+	return subtle.ConstantTimeCompare(computed, hash) == 1, nil
+}
+
+const (
+	sha512CryptRoundsDefault = 5000
+	sha512CryptRoundsMin     = 1000
+	sha512CryptRoundsMax     = 5000000
+	sha512CryptSaltMax       = 16
+)
+
+const cryptItoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512Crypt hashes password with the salt and rounds of setting ($6$[rounds=N$]salt[$...])
+// as specified in https://www.akkadia.org/drepper/SHA-crypt.txt
+func sha512Crypt(password []byte, setting string) (string, error) {
+	rest, ok := strings.CutPrefix(setting, "$6$")
+	if !ok {
+		return "", fmt.Errorf("not a sha512 crypt hash")
+	}
+
+	rounds := sha512CryptRoundsDefault
+	customRounds := false
+
+	if r, ok := strings.CutPrefix(rest, "rounds="); ok {
+		n, after, found := strings.Cut(r, "$")
+		if !found {
+			return "", fmt.Errorf("invalid sha512 crypt rounds")
+		}
+
+		v, err := strconv.Atoi(n)
+		if err != nil {
+			return "", fmt.Errorf("invalid sha512 crypt rounds: %w", err)
+		}
+
+		// the spec allows up to 999999999, far beyond what a login should cost
+		if v > sha512CryptRoundsMax {
+			return "", fmt.Errorf("sha512 crypt rounds %v exceed the maximum of %v", v, sha512CryptRoundsMax)
+		}
+
+		rounds = max(v, sha512CryptRoundsMin)
+		customRounds = true
+		rest = after
+	}
+
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > sha512CryptSaltMax {
+		salt = salt[:sha512CryptSaltMax]
+	}
+
+	s := []byte(salt)
+
+	b := sha512.New()
+	b.Write(password)
+	b.Write(s)
+	b.Write(password)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(password)
+	a.Write(s)
+
+	i := len(password)
+	for ; i > 64; i -= 64 {
+		a.Write(sumB)
+	}
+	a.Write(sumB[:i])
+
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(password)
+		}
+	}
+
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range len(password) {
+		dp.Write(password)
+	}
+	p := repeatBytes(dp.Sum(nil), len(password))
+
+	ds := sha512.New()
+	for range 16 + int(sumA[0]) {
+		ds.Write(s)
+	}
+	sb := repeatBytes(ds.Sum(nil), len(s))
+
+	c := sumA
+	for i := range rounds {
+		h := sha512.New()
+
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+
+		if i%3 != 0 {
+			h.Write(sb)
+		}
+
+		if i%7 != 0 {
+			h.Write(p)
+		}
+
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+
+	out.WriteString("$6$")
+	if customRounds {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.WriteString(salt)
+	out.WriteString("$")
+
+	for _, g := range [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+		{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+	} {
+		writeCrypt64(&out, uint(c[g[0]])<<16|uint(c[g[1]])<<8|uint(c[g[2]]), 4)
+	}
+	writeCrypt64(&out, uint(c[63]), 2)
+
+	return out.String(), nil
+}
+
+func repeatBytes(sum []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for ; n > len(sum); n -= len(sum) {
+		out = append(out, sum...)
+	}
+
+	return append(out, sum[:n]...)
+}
+
+func writeCrypt64(out *strings.Builder, v uint, n int) {
+	for range n {
+		out.WriteByte(cryptItoa64[v&0x3f])
+		v >>= 6
+	}
+}
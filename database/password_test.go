@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSha512Crypt(t *testing.T) {
+	for _, tc := range []struct {
+		password string
+		expected string
+	}{
+		{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{strings.Repeat("x", 200), "$6$abc$9bIqFS3gcEah7ONB5aYjFczb7Fkaut01.W86FsbxH3PnKOS.T6QNYs7qzjm/MziNMzBBXqOaoSNUc4PtFnUj0."},
+	} {
+		got, err := sha512Crypt([]byte(tc.password), tc.expected)
+		if err != nil {
+			t.Fatalf("sha512Crypt failed: %v", err)
+		}
+
+		if got != tc.expected {
+			t.Errorf("expected %v, got %v", tc.expected, got)
+		}
+	}
+
+	// salt longer than 16 chars is truncated
+	got, err := sha512Crypt([]byte("Hello world!"), "$6$rounds=10000$saltstringsaltstring")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(got, "$6$rounds=10000$saltstringsaltst$OW1/") {
+		t.Errorf("unexpected hash %v", got)
+	}
+
+	if _, err := sha512Crypt([]byte("Hello world!"), "$6$rounds=5000001$saltstring"); err == nil {
+		t.Errorf("expected rounds above the maximum to fail")
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+
+	argon2ided := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, 1024, 1, 1,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32)),
+	)
+
+	sha512crypted, err := sha512Crypt([]byte("secret"), "$6$somesalt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stored := range []string{string(bcrypted), argon2ided, sha512crypted} {
+		for password, expected := range map[string]bool{"secret": true, "wrong": false} {
+			ok, err := verifyPassword(stored, []byte(password), false)
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", stored, err)
+			}
+
+			if ok != expected {
+				t.Errorf("%v: password %v expected %v, got %v", stored, password, expected, ok)
+			}
+		}
+	}
+
+	for _, params := range []string{"m=1024,t=0,p=1", "m=1024,t=1,p=0", "m=4194304,t=1,p=1", "m=1024,t=1000000,p=1"} {
+		stored := strings.Replace(argon2ided, "m=1024,t=1,p=1", params, 1)
+		if ok, err := verifyPassword(stored, []byte("secret"), false); err == nil || ok {
+			t.Errorf("%v: bad argon2id parameters should be rejected, got %v, %v", params, ok, err)
+		}
+	}
+
+	if ok, err := verifyPassword("secret", []byte("secret"), true); err != nil || !ok {
+		t.Errorf("plaintext password should be accepted when allowed, got %v, %v", ok, err)
+	}
+
+	if _, err := verifyPassword("secret", []byte("secret"), false); err != errPlaintextPasswordNotAllowed {
+		t.Errorf("plaintext password should be rejected when not allowed, got %v", err)
+	}
+}
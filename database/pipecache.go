@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// pipeCache caches resolved pipes by login user, the whole cache is flushed
+// once the database changed, detected by polling a high-water mark of all
+// tables or by a postgres NOTIFY
+type pipeCache struct {
+	ttl           time.Duration
+	negativeTTL   time.Duration
+	pollInterval  time.Duration
+	notifyChannel string
+
+	entries *cache.Cache // login user -> []pipeConfig or cachedMiss
+
+	mark     string
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// cachedMiss remembers a user without downstream
+type cachedMiss struct {
+	err error
+}
+
+// notifier is implemented by backends able to push change notifications
+type notifier interface {
+	listen(channel string, notify func()) (func(), error)
+}
+
+func newPipeCache(ttl, negativeTTL, pollInterval time.Duration, notifyChannel string) *pipeCache {
+	return &pipeCache{
+		ttl:           ttl,
+		negativeTTL:   negativeTTL,
+		pollInterval:  pollInterval,
+		notifyChannel: notifyChannel,
+		entries:       cache.New(ttl, ttl),
+		stop:          make(chan struct{}),
+	}
+}
+
+// get returns the cached pipes of user, or resolves and caches them
+func (c *pipeCache) get(user string, resolve func(string) ([]pipeConfig, error)) ([]pipeConfig, error) {
+	if v, found := c.entries.Get(user); found {
+		if miss, ok := v.(cachedMiss); ok {
+			return nil, miss.err
+		}
+
+		return v.([]pipeConfig), nil
+	}
+
+	pipes, err := resolve(user)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) && c.negativeTTL > 0 {
+			c.entries.Set(user, cachedMiss{err}, c.negativeTTL)
+		}
+
+		return nil, err
+	}
+
+	c.entries.Set(user, pipes, cache.DefaultExpiration)
+
+	return pipes, nil
+}
+
+func (c *pipeCache) flush() {
+	c.entries.Flush()
+}
+
+// start watches db for changes, a listener is used if backend supports it and a channel is configured
+func (c *pipeCache) start(db *gorm.DB, backend createdb) error {
+	if c.notifyChannel != "" {
+		n, ok := backend.(notifier)
+		if !ok {
+			return fmt.Errorf("cache notify channel is only supported by postgres")
+		}
+
+		unlisten, err := n.listen(c.notifyChannel, func() {
+			log.Debugf("pipe cache flushed by notify on %v", c.notifyChannel)
+			c.flush()
+		})
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			<-c.stop
+			unlisten()
+		}()
+	}
+
+	if c.pollInterval <= 0 {
+		return nil
+	}
+
+	mark, err := highWaterMark(db)
+	if err != nil {
+		return err
+	}
+
+	c.mark = mark
+
+	go func() {
+		ticker := time.NewTicker(c.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.poll(db)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (c *pipeCache) poll(db *gorm.DB) {
+	mark, err := highWaterMark(db)
+	if err != nil {
+		log.Warnf("pipe cache failed to poll database changes: %v", err)
+		return
+	}
+
+	if mark != c.mark {
+		log.Debugf("pipe cache flushed by database change")
+		c.mark = mark
+		c.flush()
+	}
+}
+
+func (c *pipeCache) close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// highWaterMark summarizes row count, latest update and latest soft delete of all
+// tables, any insert, update or delete changes it
+func highWaterMark(db *gorm.DB) (string, error) {
+	var marks []string
+
+	for _, model := range []interface{}{
+		new(keydata),
+		new(server),
+		new(upstream),
+		new(downstream),
+		new(route),
+		new(group),
+		new(groupRoute),
+		new(groupMember),
+		new(config),
+	} {
+		var count int64
+		var updated, deleted sql.NullString
+
+		if err := db.Unscoped().Model(model).
+			Select("count(*), max(updated_at), max(deleted_at)").
+			Row().
+			Scan(&count, &updated, &deleted); err != nil {
+			return "", err
+		}
+
+		marks = append(marks, fmt.Sprintf("%v,%v,%v", count, updated.String, deleted.String))
+	}
+
+	return strings.Join(marks, ";"), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestPipeCacheInvalidatedByDatabaseChange(t *testing.T) {
+	p := newTestPlugin(t)
+	p.cache = newPipeCache(time.Minute, time.Minute, 0, "")
+
+	mark, err := highWaterMark(p.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.cache.mark = mark
+
+	if _, err := p.loadPipeFromDB(&testConn{user: "bob"}); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	d := downstream{
+		Username: "bob",
+		Upstream: upstream{Username: "app", Server: server{Address: "host:22"}},
+	}
+
+	if err := p.db.Create(&d).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.loadPipeFromDB(&testConn{user: "bob"}); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("expected cached not found, got %v", err)
+	}
+
+	p.cache.poll(p.db)
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "bob"})
+	if err != nil || pipes[0].MappedUsername != "app" {
+		t.Fatalf("expected pipe after poll, got %+v, %v", pipes, err)
+	}
+
+	if err := p.db.Model(&d.Upstream).Update("username", "changed").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if pipes, _ := p.loadPipeFromDB(&testConn{user: "bob"}); pipes[0].MappedUsername != "app" {
+		t.Errorf("expected cached pipe, got %v", pipes[0].MappedUsername)
+	}
+
+	p.cache.poll(p.db)
+
+	if pipes, _ := p.loadPipeFromDB(&testConn{user: "bob"}); pipes[0].MappedUsername != "changed" {
+		t.Errorf("expected refreshed pipe, got %v", pipes[0].MappedUsername)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"time"
+
+	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/jinzhu/gorm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 type createdb interface {
@@ -13,6 +17,43 @@ type createdb interface {
 type plugin struct {
 	db      *gorm.DB
 	logmode bool
+	pool    poolConfig
+	health  *dbHealth
+	// manualMigrate requires the schema to be migrated by the migrate command instead of on Init
+	manualMigrate bool
+	failover      *failover
+	cache         *pipeCache
+	audit         *auditLog
+	lockout       *lockout
+
+	// queries replace the built-in models, the schema belongs to the operator and is not migrated
+	queries *queryConfig
+
+	allowPlaintextPassword bool
+	keyring                *keyring
+	// secrets are the enabled schemes of upstream secret references, none if nil
+	secrets secretSchemes
+
+	// targetMenu lets downstreams with several targets pick one by keyboard-interactive after login
+	targetMenu bool
+	// targetSeparator splits a login user+target, disabled if empty
+	targetSeparator string
+
+	// jumpTimeout bounds dialing and logging in to each jump server and waiting for sshpiperd on the tunnel
+	jumpTimeout time.Duration
+	// tunnelPeer is the process allowed to use jump tunnels, the parent sshpiperd if 0
+	tunnelPeer int
+	// jumpErr is why jump tunnels cannot verify tunnelPeer, see checkTunnelPeer
+	jumpErr error
+
+	// now is the clock for access time checks, time.Now if nil
+	now func() time.Time
+
+	pubkeys       *cache.Cache // conn unique id -> presentedKey
+	deniedSources *cache.Cache // conn unique id -> true once the source denial of the connection was logged
+
+	pendingLogins *cache.Cache // conn unique id -> pendingLogin waiting for the target menu
+	targets       *cache.Cache // conn unique id -> target picked from the menu
 }
 
 func (p *plugin) Init(backend createdb) error {
@@ -23,32 +64,87 @@ func (p *plugin) Init(backend createdb) error {
 		return err
 	}
 
-	log.Printf("upstream provider: Database driver [%v] initializing", db.Dialect().GetName())
+	log.Printf("upstream provider: Database driver [%v] initializing", db.Dialector.Name())
 
-	err = db.AutoMigrate(
-		new(keydata),
-		new(server),
-		new(upstream),
-		new(downstream),
-		new(config),
-	).Error
+	switch {
+	case p.queries != nil:
+		// nothing to migrate in a schema of the operator
+	case p.manualMigrate:
+		err = checkSchemaVersion(db)
+	default:
+		err = migrateTo(db, latestSchemaVersion())
+	}
 
 	if err != nil {
-		log.Printf("AutoMigrate error: %v", err)
+		log.Printf("migrate error: %v", err)
+		closeDB(db)
+		return err
+	}
+
+	if err := p.pool.apply(db); err != nil {
+		closeDB(db)
 		return err
 	}
 
-	db.SetLogger(log.StandardLogger())
-	db.LogMode(p.logmode)
+	db.Logger = newLogger(p.logmode)
 
 	p.db = db
+	p.pubkeys = cache.New(10*time.Minute, 10*time.Minute)
+	p.deniedSources = cache.New(10*time.Minute, 10*time.Minute)
+	p.pendingLogins = cache.New(10*time.Minute, 10*time.Minute)
+	p.targets = cache.New(10*time.Minute, 10*time.Minute)
 
 	return nil
 }
 
+func (p *plugin) clock() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+
+	return time.Now()
+}
+
 // Close
 func (p *plugin) Close() {
+	if p.cache != nil {
+		p.cache.close()
+	}
+
+	if p.audit != nil {
+		p.audit.close()
+	}
+
+	if p.health != nil {
+		p.health.close()
+	}
+
 	if p.db != nil {
-		p.db.Close()
+		closeDB(p.db)
+	}
+}
+
+func gormConfig() *gorm.Config {
+	return &gorm.Config{
+		Logger: logger.Discard,
+	}
+}
+
+func newLogger(logmode bool) logger.Interface {
+	level := logger.Silent
+	if logmode {
+		level = logger.Info
+	}
+
+	return logger.New(log.StandardLogger(), logger.Config{
+		SlowThreshold:             time.Second,
+		LogLevel:                  level,
+		IgnoreRecordNotFoundError: true,
+	})
+}
+
+func closeDB(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
 	}
 }
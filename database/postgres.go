@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"time"
 
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/postgres" // gorm dialect
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
 )
 
 type postgresplugin struct {
@@ -19,9 +22,8 @@ type postgresplugin struct {
 	SslRootCert string
 }
 
-func (p *postgresplugin) create() (*gorm.DB, error) {
-
-	conn := fmt.Sprintf("host=%v port=%v user=%v password=%v dbname=%v sslmode=%v sslcert=%v sslkey=%v sslrootcert=%v",
+func (p *postgresplugin) dsn() string {
+	return fmt.Sprintf("host=%v port=%v user=%v password=%v dbname=%v sslmode=%v sslcert=%v sslkey=%v sslrootcert=%v",
 		p.Host,
 		p.Port,
 		p.User,
@@ -32,11 +34,38 @@ func (p *postgresplugin) create() (*gorm.DB, error) {
 		p.SslKey,
 		p.SslRootCert,
 	)
+}
 
-	db, err := gorm.Open("postgres", conn)
+func (p *postgresplugin) create() (*gorm.DB, error) {
+
+	db, err := gorm.Open(postgres.Open(p.dsn()), gormConfig())
 	if err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
+
+// listen calls notify for every NOTIFY on channel, and after reconnecting
+// as notifications may have been missed meanwhile
+func (p *postgresplugin) listen(channel string, notify func()) (func(), error) {
+	listener := pq.NewListener(p.dsn(), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Warnf("postgres listener on %v: %v", channel, err)
+		}
+	})
+
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	go func() {
+		for range listener.Notify {
+			// a nil notification is sent after reconnect
+			notify()
+		}
+	}()
+
+	return func() { listener.Close() }, nil
+}
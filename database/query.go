@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// queryConfig holds operator supplied SQL replacing the built-in models, for databases
+// with an existing user directory. Queries take the login user as named parameter @user.
+type queryConfig struct {
+	// LookupUser returns one row per upstream candidate of the login user, no rows if
+	// the user is unknown. Columns are matched by name, see queryRow, missing ones are empty
+	// except auth, which is required so a missing column cannot open a downstream.
+	LookupUser string `yaml:"lookup_user"`
+
+	// TrustedUserCAKeys optionally returns rows of a single column of CA keys trusted for the login user
+	TrustedUserCAKeys string `yaml:"trusted_user_ca_keys"`
+}
+
+// queryRow is an upstream candidate returned by LookupUser
+type queryRow struct {
+	Target             sql.NullString `gorm:"column:target"`
+	UpstreamHost       sql.NullString `gorm:"column:upstream_host"`
+	UpstreamUser       sql.NullString `gorm:"column:upstream_user"`
+	Auth               sql.NullString `gorm:"column:auth"`
+	Password           sql.NullString `gorm:"column:password"`
+	AuthorizedKeys     sql.NullString `gorm:"column:authorized_keys"`
+	UpstreamAuth       sql.NullString `gorm:"column:upstream_auth"`
+	UpstreamPassword   sql.NullString `gorm:"column:upstream_password"`
+	UpstreamPrivateKey sql.NullString `gorm:"column:upstream_private_key"`
+	KnownHosts         sql.NullString `gorm:"column:known_hosts"`
+	Banner             sql.NullString `gorm:"column:banner"`
+	IgnoreHostKey      sql.NullBool   `gorm:"column:ignore_host_key"`
+	Priority           sql.NullInt64  `gorm:"column:priority"`
+	Weight             sql.NullInt64  `gorm:"column:weight"`
+}
+
+func loadQueryConfig(file string) (*queryConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &queryConfig{}
+	if err := yaml.Unmarshal(data, q); err != nil {
+		return nil, fmt.Errorf("%v: %w", file, err)
+	}
+
+	if strings.TrimSpace(q.LookupUser) == "" {
+		return nil, fmt.Errorf("%v: lookup_user is required", file)
+	}
+
+	return q, nil
+}
+
+// resolvePipesByQuery returns all upstream candidates of user returned by the lookup_user query
+func (p *plugin) resolvePipesByQuery(user string) ([]pipeConfig, error) {
+	params := map[string]interface{}{
+		"user": user,
+	}
+
+	var rows []queryRow
+	if err := p.db.Raw(p.queries.LookupUser, params).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("lookup_user query: %w", err)
+	}
+
+	if len(rows) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var caKeys string
+	if p.queries.TrustedUserCAKeys != "" {
+		var keys []sql.NullString
+		if err := p.db.Raw(p.queries.TrustedUserCAKeys, params).Scan(&keys).Error; err != nil {
+			return nil, fmt.Errorf("trusted_user_ca_keys query: %w", err)
+		}
+
+		for _, k := range keys {
+			caKeys += k.String + "\n"
+		}
+	}
+
+	var pipes []pipeConfig
+
+	for i, row := range rows {
+		if row.UpstreamHost.String == "" {
+			return nil, fmt.Errorf("lookup_user query: row %v of %v has no upstream_host", i, user)
+		}
+
+		if row.Auth.String == "" {
+			return nil, fmt.Errorf("lookup_user query: row %v of %v has no auth", i, user)
+		}
+
+		fromType, err := parseName(authMapTypeNames, row.Auth.String)
+		if err != nil {
+			return nil, fmt.Errorf("lookup_user query: row %v of %v: auth: %w", i, user, err)
+		}
+
+		// an empty password would accept any password
+		if fromType != authMapTypePrivateKey && row.Password.String == "" {
+			return nil, fmt.Errorf("lookup_user query: row %v of %v: auth %v requires a password", i, user, row.Auth.String)
+		}
+
+		toType, err := parseName(authMapTypeNames, withDefault(row.UpstreamAuth.String, authMapTypeNames[authMapTypePassword]))
+		if err != nil || (toType != authMapTypePassword && toType != authMapTypePrivateKey) {
+			return nil, fmt.Errorf("lookup_user query: row %v of %v: upstream_auth must be password or privatekey", i, user)
+		}
+
+		pipes = append(pipes, pipeConfig{
+			Username:              user,
+			Target:                row.Target.String,
+			UpstreamHost:          row.UpstreamHost.String,
+			MappedUsername:        withDefault(row.UpstreamUser.String, user),
+			FromType:              fromType,
+			FromPassword:          row.Password.String,
+			FromAuthorizedKeys:    keydata{Data: row.AuthorizedKeys.String},
+			FromTrustedUserCAKeys: keydata{Data: strings.TrimSpace(caKeys)},
+			ToType:                toType,
+			ToPassword:            row.UpstreamPassword.String,
+			ToPrivateKey:          keydata{Data: row.UpstreamPrivateKey.String},
+			KnownHosts:            keydata{Data: row.KnownHosts.String},
+			Banner:                row.Banner.String,
+			IgnoreHostkey:         row.IgnoreHostKey.Bool,
+			Priority:              int(row.Priority.Int64),
+			Weight:                int(row.Weight.Int64),
+		})
+	}
+
+	return pipes, nil
+}
+
+func withDefault[T comparable](v, fallback T) T {
+	var zero T
+	if v == zero {
+		return fallback
+	}
+
+	return v
+}
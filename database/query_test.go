@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestResolvePipesByQuery(t *testing.T) {
+	file := path.Join(t.TempDir(), "queries.yaml")
+	if err := os.WriteFile(file, []byte(`
+lookup_user: |
+  SELECT host AS upstream_host, login AS upstream_user, auth, pw AS password
+  FROM accounts WHERE name = @user
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := loadQueryConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &plugin{queries: queries}
+	if err := p.Init(&sqliteplugin{
+		File: path.Join(t.TempDir(), "test.db"),
+	}); err != nil {
+		t.Fatalf("failed to init plugin: %v", err)
+	}
+
+	t.Cleanup(p.Close)
+
+	if p.db.Migrator().HasTable(&downstream{}) {
+		t.Errorf("expected built-in tables not to be migrated in query mode")
+	}
+
+	if err := p.db.Exec("CREATE TABLE accounts (name TEXT, host TEXT, login TEXT, auth TEXT, pw TEXT)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.db.Exec("INSERT INTO accounts VALUES ('bob', 'host:22', 'robert', 'password', 'secret'), ('eve', 'host:22', 'eve', 'password', NULL), ('mallory', 'host:22', 'mallory', NULL, 'secret')").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 1 || pipes[0].UpstreamHost != "host:22" || pipes[0].MappedUsername != "robert" || pipes[0].FromPassword != "secret" {
+		t.Errorf("unexpected pipes %+v", pipes)
+	}
+
+	if pipes[0].FromType != authMapTypePassword || pipes[0].ToType != authMapTypePassword {
+		t.Errorf("expected password auth, got %v %v", pipes[0].FromType, pipes[0].ToType)
+	}
+
+	if _, err := p.loadPipeFromDB(&testConn{user: "eve"}); err == nil {
+		t.Errorf("expected password auth without password to fail")
+	}
+
+	if _, err := p.loadPipeFromDB(&testConn{user: "mallory"}); err == nil {
+		t.Errorf("expected row without auth to fail")
+	}
+
+	if _, err := p.loadPipeFromDB(&testConn{user: "alice"}); err == nil {
+		t.Errorf("expected unknown user to fail")
+	}
+}
+
+func TestLoadQueryConfigRequiresLookupUser(t *testing.T) {
+	file := path.Join(t.TempDir(), "queries.yaml")
+	if err := os.WriteFile(file, []byte("trusted_user_ca_keys: SELECT 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadQueryConfig(file); err == nil {
+		t.Errorf("expected missing lookup_user to fail")
+	}
+}
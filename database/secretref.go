@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// secretResolver returns the secret a reference points to, ref is the part after scheme://
+type secretResolver interface {
+	resolve(ref string) (string, error)
+}
+
+// secretSchemeNames are the known reference schemes, e.g. file:///etc/sshpiper/keys/prod
+var secretSchemeNames = map[string]bool{
+	"file": true,
+	"env":  true,
+	"exec": true,
+}
+
+// parseSecretRef splits a reference into scheme and ref, ok is false for a value
+// without a known scheme, which is the secret itself
+func parseSecretRef(value string) (scheme, ref string, ok bool) {
+	scheme, ref, found := strings.Cut(value, "://")
+	if !found || !secretSchemeNames[scheme] {
+		return "", "", false
+	}
+
+	return scheme, ref, true
+}
+
+func isSecretRef(value string) bool {
+	_, _, ok := parseSecretRef(value)
+	return ok
+}
+
+// secretSchemes holds the resolvers of the enabled schemes. References are only
+// resolved in keydata, file and exec are limited to paths below pathPrefix and env
+// to the allowed variables, exec runs commands named by database rows.
+type secretSchemes map[string]secretResolver
+
+func parseSecretSchemes(s, pathPrefix string, envAllowlist []string) (secretSchemes, error) {
+	schemes := secretSchemes{}
+
+	for _, scheme := range splitList(s) {
+		if !secretSchemeNames[scheme] {
+			return nil, fmt.Errorf("unknown secret scheme %v", scheme)
+		}
+
+		switch scheme {
+		case "file", "exec":
+			if !filepath.IsAbs(pathPrefix) {
+				return nil, fmt.Errorf("secret scheme %v requires an absolute secret path prefix", scheme)
+			}
+
+			if scheme == "file" {
+				schemes[scheme] = fileSecretResolver{prefix: filepath.Clean(pathPrefix)}
+			} else {
+				schemes[scheme] = execSecretResolver{prefix: filepath.Clean(pathPrefix), timeout: 10 * time.Second}
+			}
+		case "env":
+			if len(envAllowlist) == 0 {
+				return nil, fmt.Errorf("secret scheme env requires a secret env allowlist")
+			}
+
+			allowed := map[string]bool{}
+			for _, name := range envAllowlist {
+				allowed[name] = true
+			}
+
+			schemes[scheme] = envSecretResolver{allowed: allowed}
+		}
+	}
+
+	return schemes, nil
+}
+
+// resolve returns value, or the secret it refers to
+func (s secretSchemes) resolve(value string) (string, error) {
+	scheme, ref, ok := parseSecretRef(value)
+	if !ok {
+		return value, nil
+	}
+
+	resolver, enabled := s[scheme]
+	if !enabled {
+		return "", fmt.Errorf("secret scheme %v is not enabled", scheme)
+	}
+
+	secret, err := resolver.resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("%v secret: %w", scheme, err)
+	}
+
+	return secret, nil
+}
+
+// withinPrefix rejects a path outside of prefix, symlinks below prefix are followed
+func withinPrefix(path, prefix string) error {
+	clean := filepath.Clean(path)
+
+	if !filepath.IsAbs(clean) || (clean != prefix && !strings.HasPrefix(clean, strings.TrimSuffix(prefix, string(filepath.Separator))+string(filepath.Separator))) {
+		return fmt.Errorf("%v is not below the secret path prefix %v", path, prefix)
+	}
+
+	return nil
+}
+
+// fileSecretResolver reads file:///path
+type fileSecretResolver struct {
+	prefix string
+}
+
+func (r fileSecretResolver) resolve(ref string) (string, error) {
+	if err := withinPrefix(ref, r.prefix); err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// envSecretResolver reads env://NAME
+type envSecretResolver struct {
+	allowed map[string]bool
+}
+
+func (r envSecretResolver) resolve(ref string) (string, error) {
+	if !r.allowed[ref] {
+		return "", fmt.Errorf("environment variable %v is not in the secret env allowlist", ref)
+	}
+
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %v is not set", ref)
+	}
+
+	return value, nil
+}
+
+// execSecretResolver runs exec:///path/to/command arg... and reads its stdout
+type execSecretResolver struct {
+	prefix  string
+	timeout time.Duration
+}
+
+func (r execSecretResolver) resolve(ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", fmt.Errorf("no command")
+	}
+
+	if err := withinPrefix(args[0], r.prefix); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %w: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestResolveSecretRefs(t *testing.T) {
+	dir := t.TempDir()
+
+	file := path.Join(dir, "secret")
+	if err := os.WriteFile(file, []byte("from file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SSHPIPERD_TEST_SECRET", "from env")
+	t.Setenv("SSHPIPERD_TEST_OTHER", "not allowed")
+
+	if _, err := parseSecretSchemes("file", "", nil); err == nil {
+		t.Errorf("expected file scheme without path prefix to fail")
+	}
+
+	if _, err := parseSecretSchemes("env", "", nil); err == nil {
+		t.Errorf("expected env scheme without allowlist to fail")
+	}
+
+	schemes, err := parseSecretSchemes("file,env", dir, []string{"SSHPIPERD_TEST_SECRET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for value, expected := range map[string]string{
+		"plain":                       "plain",
+		"https://example.com":         "https://example.com",
+		"file://" + file:              "from file",
+		"env://SSHPIPERD_TEST_SECRET": "from env",
+	} {
+		secret, err := schemes.resolve(value)
+		if err != nil || secret != expected {
+			t.Errorf("%v: expected %q, got %q, %v", value, expected, secret, err)
+		}
+	}
+
+	for _, value := range []string{
+		"env://SSHPIPERD_TEST_OTHER",
+		"file://" + path.Join(dir, "nonexistent"),
+		"file:///etc/passwd",
+		"file://" + dir + "/../" + path.Base(dir) + "x/secret",
+		"exec:///bin/echo x",
+	} {
+		if _, err := schemes.resolve(value); err == nil {
+			t.Errorf("%v: expected error", value)
+		}
+	}
+
+	exec, err := parseSecretSchemes("exec", "/bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if secret, err := exec.resolve("exec:///bin/echo from exec"); err != nil || secret != "from exec" {
+		t.Errorf("expected output of exec, got %q, %v", secret, err)
+	}
+
+	for _, value := range []string{"exec:///bin/false", "exec:///usr/bin/env"} {
+		if _, err := exec.resolve(value); err == nil {
+			t.Errorf("%v: expected error", value)
+		}
+	}
+
+	if _, err := parseSecretSchemes("file,vault", dir, nil); err == nil {
+		t.Errorf("expected unknown scheme to fail")
+	}
+}
+
+func TestUpstreamPrivateKeyFromSecretRef(t *testing.T) {
+	p := newTestPlugin(t)
+
+	secrets, err := parseSecretSchemes("env", "", []string{"SSHPIPERD_TEST_UPSTREAM_KEY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.secrets = secrets
+
+	if err := p.db.Create(&downstream{
+		Username: "bob",
+		Upstream: upstream{
+			Password:   "env://SSHPIPERD_TEST_UPSTREAM_KEY",
+			PrivateKey: keydata{Data: "env://SSHPIPERD_TEST_UPSTREAM_KEY"},
+			Server:     server{Address: "host:22"},
+		},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	p.cache = newPipeCache(time.Minute, 0, 0, "")
+
+	for _, key := range []string{"s3cret", "rotated"} {
+		t.Setenv("SSHPIPERD_TEST_UPSTREAM_KEY", key)
+
+		pipes, err := p.loadPipeFromDB(&testConn{user: "bob"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pipes[0].ToPrivateKey.Data != "env://SSHPIPERD_TEST_UPSTREAM_KEY" {
+			t.Errorf("expected the cached pipe to keep the reference, got %v", pipes[0].ToPrivateKey.Data)
+		}
+
+		// resolved per connection, a cached pipe sees the rotated secret
+		if err := p.decryptPipe(&pipes[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		if pipes[0].ToPrivateKey.Data != key {
+			t.Errorf("expected resolved private key %v, got %v", key, pipes[0].ToPrivateKey.Data)
+		}
+
+		// a password is the secret itself, whatever it starts with
+		if pipes[0].ToPassword != "env://SSHPIPERD_TEST_UPSTREAM_KEY" {
+			t.Errorf("expected password not to be resolved, got %v", pipes[0].ToPassword)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/subtle"
 	"fmt"
 	"strings"
 
@@ -13,7 +12,11 @@ import (
 )
 
 type skelpipeWrapper struct {
-	pipe *pipeConfig
+	plugin *plugin
+	pipe   *pipeConfig
+
+	// fallback is true if another candidate follows pipe
+	fallback bool
 }
 
 type skelpipeFromWrapper struct {
@@ -57,6 +60,15 @@ func (s *skelpipeWrapper) From() []skel.SkelPipeFrom {
 		return []skel.SkelPipeFrom{&skelpipeFromPublicKeyWrapper{
 			skelpipeFromWrapper: w,
 		}}
+	case authMapTypePasswordOrPrivateKey:
+		return []skel.SkelPipeFrom{
+			&skelpipeFromPublicKeyWrapper{
+				skelpipeFromWrapper: w,
+			},
+			&skelpipeFromPasswordWrapper{
+				skelpipeFromWrapper: w,
+			},
+		}
 
 	default:
 		return nil
@@ -76,41 +88,50 @@ func (s *skelpipeToWrapper) IgnoreHostKey(conn libplugin.ConnMetadata) bool {
 }
 
 func (s *skelpipeToWrapper) KnownHosts(conn libplugin.ConnMetadata) ([]byte, error) {
-	data := strings.TrimSpace(s.pipe.KnownHosts.Data)
+	return knownHostsData(s.pipe.KnownHosts.Data, s.pipe.UpstreamHost), nil
+}
+
+// knownHostsData returns a host key stored as known_hosts, authorized key or private key
+// as known_hosts lines for host
+func knownHostsData(data, host string) []byte {
+	data = strings.TrimSpace(data)
 
 	if data == "" {
-		return nil, nil
+		return nil
 	}
 
 	// If the data parses as a single authorized key, convert it into a known_hosts line.
 	if pub, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(data)); err == nil && len(bytes.TrimSpace(rest)) == 0 {
-		return []byte(knownhosts.Line([]string{s.pipe.UpstreamHost}, pub)), nil
+		return []byte(knownhosts.Line([]string{host}, pub))
 	}
 
 	if signer, err := ssh.ParsePrivateKey([]byte(data)); err == nil {
-		return []byte(knownhosts.Line([]string{s.pipe.UpstreamHost}, signer.PublicKey())), nil
+		return []byte(knownhosts.Line([]string{host}, signer.PublicKey()))
 	}
 
-	return []byte(data), nil
+	return []byte(data)
 }
 
 func (s *skelpipeFromWrapper) MatchConn(conn libplugin.ConnMetadata) (skel.SkelPipeTo, error) {
 
-	switch s.pipe.ToType {
+	// the downstream passed, open the upstream secrets of this connection only
+	pipe := *s.pipe
+	if err := s.plugin.decryptPipe(&pipe); err != nil {
+		return nil, err
+	}
+
+	s.plugin.failover.selectPipe(conn, &pipe, s.fallback)
+
+	to := skelpipeToWrapper{
+		username:        pipe.MappedUsername,
+		skelpipeWrapper: skelpipeWrapper{plugin: s.plugin, pipe: &pipe},
+	}
+
+	switch pipe.ToType {
 	case authMapTypePassword:
-		return &skelpipeToPasswordWrapper{
-			skelpipeToWrapper: skelpipeToWrapper{
-				username:        s.pipe.MappedUsername,
-				skelpipeWrapper: s.skelpipeWrapper,
-			},
-		}, nil
+		return &skelpipeToPasswordWrapper{skelpipeToWrapper: to}, nil
 	case authMapTypePrivateKey:
-		return &skelpipeToPrivateKeyWrapper{
-			skelpipeToWrapper: skelpipeToWrapper{
-				username:        s.pipe.MappedUsername,
-				skelpipeWrapper: s.skelpipeWrapper,
-			},
-		}, nil
+		return &skelpipeToPrivateKeyWrapper{skelpipeToWrapper: to}, nil
 	}
 
 	return nil, fmt.Errorf("unsupported authMapType %d", s.pipe.ToType)
@@ -119,27 +140,46 @@ func (s *skelpipeFromWrapper) MatchConn(conn libplugin.ConnMetadata) (skel.SkelP
 func (s *skelpipeFromPasswordWrapper) TestPassword(conn libplugin.ConnMetadata, password []byte) (bool, error) {
 
 	if s.pipe.FromPassword == "" {
-		// ignore password
-		return true, nil
+		// ignore password, unless the downstream may log in with a public key instead
+		return s.pipe.FromType == authMapTypePassword, nil
 	}
 
-	return subtle.ConstantTimeCompare(password, []byte(s.pipe.FromPassword)) == 1, nil
+	return verifyPassword(s.pipe.FromPassword, password, s.plugin.allowPlaintextPassword)
 }
 
 func (s *skelpipeFromPublicKeyWrapper) AuthorizedKeys(conn libplugin.ConnMetadata) ([]byte, error) {
-	return []byte(s.pipe.FromAuthorizedKeys.Data), nil
+	keys := []byte(s.pipe.FromAuthorizedKeys.Data)
+
+	if item, found := s.plugin.pubkeys.Get(conn.UniqueID()); found {
+		presented := item.(presentedKey)
+
+		if presented.certified || s.pipe.FromAllowAnyPublicKey {
+			keys = append(append(keys, '\n'), ssh.MarshalAuthorizedKey(presented.key)...)
+		}
+	}
+
+	return keys, nil
 }
 
 func (s *skelpipeFromPublicKeyWrapper) TrustedUserCAKeys(conn libplugin.ConnMetadata) ([]byte, error) {
-	return nil, nil // TODO support this
+	return []byte(s.pipe.FromTrustedUserCAKeys.Data), nil
 }
 
 func (s *skelpipeToPrivateKeyWrapper) PrivateKey(conn libplugin.ConnMetadata) ([]byte, []byte, error) {
-	return []byte(s.pipe.ToPrivateKey.Data), nil, nil
+	var cert []byte
+	if data := strings.TrimSpace(s.pipe.ToCertificate.Data); data != "" {
+		cert = []byte(data)
+	}
+
+	return []byte(s.pipe.ToPrivateKey.Data), cert, nil
 }
 
 func (s *skelpipeToPasswordWrapper) OverridePassword(conn libplugin.ConnMetadata) ([]byte, error) {
 	if s.pipe.ToPassword == "" {
+		if s.pipe.NoPassthrough {
+			return nil, fmt.Errorf("passthrough disabled but no upstream password configured for %v", s.pipe.upstreamKey())
+		}
+
 		return nil, nil
 	}
 	return []byte(s.pipe.ToPassword), nil
@@ -147,12 +187,21 @@ func (s *skelpipeToPasswordWrapper) OverridePassword(conn libplugin.ConnMetadata
 
 func (p *plugin) listPipe(conn libplugin.ConnMetadata) ([]skel.SkelPipe, error) {
 
-	pipe, err := p.loadPipeFromDB(conn)
+	pipes, err := p.loadPipeFromDB(conn)
 	if err != nil {
 		return nil, err
 	}
 
-	return []skel.SkelPipe{&skelpipeWrapper{
-		pipe: &pipe,
-	}}, nil
+	pipes = p.failover.filter(conn, pipes)
+
+	var list []skel.SkelPipe
+	for i := range pipes {
+		list = append(list, &skelpipeWrapper{
+			plugin:   p,
+			pipe:     &pipes[i],
+			fallback: i < len(pipes)-1,
+		})
+	}
+
+	return list, nil
 }
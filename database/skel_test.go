@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"os"
+	"path"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/patrickmn/go-cache"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -53,3 +59,192 @@ func TestKnownHostsBuildsFromPrivateKey(t *testing.T) {
 		t.Fatalf("known hosts line missing public key fragment %q, got %q", expectedFragment, got)
 	}
 }
+
+func TestAuthorizedKeysAllowAnyPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to derive public key: %v", err)
+	}
+
+	p := &plugin{
+		pubkeys: cache.New(time.Minute, time.Minute),
+	}
+
+	conn := &testConn{user: "honeypot", uniqueID: "conn1"}
+
+	if _, err := p.acceptPublicKey(conn, pub.Marshal()); err != nil {
+		t.Fatalf("failed to accept public key: %v", err)
+	}
+
+	for _, allowAny := range []bool{false, true} {
+		wrapper := skelpipeFromPublicKeyWrapper{
+			skelpipeFromWrapper: skelpipeFromWrapper{
+				skelpipeWrapper: skelpipeWrapper{
+					plugin: p,
+					pipe: &pipeConfig{
+						FromAllowAnyPublicKey: allowAny,
+					},
+				},
+			},
+		}
+
+		keys, err := wrapper.AuthorizedKeys(conn)
+		if err != nil {
+			t.Fatalf("failed to get authorized keys: %v", err)
+		}
+
+		if got := strings.Contains(string(keys), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))); got != allowAny {
+			t.Errorf("allowAny %v: presented key in authorized keys = %v", allowAny, got)
+		}
+	}
+}
+
+func TestOverridePasswordNoPassthrough(t *testing.T) {
+	wrapper := skelpipeToPasswordWrapper{
+		skelpipeToWrapper: skelpipeToWrapper{
+			skelpipeWrapper: skelpipeWrapper{
+				pipe: &pipeConfig{},
+			},
+		},
+	}
+
+	if password, err := wrapper.OverridePassword(nil); err != nil || password != nil {
+		t.Errorf("downstream password should pass through, got %q, %v", password, err)
+	}
+
+	wrapper.pipe.NoPassthrough = true
+
+	if _, err := wrapper.OverridePassword(nil); err == nil {
+		t.Errorf("expected error without upstream password when passthrough disabled")
+	}
+
+	wrapper.pipe.ToPassword = "secret"
+
+	if password, err := wrapper.OverridePassword(nil); err != nil || string(password) != "secret" {
+		t.Errorf("expected upstream password, got %q, %v", password, err)
+	}
+}
+
+func TestEmptyPasswordOnlyForPasswordAuth(t *testing.T) {
+	for fromType, accepted := range map[authMapType]bool{
+		authMapTypePassword:             true,
+		authMapTypePasswordOrPrivateKey: false,
+	} {
+		wrapper := skelpipeFromPasswordWrapper{
+			skelpipeFromWrapper: skelpipeFromWrapper{
+				skelpipeWrapper: skelpipeWrapper{
+					pipe: &pipeConfig{FromType: fromType},
+				},
+			},
+		}
+
+		if ok, err := wrapper.TestPassword(nil, []byte("anything")); err != nil || ok != accepted {
+			t.Errorf("auth %v: empty password accepted %v, %v", authMapTypeNames[fromType], ok, err)
+		}
+	}
+}
+
+func TestPrivateKeyUnlockedWithCertificate(t *testing.T) {
+	dir := t.TempDir()
+	dbfile := path.Join(dir, "test.db")
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// newTestUserCert certifies a key of its own
+	other, _ := newTestUserCert(t, "app")
+	otherCert := string(ssh.MarshalAuthorizedKey(other))
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"app"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"id_ed25519":          string(pem.EncodeToMemory(block)),
+		"id_ed25519-cert.pub": string(ssh.MarshalAuthorizedKey(cert)),
+		"other-cert.pub":      otherCert,
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(path.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := []string{"pipe", "add", "--username", "bob", "--address", "host", "--ignore-host-key",
+		"--upstream-auth", "privatekey", "--upstream-private-key-file", path.Join(dir, "id_ed25519")}
+
+	if _, err := runTestCommand(t, dbfile, args...); err == nil {
+		t.Errorf("expected protected key without passphrase to fail")
+	}
+
+	args = append(args, "--upstream-private-key-passphrase", "hunter2")
+
+	if _, err := runTestCommand(t, dbfile, append(args, "--upstream-certificate-file", path.Join(dir, "other-cert.pub"))...); err == nil {
+		t.Errorf("expected certificate of another key to fail")
+	}
+
+	if _, err := runTestCommand(t, dbfile, append(args, "--upstream-certificate-file", path.Join(dir, "id_ed25519-cert.pub"))...); err != nil {
+		t.Fatalf("pipe add failed: %v", err)
+	}
+
+	p := &plugin{}
+	if err := p.Init(&sqliteplugin{File: dbfile}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(p.Close)
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.decryptPipe(&pipes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapper := skelpipeToPrivateKeyWrapper{skelpipeToWrapper: skelpipeToWrapper{skelpipeWrapper: skelpipeWrapper{pipe: &pipes[0]}}}
+
+	key, certBytes, err := wrapper.PrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlocked, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		t.Fatalf("expected an unencrypted key: %v", err)
+	}
+
+	if !bytes.Equal(unlocked.PublicKey().Marshal(), signer.PublicKey().Marshal()) {
+		t.Errorf("unlocked key differs from the original")
+	}
+
+	if strings.TrimSpace(string(certBytes)) != strings.TrimSpace(files["id_ed25519-cert.pub"]) {
+		t.Errorf("expected certificate, got %q", certBytes)
+	}
+}
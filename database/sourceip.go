@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/sshpiper/libplugin"
+	"gorm.io/gorm"
+)
+
+// allowedSourcesEntry and deniedSourcesEntry are config entries holding source lists
+// applied to all downstreams, see downstream.AllowedSources
+const (
+	allowedSourcesEntry = "ALLOWED_SOURCES"
+	deniedSourcesEntry  = "DENIED_SOURCES"
+)
+
+// parseSourceList parses a comma separated list of CIDRs or single IP addresses
+func parseSourceList(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, item := range splitList(s) {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source %v: %w", item, err)
+			}
+
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %v: %w", item, err)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// sourceAddr returns the client IP of a remote address in host:port form
+func sourceAddr(remoteAddr string) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid client address %v: %w", remoteAddr, err)
+	}
+
+	return addr.Unmap(), nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupSourceListByConfig parses the source list of a config entry, nil if the entry is not set
+func lookupSourceListByConfig(db *gorm.DB, entry string) ([]netip.Prefix, error) {
+	value, err := lookupConfigValue(db, entry)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes, err := parseSourceList(value)
+	if err != nil {
+		return nil, fmt.Errorf("config %v: %w", entry, err)
+	}
+
+	return prefixes, nil
+}
+
+// sourceDeniedError rejects a client IP by the source lists of a downstream,
+// reason is logged but not returned to the client
+type sourceDeniedError struct {
+	username string
+	addr     netip.Addr
+	reason   string
+}
+
+func (e *sourceDeniedError) Error() string {
+	return fmt.Sprintf("access for %v from %v is denied", e.username, e.addr)
+}
+
+// checkSource returns a sourceDeniedError if the client IP matches a deny list, or misses the allow list.
+// Deny lists of the downstream and the config table both apply, the allow list of
+// the downstream replaces the global one when set.
+func checkSource(pipe *pipeConfig, conn libplugin.ConnMetadata) error {
+	if len(pipe.DeniedSources) == 0 && len(pipe.AllowedSources) == 0 {
+		return nil
+	}
+
+	addr, err := sourceAddr(conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+
+	if containsAddr(pipe.DeniedSources, addr) {
+		return &sourceDeniedError{pipe.Username, addr, "source is in the deny list"}
+	}
+
+	if len(pipe.AllowedSources) > 0 && !containsAddr(pipe.AllowedSources, addr) {
+		return &sourceDeniedError{pipe.Username, addr, "source is not in the allow list"}
+	}
+
+	return nil
+}
+
+// sourceDenied logs the denial of conn once, the pipe is loaded for every auth attempt of a connection
+func (p *plugin) sourceDenied(conn libplugin.ConnMetadata, err *sourceDeniedError) {
+	if p.deniedSources.Add(conn.UniqueID(), true, cache.DefaultExpiration) != nil {
+		return
+	}
+
+	log.Warnf("downstream %v denied from %v: %v", err.username, err.addr, err.reason)
+}
+
+// lookupSources returns the source lists applying to d, merged with the config table
+func lookupSources(db *gorm.DB, d *downstream) (allowed, denied []netip.Prefix, err error) {
+	if allowed, err = parseSourceList(d.AllowedSources); err != nil {
+		return nil, nil, fmt.Errorf("downstream %v: %w", d.Username, err)
+	}
+
+	if len(allowed) == 0 {
+		if allowed, err = lookupSourceListByConfig(db, allowedSourcesEntry); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if denied, err = parseSourceList(d.DeniedSources); err != nil {
+		return nil, nil, fmt.Errorf("downstream %v: %w", d.Username, err)
+	}
+
+	globalDenied, err := lookupSourceListByConfig(db, deniedSourcesEntry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return allowed, append(denied, globalDenied...), nil
+}
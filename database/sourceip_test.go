@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestSourceListEnforced(t *testing.T) {
+	p := newTestPlugin(t)
+
+	for _, d := range []downstream{
+		{Username: "ci", AllowedSources: "10.1.0.0/16, 192.168.1.5", Upstream: upstream{Server: server{Address: "host:22"}}},
+		{Username: "alice", Upstream: upstream{Server: server{Address: "host:22"}}},
+	} {
+		if err := p.db.Create(&d).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.db.Create(&config{Entry: deniedSourcesEntry, Value: "10.1.99.0/24,2001:db8::/32"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user       string
+		remoteAddr string
+		allowed    bool
+	}{
+		{"ci", "10.1.2.3:50000", true},
+		{"ci", "192.168.1.5:50000", true},
+		{"ci", "[::ffff:10.1.2.3]:50000", true},
+		{"ci", "10.2.0.1:50000", false},
+		{"ci", "10.1.99.1:50000", false},
+		{"alice", "203.0.113.7:50000", true},
+		{"alice", "[2001:db8::1]:50000", false},
+	} {
+		_, err := p.loadPipeFromDB(&testConn{user: tc.user, remoteAddr: tc.remoteAddr})
+
+		if (err == nil) != tc.allowed {
+			t.Errorf("%v from %v: expected allowed %v, got %v", tc.user, tc.remoteAddr, tc.allowed, err)
+		}
+	}
+
+	if _, err := parseSourceList("10.0.0.0/8,not-an-ip"); err == nil {
+		t.Errorf("expected invalid source to fail")
+	}
+}
+
+func TestSourceDenialLoggedOnce(t *testing.T) {
+	p := newTestPlugin(t)
+
+	if err := p.db.Create(&downstream{Username: "ci", DeniedSources: "10.1.0.0/16", Upstream: upstream{Server: server{Address: "host:22"}}}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	// the pipe is loaded for every auth attempt of the connection
+	for _, id := range []string{"1", "1", "1", "2"} {
+		if _, err := p.loadPipeFromDB(&testConn{user: "ci", uniqueID: id, remoteAddr: "10.1.2.3:50000"}); err == nil {
+			t.Fatalf("expected ci to be denied")
+		}
+	}
+
+	if n := len(hook.AllEntries()); n != 2 {
+		t.Errorf("expected one denial logged per connection, got %v", n)
+	}
+}
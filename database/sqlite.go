@@ -1,8 +1,8 @@
 package main
 
 import (
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite" // gorm dialect
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 type sqliteplugin struct {
@@ -11,7 +11,7 @@ type sqliteplugin struct {
 
 func (p *sqliteplugin) create() (*gorm.DB, error) {
 
-	db, err := gorm.Open("sqlite3", p.File)
+	db, err := gorm.Open(sqlite.Open(p.File), gormConfig())
 	if err != nil {
 		return nil, err
 	}
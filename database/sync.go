@@ -0,0 +1,1489 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tg123/sshpiper/libplugin"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// routingTable is the declarative form of the database, downstreams are keyed by
+// username, servers, keys and groups by name. Upstreams belong to their downstream
+// or group and keydata other than named keys belongs to the row using it.
+type routingTable struct {
+	Servers     []serverSpec      `yaml:"servers,omitempty" json:"servers,omitempty"`
+	Keys        []keySpec         `yaml:"keys,omitempty" json:"keys,omitempty"`
+	Groups      []groupSpec       `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Downstreams []downstreamSpec  `yaml:"downstreams,omitempty" json:"downstreams,omitempty"`
+	Config      map[string]string `yaml:"config,omitempty" json:"config,omitempty"`
+}
+
+type serverSpec struct {
+	Name            string `yaml:"name" json:"name"`
+	Address         string `yaml:"address" json:"address"`
+	HostKey         string `yaml:"host_key,omitempty" json:"host_key,omitempty"`
+	IgnoreHostKey   bool   `yaml:"ignore_host_key,omitempty" json:"ignore_host_key,omitempty"`
+	TrustOnFirstUse bool   `yaml:"trust_on_first_use,omitempty" json:"trust_on_first_use,omitempty"`
+	Banner          string `yaml:"banner,omitempty" json:"banner,omitempty"`
+	// Via names the jump server this server is reached through, the jump fields log in
+	// to this server when it is the jump server of another
+	Via            string `yaml:"via,omitempty" json:"via,omitempty"`
+	JumpUsername   string `yaml:"jump_username,omitempty" json:"jump_username,omitempty"`
+	JumpPassword   string `yaml:"jump_password,omitempty" json:"jump_password,omitempty"`
+	JumpPrivateKey string `yaml:"jump_private_key,omitempty" json:"jump_private_key,omitempty"`
+}
+
+type keySpec struct {
+	Name string `yaml:"name" json:"name"`
+	Type string `yaml:"type,omitempty" json:"type,omitempty"`
+	Data string `yaml:"data" json:"data"`
+}
+
+type groupSpec struct {
+	Name      string         `yaml:"name" json:"name"`
+	Upstreams []upstreamSpec `yaml:"upstreams" json:"upstreams"`
+}
+
+type downstreamSpec struct {
+	Username          string         `yaml:"username" json:"username"`
+	Name              string         `yaml:"name,omitempty" json:"name,omitempty"`
+	Match             string         `yaml:"match,omitempty" json:"match,omitempty"`
+	MatchPriority     int            `yaml:"match_priority,omitempty" json:"match_priority,omitempty"`
+	Auth              string         `yaml:"auth,omitempty" json:"auth,omitempty"`
+	Password          string         `yaml:"password,omitempty" json:"password,omitempty"`
+	AuthorizedKeys    string         `yaml:"authorized_keys,omitempty" json:"authorized_keys,omitempty"`
+	AllowAnyPublicKey bool           `yaml:"allow_any_public_key,omitempty" json:"allow_any_public_key,omitempty"`
+	NoPassthrough     bool           `yaml:"no_passthrough,omitempty" json:"no_passthrough,omitempty"`
+	TrustedUserCAKeys string         `yaml:"trusted_user_ca_keys,omitempty" json:"trusted_user_ca_keys,omitempty"`
+	AllowedPrincipals string         `yaml:"allowed_principals,omitempty" json:"allowed_principals,omitempty"`
+	ValidFrom         *time.Time     `yaml:"valid_from,omitempty" json:"valid_from,omitempty"`
+	ValidUntil        *time.Time     `yaml:"valid_until,omitempty" json:"valid_until,omitempty"`
+	AccessWindows     string         `yaml:"access_windows,omitempty" json:"access_windows,omitempty"`
+	AccessTimezone    string         `yaml:"access_timezone,omitempty" json:"access_timezone,omitempty"`
+	AllowedSources    string         `yaml:"allowed_sources,omitempty" json:"allowed_sources,omitempty"`
+	DeniedSources     string         `yaml:"denied_sources,omitempty" json:"denied_sources,omitempty"`
+	Banner            string         `yaml:"banner,omitempty" json:"banner,omitempty"`
+	Groups            []string       `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Upstreams         []upstreamSpec `yaml:"upstreams" json:"upstreams"`
+}
+
+type upstreamSpec struct {
+	Server          string `yaml:"server" json:"server"`
+	Name            string `yaml:"name,omitempty" json:"name,omitempty"`
+	Username        string `yaml:"username,omitempty" json:"username,omitempty"`
+	UsernameMapping string `yaml:"username_mapping,omitempty" json:"username_mapping,omitempty"`
+	Auth            string `yaml:"auth,omitempty" json:"auth,omitempty"`
+	Password        string `yaml:"password,omitempty" json:"password,omitempty"`
+	PrivateKey      string `yaml:"private_key,omitempty" json:"private_key,omitempty"`
+	Passphrase      string `yaml:"passphrase,omitempty" json:"passphrase,omitempty"`
+	Certificate     string `yaml:"certificate,omitempty" json:"certificate,omitempty"`
+	Priority        int    `yaml:"priority,omitempty" json:"priority,omitempty"`
+	Weight          int    `yaml:"weight,omitempty" json:"weight,omitempty"`
+}
+
+func syncCommands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:  "export",
+			Usage: "export servers, keys, groups, downstreams and config as a yaml or json document",
+			Flags: append(databaseFlags(),
+				&cli.StringFlag{Name: "format", Value: "yaml", Usage: "output format, yaml or json"},
+				&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Usage: "output file, stdout if empty"},
+			),
+			Action: withPlugin(exportCommand),
+		},
+		{
+			Name:      "import",
+			Usage:     "make the database match a yaml or json document, rows missing from the document are deleted",
+			ArgsUsage: "<file>",
+			Flags: append(databaseFlags(),
+				&cli.BoolFlag{Name: "dry-run", Usage: "print the changes without applying them"},
+			),
+			Action: withPlugin(importCommand),
+		},
+	}
+}
+
+func exportCommand(c *cli.Context, p *plugin) error {
+	table, err := p.exportRoutingTable(p.db)
+	if err != nil {
+		return err
+	}
+
+	w := c.App.Writer
+	if output := c.String("output"); output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	switch c.String("format") {
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(table); err != nil {
+			return err
+		}
+
+		return enc.Close()
+	case "json":
+		return printJSON(w, table)
+	default:
+		return fmt.Errorf("unknown format %v, expected yaml or json", c.String("format"))
+	}
+}
+
+func importCommand(c *cli.Context, p *plugin) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one file")
+	}
+
+	data, err := os.ReadFile(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	// json documents are valid yaml
+	desired := routingTable{}
+	if err := yaml.Unmarshal(data, &desired); err != nil {
+		return err
+	}
+
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		return p.importRoutingTable(tx, &desired, c.Bool("dry-run"), c.App.Writer)
+	})
+}
+
+// exportRoutingTable reads the database into a routingTable, servers without a name
+// are named after their address. Encrypted secrets are encrypted again unbound from
+// their rows, see secretField.exported.
+func (p *plugin) exportRoutingTable(db *gorm.DB) (*routingTable, error) {
+	table := &routingTable{
+		Servers:     []serverSpec{},
+		Keys:        []keySpec{},
+		Groups:      []groupSpec{},
+		Downstreams: []downstreamSpec{},
+		Config:      map[string]string{},
+	}
+
+	var servers []server
+	if err := db.Preload("HostKey").Preload("JumpPrivateKey").Order("id asc").Find(&servers).Error; err != nil {
+		return nil, err
+	}
+
+	serverNames := map[uint]string{}
+	taken := map[string]bool{}
+
+	for _, s := range servers {
+		name := s.Name
+		if name == "" {
+			name = s.Address
+		}
+
+		if taken[name] {
+			name = fmt.Sprintf("%v-%v", name, s.ID)
+		}
+
+		taken[name] = true
+		serverNames[s.ID] = name
+	}
+
+	// jump servers may come after the servers reached through them
+	for _, s := range servers {
+		jumpPassword, err := p.exportSecret(s.JumpPassword, serverField("jump_password", s.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		jumpPrivateKey, err := p.exportSecret(s.JumpPrivateKey.Data, keydataField(s.JumpPrivateKey.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		table.Servers = append(table.Servers, serverSpec{
+			Name:            serverNames[s.ID],
+			Address:         s.Address,
+			HostKey:         s.HostKey.Data,
+			IgnoreHostKey:   s.IgnoreHostKey,
+			TrustOnFirstUse: s.TrustOnFirstUse,
+			Banner:          s.Banner,
+			Via:             serverNames[uint(s.ViaServerID)],
+			JumpUsername:    s.JumpUsername,
+			JumpPassword:    jumpPassword,
+			JumpPrivateKey:  jumpPrivateKey,
+		})
+	}
+
+	var keys []keydata
+	if err := db.Where("name <> ?", "").Order("name asc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		data, err := p.exportSecret(k.Data, keydataField(k.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		table.Keys = append(table.Keys, keySpec{
+			Name: k.Name,
+			Type: k.Type,
+			Data: data,
+		})
+	}
+
+	exportUpstream := func(u *upstream, priority, weight int) (spec upstreamSpec, err error) {
+		spec = upstreamSpec{
+			Server:          serverNames[u.Server.ID],
+			Name:            u.Name,
+			Username:        u.Username,
+			UsernameMapping: usernameMappingNames[u.UsernameMapping],
+			Auth:            authMapTypeNames[u.AuthMapType],
+			Certificate:     u.Certificate.Data,
+			Priority:        priority,
+			Weight:          weight,
+		}
+
+		if spec.Password, err = p.exportSecret(u.Password, upstreamField("password", u.ID)); err != nil {
+			return spec, err
+		}
+
+		if spec.PrivateKey, err = p.exportSecret(u.PrivateKey.Data, keydataField(u.PrivateKey.ID)); err != nil {
+			return spec, err
+		}
+
+		spec.Passphrase, err = p.exportSecret(u.PrivateKeyPassphrase, upstreamField("private_key_passphrase", u.ID))
+
+		return spec, err
+	}
+
+	var groups []group
+	if err := db.Preload("Routes").
+		Preload("Routes.Upstream").
+		Preload("Routes.Upstream.Server").
+		Preload("Routes.Upstream.PrivateKey").
+		Preload("Routes.Upstream.Certificate").
+		Order("name asc").
+		Find(&groups).Error; err != nil {
+
+		return nil, err
+	}
+
+	groupNames := map[int]string{}
+
+	for _, g := range groups {
+		groupNames[int(g.ID)] = g.Name
+
+		spec := groupSpec{Name: g.Name, Upstreams: []upstreamSpec{}}
+		for _, r := range g.Routes {
+			u, err := exportUpstream(&r.Upstream, r.Priority, r.Weight)
+			if err != nil {
+				return nil, err
+			}
+
+			spec.Upstreams = append(spec.Upstreams, u)
+		}
+
+		table.Groups = append(table.Groups, spec)
+	}
+
+	var members []groupMember
+	if err := db.Order("id asc").Find(&members).Error; err != nil {
+		return nil, err
+	}
+
+	memberOf := map[int][]string{}
+	for _, m := range members {
+		if name, ok := groupNames[m.GroupID]; ok {
+			memberOf[m.DownstreamID] = append(memberOf[m.DownstreamID], name)
+		}
+	}
+
+	var downstreams []downstream
+	if err := preloadDownstream(db).Order("username asc").Find(&downstreams).Error; err != nil {
+		return nil, err
+	}
+
+	for _, d := range downstreams {
+		spec := downstreamSpec{
+			Username:          d.Username,
+			Name:              d.Name,
+			Match:             matchTypeNames[d.MatchType],
+			MatchPriority:     d.MatchPriority,
+			Auth:              authMapTypeNames[d.AuthMapType],
+			Password:          d.Password,
+			AuthorizedKeys:    d.AuthorizedKeys.Data,
+			AllowAnyPublicKey: d.AllowAnyPublicKey,
+			NoPassthrough:     d.NoPassthrough,
+			TrustedUserCAKeys: d.TrustedUserCAKeys.Data,
+			AllowedPrincipals: d.AllowedPrincipals,
+			ValidFrom:         d.ValidFrom,
+			ValidUntil:        d.ValidUntil,
+			AccessWindows:     d.AccessWindows,
+			AccessTimezone:    d.AccessTimezone,
+			AllowedSources:    d.AllowedSources,
+			DeniedSources:     d.DeniedSources,
+			Banner:            d.Banner,
+			Groups:            memberOf[int(d.ID)],
+			Upstreams:         []upstreamSpec{},
+		}
+
+		add := func(u *upstream, priority, weight int) error {
+			us, err := exportUpstream(u, priority, weight)
+			spec.Upstreams = append(spec.Upstreams, us)
+			return err
+		}
+
+		if d.UpstreamID != 0 {
+			if err := add(&d.Upstream, 0, 1); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, r := range d.Routes {
+			if err := add(&r.Upstream, r.Priority, r.Weight); err != nil {
+				return nil, err
+			}
+		}
+
+		table.Downstreams = append(table.Downstreams, spec)
+	}
+
+	var configs []config
+	if err := db.Find(&configs).Error; err != nil {
+		return nil, err
+	}
+
+	for _, c := range configs {
+		table.Config[c.Entry] = c.Value
+	}
+
+	return table, nil
+}
+
+// normalize fills in defaults and orders upstreams by priority so equal tables compare equal
+func (t *routingTable) normalize() {
+	for i := range t.Groups {
+		normalizeUpstreams(t.Groups[i].Upstreams)
+	}
+
+	for i := range t.Downstreams {
+		d := &t.Downstreams[i]
+
+		if d.Match == "" {
+			d.Match = matchTypeNames[matchTypeExact]
+		}
+
+		if d.Auth == "" {
+			d.Auth = authMapTypeNames[authMapTypePassword]
+		}
+
+		d.ValidFrom = normalizeTime(d.ValidFrom)
+		d.ValidUntil = normalizeTime(d.ValidUntil)
+
+		if len(d.Groups) == 0 {
+			d.Groups = nil
+		}
+
+		sort.Strings(d.Groups)
+		normalizeUpstreams(d.Upstreams)
+	}
+}
+
+func normalizeUpstreams(ups []upstreamSpec) {
+	for j := range ups {
+		u := &ups[j]
+
+		if u.Auth == "" {
+			u.Auth = authMapTypeNames[authMapTypePassword]
+		}
+
+		if u.UsernameMapping == "" {
+			u.UsernameMapping = usernameMappingNames[usernameMappingAuto]
+		}
+
+		if u.Weight == 0 {
+			u.Weight = 1
+		}
+	}
+
+	sort.SliceStable(ups, func(a, b int) bool {
+		return ups[a].Priority < ups[b].Priority
+	})
+}
+
+// validate checks references and values of a routingTable
+func (t *routingTable) validate() error {
+	servers := map[string]bool{}
+	for i := range t.Servers {
+		s := &t.Servers[i]
+
+		if s.Name == "" {
+			return fmt.Errorf("server %v: name is required", i)
+		}
+
+		if servers[s.Name] {
+			return fmt.Errorf("server %v: duplicate name", s.Name)
+		}
+
+		servers[s.Name] = true
+
+		if _, _, err := libplugin.SplitHostPortForSSH(s.Address); err != nil {
+			return fmt.Errorf("server %v: invalid address %v: %w", s.Name, s.Address, err)
+		}
+
+		if err := validateBanner(s.Banner); err != nil {
+			return fmt.Errorf("server %v: %w", s.Name, err)
+		}
+	}
+
+	if err := validateJumpChains(t.Servers); err != nil {
+		return err
+	}
+
+	keys := map[string]bool{}
+	for i := range t.Keys {
+		k := &t.Keys[i]
+
+		if k.Name == "" {
+			return fmt.Errorf("key %v: name is required", i)
+		}
+
+		if keys[k.Name] {
+			return fmt.Errorf("key %v: duplicate name", k.Name)
+		}
+
+		keys[k.Name] = true
+	}
+
+	groups := map[string]bool{}
+	for i := range t.Groups {
+		g := &t.Groups[i]
+
+		if g.Name == "" {
+			return fmt.Errorf("group %v: name is required", i)
+		}
+
+		if groups[g.Name] {
+			return fmt.Errorf("group %v: duplicate name", g.Name)
+		}
+
+		groups[g.Name] = true
+
+		for j := range g.Upstreams {
+			if err := g.Upstreams[j].validate(servers); err != nil {
+				return fmt.Errorf("group %v: upstream %v: %w", g.Name, j, err)
+			}
+		}
+	}
+
+	downstreams := map[string]bool{}
+	for i := range t.Downstreams {
+		d := &t.Downstreams[i]
+
+		if d.Username == "" {
+			return fmt.Errorf("downstream %v: username is required", i)
+		}
+
+		if downstreams[d.Username] {
+			return fmt.Errorf("downstream %v: duplicate username", d.Username)
+		}
+
+		downstreams[d.Username] = true
+
+		match, err := parseName(matchTypeNames, d.Match)
+		if err != nil {
+			return fmt.Errorf("downstream %v: %w", d.Username, err)
+		}
+
+		if match != matchTypeExact {
+			if _, err := compileUserPattern(match, d.Username); err != nil {
+				return fmt.Errorf("downstream %v: invalid username pattern: %w", d.Username, err)
+			}
+		}
+
+		auth, err := parseName(authMapTypeNames, d.Auth)
+		if err != nil {
+			return fmt.Errorf("downstream %v: %w", d.Username, err)
+		}
+
+		publicKeys := d.AuthorizedKeys != "" || d.TrustedUserCAKeys != "" || d.AllowAnyPublicKey || t.Config[trustedUserCAKeysEntry] != ""
+
+		if err := checkDownstreamCredentials(auth, d.Password, publicKeys); err != nil {
+			return fmt.Errorf("downstream %v: %w", d.Username, err)
+		}
+
+		if _, err := parseAccessWindows(d.AccessWindows); err != nil {
+			return fmt.Errorf("downstream %v: %w", d.Username, err)
+		}
+
+		if _, err := time.LoadLocation(d.AccessTimezone); err != nil {
+			return fmt.Errorf("downstream %v: %w", d.Username, err)
+		}
+
+		if _, err := parseSourceList(d.AllowedSources); err != nil {
+			return fmt.Errorf("downstream %v: %w", d.Username, err)
+		}
+
+		if _, err := parseSourceList(d.DeniedSources); err != nil {
+			return fmt.Errorf("downstream %v: %w", d.Username, err)
+		}
+
+		if err := validateBanner(d.Banner); err != nil {
+			return fmt.Errorf("downstream %v: %w", d.Username, err)
+		}
+
+		for _, name := range d.Groups {
+			if !groups[name] {
+				return fmt.Errorf("downstream %v: unknown group %v", d.Username, name)
+			}
+		}
+
+		if len(d.Upstreams) == 0 && len(d.Groups) == 0 {
+			return fmt.Errorf("downstream %v: at least one upstream or group is required", d.Username)
+		}
+
+		for j := range d.Upstreams {
+			if err := d.Upstreams[j].validate(servers); err != nil {
+				return fmt.Errorf("downstream %v: upstream %v: %w", d.Username, j, err)
+			}
+		}
+	}
+
+	for entry, value := range t.Config {
+		switch entry {
+		case fallbackUserEntry:
+			if !downstreams[value] {
+				return fmt.Errorf("config %v: unknown downstream %v", entry, value)
+			}
+		case trustedUserCAKeysEntry:
+			if !keys[value] {
+				return fmt.Errorf("config %v: unknown key %v", entry, value)
+			}
+		case allowedSourcesEntry, deniedSourcesEntry:
+			if _, err := parseSourceList(value); err != nil {
+				return fmt.Errorf("config %v: %w", entry, err)
+			}
+		case bannerEntry:
+			if err := validateBanner(value); err != nil {
+				return fmt.Errorf("config %v: %w", entry, err)
+			}
+		default:
+			return fmt.Errorf("unknown config entry %v, expected one of %v", entry, strings.Join(configEntries, ", "))
+		}
+	}
+
+	return nil
+}
+
+func (u *upstreamSpec) validate(servers map[string]bool) error {
+	if !servers[u.Server] {
+		return fmt.Errorf("unknown server %v", u.Server)
+	}
+
+	if u.Auth != authMapTypeNames[authMapTypePassword] && u.Auth != authMapTypeNames[authMapTypePrivateKey] {
+		return fmt.Errorf("auth must be password or privatekey")
+	}
+
+	mapping, err := parseName(usernameMappingNames, u.UsernameMapping)
+	if err != nil {
+		return err
+	}
+
+	if err := validateUsernameMapping(mapping, u.Username); err != nil {
+		return err
+	}
+
+	if u.Certificate != "" {
+		if u.PrivateKey == "" {
+			return fmt.Errorf("certificate requires a private key")
+		}
+
+		if err := validateCertificate(u.Certificate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reveal returns the plaintext of an exported secret for comparison, encrypted values
+// that cannot be decrypted are compared as they are
+func (p *plugin) reveal(secret string, field secretField) string {
+	if !isEncrypted(secret) || p.keyring == nil {
+		return secret
+	}
+
+	plain, err := p.keyring.decrypt(secret, field.exported())
+	if err != nil {
+		return secret
+	}
+
+	return plain
+}
+
+// validateJumpChains checks that every via names a server and no jump chain loops or exceeds maxJumpHops
+func validateJumpChains(servers []serverSpec) error {
+	via := map[string]string{}
+	for _, s := range servers {
+		via[s.Name] = s.Via
+	}
+
+	for _, s := range servers {
+		seen := map[string]bool{s.Name: true}
+
+		for name, hops := s.Via, 0; name != ""; name, hops = via[name], hops+1 {
+			if _, ok := via[name]; !ok {
+				return fmt.Errorf("server %v: unknown jump server %v", s.Name, name)
+			}
+
+			if seen[name] {
+				return fmt.Errorf("server %v: jump chain loops at %v", s.Name, name)
+			}
+
+			if hops == maxJumpHops {
+				return fmt.Errorf("server %v: more than %v jump servers", s.Name, maxJumpHops)
+			}
+
+			seen[name] = true
+		}
+	}
+
+	return nil
+}
+
+func (p *plugin) sameServer(a, b serverSpec) bool {
+	for _, s := range []*serverSpec{&a, &b} {
+		s.JumpPassword = p.reveal(s.JumpPassword, serverField("jump_password", 0))
+		s.JumpPrivateKey = p.reveal(s.JumpPrivateKey, keydataField(0))
+	}
+
+	return a == b
+}
+
+func (p *plugin) sameKey(a, b keySpec) bool {
+	a.Data = p.reveal(a.Data, keydataField(0))
+	b.Data = p.reveal(b.Data, keydataField(0))
+
+	return a == b
+}
+
+func (p *plugin) sameDownstream(a, b downstreamSpec) bool {
+	// a plaintext password in the document is the same as the hash it was stored as
+	if a.Password != b.Password {
+		if ok, _ := verifyPassword(a.Password, []byte(b.Password), false); ok {
+			b.Password = a.Password
+		}
+	}
+
+	a.Upstreams = p.revealUpstreams(a.Upstreams)
+	b.Upstreams = p.revealUpstreams(b.Upstreams)
+
+	return reflect.DeepEqual(a, b)
+}
+
+func (p *plugin) sameGroup(a, b groupSpec) bool {
+	a.Upstreams = p.revealUpstreams(a.Upstreams)
+	b.Upstreams = p.revealUpstreams(b.Upstreams)
+
+	return reflect.DeepEqual(a, b)
+}
+
+// revealUpstreams returns a copy of ups with revealed secrets
+func (p *plugin) revealUpstreams(ups []upstreamSpec) []upstreamSpec {
+	ups = append([]upstreamSpec(nil), ups...)
+
+	for i := range ups {
+		ups[i].Password = p.reveal(ups[i].Password, upstreamField("password", 0))
+		ups[i].PrivateKey = p.reveal(ups[i].PrivateKey, keydataField(0))
+		ups[i].Passphrase = p.reveal(ups[i].Passphrase, upstreamField("private_key_passphrase", 0))
+	}
+
+	return ups
+}
+
+// importRoutingTable makes the database match desired, printing one line per
+// created (+), updated (~) or deleted (-) row. Nothing is written in dry run.
+func (p *plugin) importRoutingTable(tx *gorm.DB, desired *routingTable, dryRun bool, w io.Writer) error {
+	desired.normalize()
+
+	if err := desired.validate(); err != nil {
+		return err
+	}
+
+	current, err := p.exportRoutingTable(tx)
+	if err != nil {
+		return err
+	}
+
+	current.normalize()
+
+	changes := 0
+	change := func(op, kind, name string) {
+		fmt.Fprintf(w, "%v %v %v\n", op, kind, name)
+		changes++
+	}
+
+	currentServers := map[string]serverSpec{}
+	for _, s := range current.Servers {
+		currentServers[s.Name] = s
+	}
+
+	currentKeys := map[string]keySpec{}
+	for _, k := range current.Keys {
+		currentKeys[k.Name] = k
+	}
+
+	currentGroups := map[string]groupSpec{}
+	for _, g := range current.Groups {
+		currentGroups[g.Name] = g
+	}
+
+	currentDownstreams := map[string]downstreamSpec{}
+	for _, d := range current.Downstreams {
+		currentDownstreams[d.Username] = d
+	}
+
+	desiredServers := map[string]bool{}
+	var upsertServers []serverSpec
+	for _, s := range desired.Servers {
+		desiredServers[s.Name] = true
+
+		// a trust on first use server without host_key keeps the key recorded on first use
+		if cur, ok := currentServers[s.Name]; ok && s.TrustOnFirstUse && s.HostKey == "" {
+			s.HostKey = cur.HostKey
+		}
+
+		if cur, ok := currentServers[s.Name]; !ok {
+			change("+", "server", s.Name)
+			upsertServers = append(upsertServers, s)
+		} else if !p.sameServer(cur, s) {
+			change("~", "server", s.Name)
+			upsertServers = append(upsertServers, s)
+		}
+	}
+
+	var deleteServers []string
+	for _, s := range current.Servers {
+		if !desiredServers[s.Name] {
+			change("-", "server", s.Name)
+			deleteServers = append(deleteServers, s.Name)
+		}
+	}
+
+	desiredKeys := map[string]bool{}
+	var upsertKeys []keySpec
+	for _, k := range desired.Keys {
+		desiredKeys[k.Name] = true
+
+		if cur, ok := currentKeys[k.Name]; !ok {
+			change("+", "key", k.Name)
+			upsertKeys = append(upsertKeys, k)
+		} else if !p.sameKey(cur, k) {
+			change("~", "key", k.Name)
+			upsertKeys = append(upsertKeys, k)
+		}
+	}
+
+	var deleteKeys []string
+	for _, k := range current.Keys {
+		if !desiredKeys[k.Name] {
+			change("-", "key", k.Name)
+			deleteKeys = append(deleteKeys, k.Name)
+		}
+	}
+
+	desiredGroups := map[string]bool{}
+	var upsertGroups []groupSpec
+	for _, g := range desired.Groups {
+		desiredGroups[g.Name] = true
+
+		if cur, ok := currentGroups[g.Name]; !ok {
+			change("+", "group", g.Name)
+			upsertGroups = append(upsertGroups, g)
+		} else if !p.sameGroup(cur, g) {
+			change("~", "group", g.Name)
+			upsertGroups = append(upsertGroups, g)
+		}
+	}
+
+	var deleteGroups []string
+	for _, g := range current.Groups {
+		if !desiredGroups[g.Name] {
+			change("-", "group", g.Name)
+			deleteGroups = append(deleteGroups, g.Name)
+		}
+	}
+
+	desiredDownstreams := map[string]bool{}
+	var upsertDownstreams []downstreamSpec
+	for _, d := range desired.Downstreams {
+		desiredDownstreams[d.Username] = true
+
+		if cur, ok := currentDownstreams[d.Username]; !ok {
+			change("+", "downstream", d.Username)
+			upsertDownstreams = append(upsertDownstreams, d)
+		} else if !p.sameDownstream(cur, d) {
+			change("~", "downstream", d.Username)
+			upsertDownstreams = append(upsertDownstreams, d)
+		}
+	}
+
+	var deleteDownstreams []string
+	for _, d := range current.Downstreams {
+		if !desiredDownstreams[d.Username] {
+			change("-", "downstream", d.Username)
+			deleteDownstreams = append(deleteDownstreams, d.Username)
+		}
+	}
+
+	var deleteConfigs []string
+	for _, entry := range sortedKeys(desired.Config) {
+		if cur, ok := current.Config[entry]; !ok {
+			change("+", "config", entry)
+		} else if cur != desired.Config[entry] {
+			change("~", "config", entry)
+		}
+	}
+
+	for _, entry := range sortedKeys(current.Config) {
+		if _, ok := desired.Config[entry]; !ok {
+			change("-", "config", entry)
+			deleteConfigs = append(deleteConfigs, entry)
+		}
+	}
+
+	if dryRun || changes == 0 {
+		fmt.Fprintf(w, "%v changes", changes)
+		if dryRun {
+			fmt.Fprint(w, ", dry run, nothing applied")
+		}
+		fmt.Fprintln(w)
+
+		return nil
+	}
+
+	s := syncer{tx: tx, plugin: p, servers: map[string]uint{}}
+
+	if err := s.loadServerIDs(current.Servers); err != nil {
+		return err
+	}
+
+	for _, spec := range upsertServers {
+		if err := s.upsertServer(spec); err != nil {
+			return fmt.Errorf("server %v: %w", spec.Name, err)
+		}
+	}
+
+	// jump servers exist once all servers are upserted
+	for _, spec := range upsertServers {
+		if err := s.linkJumpServer(spec); err != nil {
+			return fmt.Errorf("server %v: %w", spec.Name, err)
+		}
+	}
+
+	for _, spec := range upsertKeys {
+		if err := s.upsertKey(spec); err != nil {
+			return fmt.Errorf("key %v: %w", spec.Name, err)
+		}
+	}
+
+	for _, username := range deleteDownstreams {
+		if err := s.deleteDownstream(username); err != nil {
+			return fmt.Errorf("downstream %v: %w", username, err)
+		}
+	}
+
+	for _, spec := range upsertGroups {
+		if err := s.upsertGroup(spec); err != nil {
+			return fmt.Errorf("group %v: %w", spec.Name, err)
+		}
+	}
+
+	for _, spec := range upsertDownstreams {
+		if err := s.upsertDownstream(spec); err != nil {
+			return fmt.Errorf("downstream %v: %w", spec.Username, err)
+		}
+	}
+
+	for _, name := range deleteGroups {
+		if err := s.deleteGroup(name); err != nil {
+			return fmt.Errorf("group %v: %w", name, err)
+		}
+	}
+
+	for _, name := range deleteServers {
+		if err := s.deleteServer(name); err != nil {
+			return fmt.Errorf("server %v: %w", name, err)
+		}
+	}
+
+	for _, name := range deleteKeys {
+		if err := tx.Where(&keydata{Name: name}).Delete(&keydata{}).Error; err != nil {
+			return fmt.Errorf("key %v: %w", name, err)
+		}
+	}
+
+	for entry, value := range desired.Config {
+		cfg := config{}
+		if err := tx.Where(&config{Entry: entry}).Assign(config{Value: value}).FirstOrCreate(&cfg).Error; err != nil {
+			return fmt.Errorf("config %v: %w", entry, err)
+		}
+	}
+
+	for _, entry := range deleteConfigs {
+		// config entries are unique, a soft deleted row would block setting the entry again
+		if err := tx.Unscoped().Where(&config{Entry: entry}).Delete(&config{}).Error; err != nil {
+			return fmt.Errorf("config %v: %w", entry, err)
+		}
+	}
+
+	fmt.Fprintf(w, "%v changes applied\n", changes)
+
+	return nil
+}
+
+// syncer writes routingTable rows within a transaction
+type syncer struct {
+	tx      *gorm.DB
+	plugin  *plugin
+	servers map[string]uint // exported server name -> id
+
+	// pruneServers deletes unnamed servers left without upstream, an import keeps
+	// them as the document names them after their address
+	pruneServers bool
+}
+
+// findServer finds a server by its exported name, which is the address for servers without a name
+func (s *syncer) findServer(name string, srv *server) error {
+	if id, ok := s.servers[name]; ok {
+		return s.tx.First(srv, id).Error
+	}
+
+	return s.tx.Where(&server{Name: name}).First(srv).Error
+}
+
+func (s *syncer) loadServerIDs(exported []serverSpec) error {
+	var servers []server
+	if err := s.tx.Order("id asc").Find(&servers).Error; err != nil {
+		return err
+	}
+
+	for _, srv := range servers {
+		if srv.Name != "" {
+			s.servers[srv.Name] = srv.ID
+		}
+	}
+
+	// unnamed servers are exported under their address
+	for _, spec := range exported {
+		if _, ok := s.servers[spec.Name]; ok {
+			continue
+		}
+
+		for _, srv := range servers {
+			if srv.Name == "" && (spec.Name == srv.Address || spec.Name == fmt.Sprintf("%v-%v", srv.Address, srv.ID)) {
+				s.servers[spec.Name] = srv.ID
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *syncer) upsertServer(spec serverSpec) error {
+	srv := server{}
+	if err := s.findServer(spec.Name, &srv); err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	oldHostKey := srv.HostKeyID
+	oldJumpKey := srv.JumpPrivateKeyID
+
+	srv.Name = spec.Name
+	srv.Address = spec.Address
+	srv.IgnoreHostKey = spec.IgnoreHostKey
+	srv.TrustOnFirstUse = spec.TrustOnFirstUse
+	srv.Banner = spec.Banner
+	srv.HostKeyID = 0
+	srv.HostKey = keydata{}
+	srv.ViaServerID = 0
+	srv.JumpUsername = spec.JumpUsername
+	srv.JumpPrivateKeyID = 0
+	srv.JumpPrivateKey = keydata{}
+
+	if spec.HostKey != "" {
+		srv.HostKey = keydata{Data: spec.HostKey, Type: "knownhosts"}
+	}
+
+	srv.JumpPassword = spec.JumpPassword
+
+	if spec.JumpPrivateKey != "" {
+		srv.JumpPrivateKey = keydata{Data: spec.JumpPrivateKey, Type: "privatekey"}
+	}
+
+	if err := s.plugin.saveServer(s.tx, &srv); err != nil {
+		return err
+	}
+
+	s.servers[spec.Name] = srv.ID
+
+	return s.pruneKeydata(oldHostKey, oldJumpKey)
+}
+
+// linkJumpServer points an upserted server at the jump server named by spec.Via
+func (s *syncer) linkJumpServer(spec serverSpec) error {
+	if spec.Via == "" {
+		return nil
+	}
+
+	srv, via := server{}, server{}
+	if err := s.findServer(spec.Name, &srv); err != nil {
+		return err
+	}
+
+	if err := s.findServer(spec.Via, &via); err != nil {
+		return fmt.Errorf("jump server %v: %w", spec.Via, err)
+	}
+
+	return s.tx.Model(&srv).Update("via_server_id", via.ID).Error
+}
+
+func (s *syncer) upsertKey(spec keySpec) error {
+	k := keydata{}
+	if err := s.tx.Where(&keydata{Name: spec.Name}).First(&k).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	k.Name = spec.Name
+	k.Type = spec.Type
+	k.Data = spec.Data
+
+	return s.plugin.saveKeydata(s.tx, &k)
+}
+
+func (s *syncer) upsertDownstream(spec downstreamSpec) error {
+	d := downstream{}
+	err := s.tx.Where(&downstream{Username: spec.Username}).First(&d).Error
+
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	if err == nil {
+		if err := s.clearDownstream(&d); err != nil {
+			return err
+		}
+	}
+
+	match, _ := parseName(matchTypeNames, spec.Match)
+	auth, _ := parseName(authMapTypeNames, spec.Auth)
+
+	d.Username = spec.Username
+	d.Name = spec.Name
+	d.MatchType = match
+	d.MatchPriority = spec.MatchPriority
+	d.AuthMapType = auth
+	if d.Password, err = hashPassword(spec.Password); err != nil {
+		return err
+	}
+
+	d.AllowAnyPublicKey = spec.AllowAnyPublicKey
+	d.NoPassthrough = spec.NoPassthrough
+	d.AllowedPrincipals = spec.AllowedPrincipals
+	d.ValidFrom = spec.ValidFrom
+	d.ValidUntil = spec.ValidUntil
+	d.AccessWindows = spec.AccessWindows
+	d.AccessTimezone = spec.AccessTimezone
+	d.AllowedSources = spec.AllowedSources
+	d.DeniedSources = spec.DeniedSources
+	d.Banner = spec.Banner
+	d.UpstreamID = 0
+	d.Upstream = upstream{}
+	d.Routes = nil
+	d.AuthorizedKeysID = 0
+	d.AuthorizedKeys = keydata{}
+	d.TrustedUserCAKeysID = 0
+	d.TrustedUserCAKeys = keydata{}
+
+	if spec.AuthorizedKeys != "" {
+		d.AuthorizedKeys = keydata{Data: spec.AuthorizedKeys, Type: "publickey"}
+	}
+
+	if spec.TrustedUserCAKeys != "" {
+		d.TrustedUserCAKeys = keydata{Data: spec.TrustedUserCAKeys, Type: "publickey"}
+	}
+
+	for _, us := range spec.Upstreams {
+		u, err := s.newUpstream(us)
+		if err != nil {
+			return err
+		}
+
+		d.Routes = append(d.Routes, route{
+			UpstreamID: int(u.ID),
+			Priority:   us.Priority,
+			Weight:     us.Weight,
+		})
+	}
+
+	if err := s.tx.Save(&d).Error; err != nil {
+		return err
+	}
+
+	return joinGroups(s.tx, &d, spec.Groups)
+}
+
+func (s *syncer) upsertGroup(spec groupSpec) error {
+	g := group{}
+	err := s.tx.Where(&group{Name: spec.Name}).First(&g).Error
+
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	if err == nil {
+		if err := s.clearGroupRoutes(&g); err != nil {
+			return err
+		}
+	}
+
+	g.Name = spec.Name
+	g.Routes = nil
+
+	for _, us := range spec.Upstreams {
+		u, err := s.newUpstream(us)
+		if err != nil {
+			return err
+		}
+
+		g.Routes = append(g.Routes, groupRoute{
+			UpstreamID: int(u.ID),
+			Priority:   us.Priority,
+			Weight:     us.Weight,
+		})
+	}
+
+	return s.tx.Save(&g).Error
+}
+
+// clearGroupRoutes deletes the routes and upstreams owned by a group
+func (s *syncer) clearGroupRoutes(g *group) error {
+	var routes []groupRoute
+	if err := s.tx.Where("group_id = ?", g.ID).Find(&routes).Error; err != nil {
+		return err
+	}
+
+	if err := s.tx.Where("group_id = ?", g.ID).Delete(&groupRoute{}).Error; err != nil {
+		return err
+	}
+
+	for _, r := range routes {
+		if err := s.pruneUpstream(r.UpstreamID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *syncer) deleteGroup(name string) error {
+	g := group{}
+	if err := s.tx.Where(&group{Name: name}).First(&g).Error; err != nil {
+		return err
+	}
+
+	if err := s.clearGroupRoutes(&g); err != nil {
+		return err
+	}
+
+	if err := s.tx.Where("group_id = ?", g.ID).Delete(&groupMember{}).Error; err != nil {
+		return err
+	}
+
+	// group names are unique, a soft deleted row would block adding the name again
+	return s.tx.Unscoped().Delete(&g).Error
+}
+
+// newUpstream creates the upstream of spec
+func (s *syncer) newUpstream(spec upstreamSpec) (*upstream, error) {
+	auth, _ := parseName(authMapTypeNames, spec.Auth)
+	mapping, _ := parseName(usernameMappingNames, spec.UsernameMapping)
+
+	u := &upstream{
+		Name:            spec.Name,
+		Username:        spec.Username,
+		UsernameMapping: mapping,
+		AuthMapType:     auth,
+	}
+
+	srv := server{}
+	if err := s.findServer(spec.Server, &srv); err != nil {
+		return nil, fmt.Errorf("server %v: %w", spec.Server, err)
+	}
+
+	u.ServerID = int(srv.ID)
+	u.Password = spec.Password
+	u.PrivateKeyPassphrase = spec.Passphrase
+
+	if spec.PrivateKey != "" {
+		u.PrivateKey = keydata{Data: spec.PrivateKey, Type: "privatekey"}
+	}
+
+	if spec.Certificate != "" {
+		u.Certificate = keydata{Data: spec.Certificate, Type: "certificate"}
+	}
+
+	if err := s.plugin.createUpstream(s.tx, u); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// clearDownstream deletes the upstreams, routes, group memberships and keydata owned by a downstream
+func (s *syncer) clearDownstream(d *downstream) error {
+	if err := s.tx.Where("downstream_id = ?", d.ID).Delete(&groupMember{}).Error; err != nil {
+		return err
+	}
+
+	var routes []route
+	if err := s.tx.Where("downstream_id = ?", d.ID).Find(&routes).Error; err != nil {
+		return err
+	}
+
+	upstreams := []int{d.UpstreamID}
+	for _, r := range routes {
+		upstreams = append(upstreams, r.UpstreamID)
+	}
+
+	if err := s.tx.Where("downstream_id = ?", d.ID).Delete(&route{}).Error; err != nil {
+		return err
+	}
+
+	if err := s.tx.Model(d).Updates(map[string]interface{}{
+		"upstream_id":             0,
+		"authorized_keys_id":      0,
+		"trusted_user_ca_keys_id": 0,
+	}).Error; err != nil {
+		return err
+	}
+
+	for _, id := range upstreams {
+		if err := s.pruneUpstream(id); err != nil {
+			return err
+		}
+	}
+
+	return s.pruneKeydata(d.AuthorizedKeysID, d.TrustedUserCAKeysID)
+}
+
+func (s *syncer) deleteDownstream(username string) error {
+	d := downstream{}
+	if err := s.tx.Where(&downstream{Username: username}).First(&d).Error; err != nil {
+		return err
+	}
+
+	if err := s.clearDownstream(&d); err != nil {
+		return err
+	}
+
+	// usernames are unique, a soft deleted row would block adding the username again
+	return s.tx.Unscoped().Delete(&d).Error
+}
+
+func (s *syncer) deleteServer(name string) error {
+	srv := server{}
+	if err := s.findServer(name, &srv); err != nil {
+		return err
+	}
+
+	if err := s.tx.Delete(&srv).Error; err != nil {
+		return err
+	}
+
+	return s.pruneKeydata(srv.HostKeyID, srv.JumpPrivateKeyID)
+}
+
+// pruneUpstream deletes an upstream and its private key once no downstream, route or group route refers to it
+func (s *syncer) pruneUpstream(id int) error {
+	if id == 0 {
+		return nil
+	}
+
+	var refs int64
+	if err := s.tx.Model(&downstream{}).Where("upstream_id = ?", id).Count(&refs).Error; err != nil {
+		return err
+	}
+
+	if refs > 0 {
+		return nil
+	}
+
+	if err := s.tx.Model(&route{}).Where("upstream_id = ?", id).Count(&refs).Error; err != nil {
+		return err
+	}
+
+	if refs > 0 {
+		return nil
+	}
+
+	if err := s.tx.Model(&groupRoute{}).Where("upstream_id = ?", id).Count(&refs).Error; err != nil {
+		return err
+	}
+
+	if refs > 0 {
+		return nil
+	}
+
+	u := upstream{}
+	if err := s.tx.First(&u, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	if err := s.tx.Delete(&u).Error; err != nil {
+		return err
+	}
+
+	if s.pruneServers {
+		if err := s.pruneServer(u.ServerID); err != nil {
+			return err
+		}
+	}
+
+	return s.pruneKeydata(u.PrivateKeyID, u.CertificateID)
+}
+
+// pruneServer deletes an unnamed server and its keys once no upstream or server refers to it,
+// named servers are managed as servers
+func (s *syncer) pruneServer(id int) error {
+	if id == 0 {
+		return nil
+	}
+
+	srv := server{}
+	if err := s.tx.First(&srv, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	if srv.Name != "" {
+		return nil
+	}
+
+	var refs int64
+	if err := s.tx.Model(&upstream{}).Where("server_id = ?", id).Count(&refs).Error; err != nil {
+		return err
+	}
+
+	if refs > 0 {
+		return nil
+	}
+
+	if err := s.tx.Model(&server{}).Where("via_server_id = ?", id).Count(&refs).Error; err != nil {
+		return err
+	}
+
+	if refs > 0 {
+		return nil
+	}
+
+	if err := s.tx.Delete(&srv).Error; err != nil {
+		return err
+	}
+
+	return s.pruneKeydata(srv.HostKeyID, srv.JumpPrivateKeyID)
+}
+
+// pruneKeydata deletes unnamed keydata no row refers to, named keydata is managed as keys
+func (s *syncer) pruneKeydata(ids ...int) error {
+	for _, id := range ids {
+		if id == 0 {
+			continue
+		}
+
+		k := keydata{}
+		if err := s.tx.First(&k, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+
+			return err
+		}
+
+		if k.Name != "" {
+			continue
+		}
+
+		var total int64
+		for _, ref := range []struct {
+			model  interface{}
+			column string
+		}{
+			{&downstream{}, "authorized_keys_id"},
+			{&downstream{}, "trusted_user_ca_keys_id"},
+			{&upstream{}, "private_key_id"},
+			{&upstream{}, "certificate_id"},
+			{&server{}, "host_key_id"},
+			{&server{}, "jump_private_key_id"},
+		} {
+			var refs int64
+			if err := s.tx.Model(ref.model).Where(ref.column+" = ?", id).Count(&refs).Error; err != nil {
+				return err
+			}
+
+			total += refs
+		}
+
+		if total > 0 {
+			continue
+		}
+
+		if err := s.tx.Delete(&k).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalizeTime drops location and sub-second precision, which databases do not keep alike
+func normalizeTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	n := t.UTC().Truncate(time.Second)
+	return &n
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testRoutingTable = `
+servers:
+  - name: primary
+    address: primary:2222
+    ignore_host_key: true
+  - name: backup
+    address: backup
+    ignore_host_key: true
+downstreams:
+  - username: bob
+    password: secret
+    upstreams:
+      - server: backup
+        username: app
+        priority: 1
+      - server: primary
+        username: app
+        password: pass
+  - username: "dev-*"
+    match: glob
+    upstreams:
+      - server: primary
+        username: "{1}"
+config:
+  FALLBACK_USER: bob
+`
+
+func importTestTable(t *testing.T, p *plugin, doc string, dryRun bool) string {
+	table := routingTable{}
+	if err := yaml.Unmarshal([]byte(doc), &table); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := p.importRoutingTable(p.db, &table, dryRun, &out); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+
+	return out.String()
+}
+
+func TestImportRoutingTable(t *testing.T) {
+	p := newTestPlugin(t)
+
+	if err := p.db.Create(&downstream{
+		Username: "stale",
+		Upstream: upstream{Server: server{Address: "old:22"}},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	out := importTestTable(t, p, testRoutingTable, true)
+	for _, line := range []string{"+ server primary", "+ downstream bob", "+ downstream dev-*", "- downstream stale", "- server old:22", "+ config FALLBACK_USER"} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected %q in dry run output %v", line, out)
+		}
+	}
+
+	if err := p.db.Where(&downstream{Username: "bob"}).First(&downstream{}).Error; err == nil {
+		t.Errorf("dry run must not write")
+	}
+
+	importTestTable(t, p, testRoutingTable, false)
+
+	if out := importTestTable(t, p, testRoutingTable, false); out != "0 changes\n" {
+		t.Errorf("expected import to be idempotent, got %v", out)
+	}
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 2 || pipes[0].UpstreamHost != "primary:2222" || pipes[0].ToPassword != "pass" || pipes[1].UpstreamHost != "backup" {
+		t.Errorf("unexpected pipes %+v", pipes)
+	}
+
+	pipes, err = p.loadPipeFromDB(&testConn{user: "nobody"})
+	if err != nil || len(pipes) != 2 || pipes[0].MappedUsername != "app" {
+		t.Errorf("expected fallback to bob, got %+v, %v", pipes, err)
+	}
+
+	changed := strings.Replace(testRoutingTable, "password: pass", "password: changed", 1)
+	if out := importTestTable(t, p, changed, false); !strings.Contains(out, "~ downstream bob\n") || strings.Contains(out, "dev-*") {
+		t.Errorf("expected only bob changed, got %v", out)
+	}
+
+	var upstreams int64
+	if err := p.db.Model(&upstream{}).Count(&upstreams).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if upstreams != 3 {
+		t.Errorf("expected replaced upstreams to be deleted, got %v upstreams", upstreams)
+	}
+
+	exported, err := p.exportRoutingTable(p.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := yaml.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := importTestTable(t, p, string(data), false); out != "0 changes\n" {
+		t.Errorf("expected export to import without changes, got %v", out)
+	}
+}
+
+func TestImportRejectsMissingCredentials(t *testing.T) {
+	const servers = `
+servers:
+  - name: primary
+    address: primary:22
+    ignore_host_key: true
+`
+
+	for doc, valid := range map[string]bool{
+		`
+downstreams:
+  - username: bob
+    auth: password-or-privatekey
+    password: secret
+    authorized_keys: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFINJM8a0gJVY1G+X1rQFhfEh/Vz/KyjOy8bg0rBquy8
+    upstreams:
+      - server: primary
+`: true,
+		`
+downstreams:
+  - username: bob
+    auth: password-or-privatekey
+    authorized_keys: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFINJM8a0gJVY1G+X1rQFhfEh/Vz/KyjOy8bg0rBquy8
+    upstreams:
+      - server: primary
+`: false,
+		`
+downstreams:
+  - username: bob
+    auth: privatekey
+    upstreams:
+      - server: primary
+`: false,
+		`
+downstreams:
+  - username: bob
+    auth: privatekey
+    trusted_user_ca_keys: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFINJM8a0gJVY1G+X1rQFhfEh/Vz/KyjOy8bg0rBquy8
+    upstreams:
+      - server: primary
+`: true,
+	} {
+		table := routingTable{}
+		if err := yaml.Unmarshal([]byte(doc+servers), &table); err != nil {
+			t.Fatal(err)
+		}
+
+		table.normalize()
+
+		if err := table.validate(); (err == nil) != valid {
+			t.Errorf("expected valid %v, got %v for %v", valid, err, doc)
+		}
+	}
+}
+
+func TestImportGroups(t *testing.T) {
+	p := newTestPlugin(t)
+
+	doc := `
+servers:
+  - name: build
+    address: build:22
+    ignore_host_key: true
+groups:
+  - name: dev
+    upstreams:
+      - server: build
+        username: ci
+downstreams:
+  - username: alice
+    groups: [dev]
+`
+
+	if out := importTestTable(t, p, doc, false); !strings.Contains(out, "+ group dev") {
+		t.Errorf("expected group to be created, got %v", out)
+	}
+
+	if out := importTestTable(t, p, doc, false); out != "0 changes\n" {
+		t.Errorf("expected import to be idempotent, got %v", out)
+	}
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 1 || pipes[0].UpstreamHost != "build:22" || pipes[0].MappedUsername != "ci" {
+		t.Errorf("unexpected pipes %+v", pipes)
+	}
+
+	out := importTestTable(t, p, strings.Replace(doc, "    groups: [dev]\n", "    upstreams:\n      - server: build\n", 1), false)
+	if !strings.Contains(out, "~ downstream alice") {
+		t.Errorf("expected membership change, got %v", out)
+	}
+
+	var members int64
+	if err := p.db.Model(&groupMember{}).Count(&members).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if members != 0 {
+		t.Errorf("expected membership removed, got %v", members)
+	}
+}
+
+func TestImportJumpChains(t *testing.T) {
+	p := newTestPlugin(t)
+
+	doc := `
+servers:
+  - name: db
+    address: db.internal:22
+    ignore_host_key: true
+    via: bastion
+  - name: bastion
+    address: bastion:22
+    ignore_host_key: true
+    jump_username: ops
+    jump_password: secret
+downstreams:
+  - username: alice
+    upstreams:
+      - server: db
+`
+
+	importTestTable(t, p, doc, false)
+
+	if out := importTestTable(t, p, doc, false); out != "0 changes\n" {
+		t.Errorf("expected import to be idempotent, got %v", out)
+	}
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 1 || len(pipes[0].Via) != 1 || pipes[0].Via[0].Address != "bastion:22" || pipes[0].Via[0].Username != "ops" || pipes[0].Via[0].Password != "secret" {
+		t.Errorf("unexpected pipes %+v", pipes)
+	}
+
+	for _, via := range []string{"nowhere", "db"} {
+		table := routingTable{}
+		if err := yaml.Unmarshal([]byte(strings.Replace(doc, "    jump_username: ops\n", "    jump_username: ops\n    via: "+via+"\n", 1)), &table); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.importRoutingTable(p.db, &table, true, io.Discard); err == nil {
+			t.Errorf("expected jump server %v to be rejected", via)
+		}
+	}
+}
+
+func TestImportHashesDownstreamPassword(t *testing.T) {
+	p := newTestPlugin(t)
+
+	doc := `
+servers:
+  - name: build
+    address: build:22
+    ignore_host_key: true
+downstreams:
+  - username: alice
+    password: hunter2
+    upstreams:
+      - server: build
+`
+
+	importTestTable(t, p, doc, false)
+
+	d := downstream{}
+	if err := p.db.Where(&downstream{Username: "alice"}).First(&d).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(d.Password, "$2") {
+		t.Errorf("expected the imported password to be stored as bcrypt hash, got %v", d.Password)
+	}
+
+	if ok, err := verifyPassword(d.Password, []byte("hunter2"), false); err != nil || !ok {
+		t.Errorf("expected the stored hash to verify, got %v, %v", ok, err)
+	}
+
+	if out := importTestTable(t, p, doc, false); out != "0 changes\n" {
+		t.Errorf("expected plaintext password to match its hash, got %v", out)
+	}
+
+	if out := importTestTable(t, p, strings.Replace(doc, "hunter2", "changed", 1), false); !strings.Contains(out, "~ downstream alice") {
+		t.Errorf("expected password change, got %v", out)
+	}
+}
+
+func TestImportEncryptedExport(t *testing.T) {
+	key := testEncryptionKey(t, "k1")
+
+	newEncryptedPlugin := func() *plugin {
+		p := newTestPlugin(t)
+
+		keyring, err := loadKeyring("", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p.keyring = keyring
+
+		return p
+	}
+
+	src := newEncryptedPlugin()
+	importTestTable(t, src, testRoutingTable, false)
+
+	exported, err := src.exportRoutingTable(src.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := yaml.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), "password: pass\n") {
+		t.Errorf("expected upstream password to be exported encrypted, got %v", string(data))
+	}
+
+	if out := importTestTable(t, src, string(data), false); out != "0 changes\n" {
+		t.Errorf("expected export to import without changes, got %v", out)
+	}
+
+	// rows get other ids in another database
+	dst := newEncryptedPlugin()
+	if err := dst.db.Create(&upstream{Server: server{Address: "other:22"}}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	importTestTable(t, dst, string(data), false)
+
+	pipes, err := dst.loadPipeFromDB(&testConn{user: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range pipes {
+		if err := dst.decryptPipe(&pipes[i]); err != nil {
+			t.Fatal(err)
+		}
+
+		if pipes[i].UpstreamHost == "primary:2222" && pipes[i].ToPassword != "pass" {
+			t.Errorf("expected imported password, got %v", pipes[i].ToPassword)
+		}
+	}
+}
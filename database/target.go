@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tg123/sshpiper/libplugin"
+	"gorm.io/gorm"
+)
+
+// errTargetSelectionRequired holds back the upstream of an accepted login, the target is picked by keyboard-interactive next
+var errTargetSelectionRequired = errors.New("credentials accepted, target selection required")
+
+var errNoTargetSelection = errors.New("keyboard-interactive is only used to select a target after login")
+
+// errPublicKeyTargetRequired rejects a public key login that would need the target menu, the
+// public key callback also runs for unsigned queries and cannot hold back a verified login
+var errPublicKeyTargetRequired = errors.New("public key logins must name their target as user+target")
+
+// maxTargetPrompts is how often an invalid answer to the target menu is asked again
+const maxTargetPrompts = 3
+
+// pendingLogin keeps the accepted password of a downstream until its target is selected
+type pendingLogin struct {
+	password []byte
+}
+
+// resolveLogin returns the upstream candidates of the login user, limited to the target
+// named by user+target or picked from the target menu
+func (p *plugin) resolveLogin(conn libplugin.ConnMetadata) ([]pipeConfig, error) {
+	login := conn.User()
+
+	if sep := p.targetSeparator; sep != "" {
+		if i := strings.LastIndex(login, sep); i > 0 {
+			user, target := login[:i], login[i+len(sep):]
+
+			pipes, err := p.cachedPipes(user)
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, err
+			}
+
+			// otherwise the separator is part of the username
+			if selected := withTarget(pipes, target); len(selected) > 0 {
+				return selected, nil
+			}
+		}
+	}
+
+	pipes, err := p.cachedPipes(login)
+	if err != nil {
+		return nil, err
+	}
+
+	if item, found := p.targets.Get(conn.UniqueID()); found {
+		selected := withTarget(pipes, item.(string))
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("target %v of %v no longer exists", item, login)
+		}
+
+		return selected, nil
+	}
+
+	return pipes, nil
+}
+
+// withTarget returns a copy of the candidates of target
+func withTarget(pipes []pipeConfig, target string) []pipeConfig {
+	var selected []pipeConfig
+
+	for _, pipe := range pipes {
+		if pipe.Target == target {
+			selected = append(selected, pipe)
+		}
+	}
+
+	return selected
+}
+
+// targetNames returns the distinct non-empty targets of pipes, sorted so the menu does not
+// change with the weighted order of the candidates
+func targetNames(pipes []pipeConfig) []string {
+	var names []string
+	seen := map[string]bool{}
+
+	for _, pipe := range pipes {
+		if pipe.Target == "" || seen[pipe.Target] {
+			continue
+		}
+
+		seen[pipe.Target] = true
+		names = append(names, pipe.Target)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// needsTargetMenu reports whether the downstream has several targets and has not picked one yet
+func (p *plugin) needsTargetMenu(conn libplugin.ConnMetadata) (bool, error) {
+	if !p.targetMenu {
+		return false, nil
+	}
+
+	if _, found := p.targets.Get(conn.UniqueID()); found {
+		return false, nil
+	}
+
+	pipes, err := p.loadPipeFromDB(conn)
+	if err != nil {
+		return false, err
+	}
+
+	return len(targetNames(pipes)) >= 2, nil
+}
+
+// deferToTargetMenu holds back an accepted password login if the downstream has several targets to pick from
+func (p *plugin) deferToTargetMenu(conn libplugin.ConnMetadata, password []byte) (bool, error) {
+	needed, err := p.needsTargetMenu(conn)
+	if err != nil || !needed {
+		return false, err
+	}
+
+	p.pendingLogins.SetDefault(conn.UniqueID(), pendingLogin{
+		password: bytes.Clone(password),
+	})
+
+	return true, nil
+}
+
+// checkPublicKeyTarget rejects a public key login that would need the target menu
+func (p *plugin) checkPublicKeyTarget(conn libplugin.ConnMetadata) error {
+	needed, err := p.needsTargetMenu(conn)
+	if err != nil {
+		return err
+	}
+
+	if needed {
+		return errPublicKeyTargetRequired
+	}
+
+	return nil
+}
+
+// targetMenuPending reports whether conn logged in and waits for the target menu
+func (p *plugin) targetMenuPending(conn libplugin.ConnMetadata) bool {
+	if !p.targetMenu {
+		return false
+	}
+
+	_, found := p.pendingLogins.Get(conn.UniqueID())
+	return found
+}
+
+// selectTarget asks the downstream for one of its targets and completes the login
+// held back by deferToTargetMenu with password
+func (p *plugin) selectTarget(
+	conn libplugin.ConnMetadata,
+	client libplugin.KeyboardInteractiveChallenge,
+	password func(libplugin.ConnMetadata, []byte) (*libplugin.Upstream, error),
+) (*libplugin.Upstream, error) {
+	item, found := p.pendingLogins.Get(conn.UniqueID())
+	if !found {
+		return nil, errNoTargetSelection
+	}
+
+	pending := item.(pendingLogin)
+
+	pipes, err := p.loadPipeFromDB(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	names := targetNames(pipes)
+
+	var menu strings.Builder
+	menu.WriteString("Select a target:\n")
+	for i, name := range names {
+		fmt.Fprintf(&menu, "  %v) %v\n", i+1, name)
+	}
+
+	for range maxTargetPrompts {
+		answer, err := client(conn.User(), menu.String(), "Target: ", true)
+		if err != nil {
+			return nil, err
+		}
+
+		target, ok := pickTarget(names, answer)
+		if !ok {
+			continue
+		}
+
+		p.targets.SetDefault(conn.UniqueID(), target)
+		p.pendingLogins.Delete(conn.UniqueID())
+
+		return password(conn, pending.password)
+	}
+
+	return nil, fmt.Errorf("no valid target selected by %v", conn.User())
+}
+
+// pickTarget accepts a target by its number in the menu or by name
+func pickTarget(names []string, answer string) (string, bool) {
+	answer = strings.TrimSpace(answer)
+
+	if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(names) {
+		return names[n-1], true
+	}
+
+	for _, name := range names {
+		if name == answer {
+			return name, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tg123/sshpiper/libplugin"
+)
+
+func newTargetTestPlugin(t *testing.T) *plugin {
+	p := newTestPlugin(t)
+
+	if err := p.db.Create(&downstream{
+		Username: "bob",
+		Upstream: upstream{Server: server{Name: "web", Address: "web:22"}},
+		Routes: []route{
+			{Upstream: upstream{Name: "db", Username: "dba", Server: server{Name: "db1", Address: "db1:22"}}},
+			{Upstream: upstream{Name: "db", Username: "dba", Server: server{Name: "db2", Address: "db2:22"}}, Priority: 1},
+		},
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestLoginTargetSeparator(t *testing.T) {
+	p := newTargetTestPlugin(t)
+	p.targetSeparator = "+"
+
+	pipes, err := p.loadPipeFromDB(&testConn{user: "bob+db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 2 || pipes[0].UpstreamHost != "db1:22" || pipes[1].UpstreamHost != "db2:22" {
+		t.Errorf("expected both db candidates, got %+v", pipes)
+	}
+
+	pipes, err = p.loadPipeFromDB(&testConn{user: "bob+web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 1 || pipes[0].UpstreamHost != "web:22" || pipes[0].MappedUsername != "bob" {
+		t.Errorf("expected web candidate as bob, got %+v", pipes)
+	}
+
+	if _, err := p.loadPipeFromDB(&testConn{user: "bob+mail"}); err == nil {
+		t.Errorf("expected unknown target to fail")
+	}
+}
+
+func TestTargetMenu(t *testing.T) {
+	p := newTargetTestPlugin(t)
+	p.targetMenu = true
+
+	conn := &testConn{user: "bob", uniqueID: "1"}
+
+	deferred, err := p.deferToTargetMenu(conn, []byte("secret"))
+	if err != nil || !deferred {
+		t.Fatalf("expected login to wait for the target menu: %v", err)
+	}
+
+	if !p.targetMenuPending(conn) {
+		t.Errorf("expected target menu to be pending")
+	}
+
+	var answers []string
+	client := func(user, instruction, question string, echo bool) (string, error) {
+		answer := []string{"9", "1"}[len(answers)]
+		answers = append(answers, answer)
+		return answer, nil
+	}
+
+	var completed []byte
+	password := func(conn libplugin.ConnMetadata, password []byte) (*libplugin.Upstream, error) {
+		completed = password
+		return &libplugin.Upstream{}, nil
+	}
+
+	if _, err := p.selectTarget(conn, client, password); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(answers) != 2 || string(completed) != "secret" {
+		t.Errorf("expected invalid answer to be asked again and the login completed, got %v %q", answers, completed)
+	}
+
+	pipes, err := p.loadPipeFromDB(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pipes) != 2 || pipes[0].Target != "db" {
+		t.Errorf("expected db candidates, got %+v", pipes)
+	}
+
+	if deferred, _ := p.deferToTargetMenu(conn, nil); deferred {
+		t.Errorf("expected no menu once a target is selected")
+	}
+
+	if _, err := p.selectTarget(&testConn{user: "bob", uniqueID: "2"}, client, password); err == nil {
+		t.Errorf("expected target menu without login to fail")
+	}
+}
+
+func TestTargetMenuRejectsPublicKey(t *testing.T) {
+	p := newTargetTestPlugin(t)
+	p.targetMenu = true
+	p.targetSeparator = "+"
+
+	// the public key callback also runs for unsigned queries, a key must not be held back for the menu
+	conn := &testConn{user: "bob", uniqueID: "1"}
+
+	if err := p.checkPublicKeyTarget(conn); err != errPublicKeyTargetRequired {
+		t.Errorf("expected public key login without target to be rejected, got %v", err)
+	}
+
+	if p.targetMenuPending(conn) {
+		t.Errorf("expected no target menu after a public key query")
+	}
+
+	client := func(user, instruction, question string, echo bool) (string, error) {
+		return "1", nil
+	}
+
+	password := func(conn libplugin.ConnMetadata, password []byte) (*libplugin.Upstream, error) {
+		return &libplugin.Upstream{}, nil
+	}
+
+	if _, err := p.selectTarget(conn, client, password); err != errNoTargetSelection {
+		t.Errorf("expected target menu after a public key query to fail, got %v", err)
+	}
+
+	if err := p.checkPublicKeyTarget(&testConn{user: "bob+db", uniqueID: "2"}); err != nil {
+		t.Errorf("expected public key login naming its target to pass: %v", err)
+	}
+}
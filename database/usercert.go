@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/tg123/sshpiper/libplugin"
+	"golang.org/x/crypto/ssh"
+)
+
+// presentedKey is the public key a downstream authenticates with, recorded
+// so AuthorizedKeys can accept it when the downstream allows any public key
+// or the key comes from an already verified user certificate
+type presentedKey struct {
+	key       ssh.PublicKey
+	certified bool
+}
+
+// acceptPublicKey records the key presented by downstream. User certificates are
+// verified against the trusted CA keys and allowed principals of the downstream, and
+// the certified key is returned so skel can match it like a plain public key.
+func (p *plugin) acceptPublicKey(conn libplugin.ConnMetadata, key []byte) ([]byte, error) {
+	pub, err := ssh.ParsePublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		p.pubkeys.SetDefault(conn.UniqueID(), presentedKey{key: pub})
+		return key, nil
+	}
+
+	pipes, err := p.loadPipeFromDB(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !pipes[0].FromAllowAnyPublicKey {
+		if err := verifyUserCert(cert, &pipes[0], conn.User(), conn.RemoteAddr()); err != nil {
+			return nil, err
+		}
+	}
+
+	p.pubkeys.SetDefault(conn.UniqueID(), presentedKey{key: cert.Key, certified: true})
+
+	return cert.Key.Marshal(), nil
+}
+
+// sourceAddressOption is the critical option limiting the client addresses a certificate is valid from
+const sourceAddressOption = "source-address"
+
+func verifyUserCert(cert *ssh.Certificate, pipe *pipeConfig, user, remoteAddr string) error {
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("only user certificates are supported, cert type: %v", cert.CertType)
+	}
+
+	var cas []ssh.PublicKey
+
+	rest := []byte(strings.TrimSpace(pipe.FromTrustedUserCAKeys.Data))
+	for len(rest) > 0 {
+		ca, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return fmt.Errorf("failed to parse trusted user ca keys: %w", err)
+		}
+
+		cas = append(cas, ca)
+		rest = next
+	}
+
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, ca := range cas {
+				if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+
+			return false
+		},
+	}
+
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return fmt.Errorf("certificate signed by unrecognized authority")
+	}
+
+	// CheckCert below rejects critical options other than source-address, which is left to
+	// the caller and checked here as sshpiperd only gets the certified key
+	if err := checkCertSource(cert, remoteAddr); err != nil {
+		return err
+	}
+
+	principals := pipe.FromAllowedPrincipals
+	if len(principals) == 0 {
+		principals = []string{user}
+	}
+
+	var err error
+	for _, principal := range principals {
+		err = checker.CheckCert(principal, cert)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// checkCertSource enforces the source-address critical option of cert against the client address
+func checkCertSource(cert *ssh.Certificate, remoteAddr string) error {
+	list, ok := cert.CriticalOptions[sourceAddressOption]
+	if !ok {
+		return nil
+	}
+
+	allowed, err := parseSourceList(list)
+	if err != nil {
+		return fmt.Errorf("certificate %v: %w", sourceAddressOption, err)
+	}
+
+	addr, err := sourceAddr(remoteAddr)
+	if err != nil {
+		return err
+	}
+
+	if !containsAddr(allowed, addr) {
+		return fmt.Errorf("certificate is not valid from %v", addr)
+	}
+
+	return nil
+}
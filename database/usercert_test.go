@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestUserCert(t *testing.T, principals ...string) (*ssh.Certificate, ssh.PublicKey) {
+	return newTestUserCertWithOptions(t, nil, principals...)
+}
+
+func newTestUserCertWithOptions(t *testing.T, options map[string]string, principals ...string) (*ssh.Certificate, ssh.PublicKey) {
+	_, capriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ca key: %v", err)
+	}
+
+	casigner, err := ssh.NewSignerFromKey(capriv)
+	if err != nil {
+		t.Fatalf("failed to create ca signer: %v", err)
+	}
+
+	userpub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate user key: %v", err)
+	}
+
+	key, err := ssh.NewPublicKey(userpub)
+	if err != nil {
+		t.Fatalf("failed to convert user key: %v", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions:     ssh.Permissions{CriticalOptions: options},
+	}
+
+	if err := cert.SignCert(rand.Reader, casigner); err != nil {
+		t.Fatalf("failed to sign cert: %v", err)
+	}
+
+	return cert, casigner.PublicKey()
+}
+
+func TestVerifyUserCert(t *testing.T) {
+	cert, ca := newTestUserCert(t, "alice")
+	_, otherca := newTestUserCert(t)
+
+	trusted := keydata{Data: string(ssh.MarshalAuthorizedKey(otherca)) + string(ssh.MarshalAuthorizedKey(ca))}
+
+	if err := verifyUserCert(cert, &pipeConfig{FromTrustedUserCAKeys: trusted}, "alice", "192.0.2.1:22"); err != nil {
+		t.Errorf("cert for login user should be accepted: %v", err)
+	}
+
+	if err := verifyUserCert(cert, &pipeConfig{FromTrustedUserCAKeys: trusted}, "bob", "192.0.2.1:22"); err == nil {
+		t.Errorf("cert without login user principal should be rejected")
+	}
+
+	if err := verifyUserCert(cert, &pipeConfig{
+		FromTrustedUserCAKeys: trusted,
+		FromAllowedPrincipals: []string{"admins", "alice"},
+	}, "deploy", "192.0.2.1:22"); err != nil {
+		t.Errorf("cert with allowed principal should be accepted: %v", err)
+	}
+
+	if err := verifyUserCert(cert, &pipeConfig{
+		FromTrustedUserCAKeys: keydata{Data: string(ssh.MarshalAuthorizedKey(otherca))},
+	}, "alice", "192.0.2.1:22"); err == nil {
+		t.Errorf("cert signed by untrusted ca should be rejected")
+	}
+}
+
+func TestVerifyUserCertCriticalOptions(t *testing.T) {
+	cert, ca := newTestUserCertWithOptions(t, map[string]string{"source-address": "10.0.0.0/8,192.0.2.1"}, "alice")
+	pipe := &pipeConfig{FromTrustedUserCAKeys: keydata{Data: string(ssh.MarshalAuthorizedKey(ca))}}
+
+	for _, addr := range []string{"10.1.2.3:50000", "192.0.2.1:22"} {
+		if err := verifyUserCert(cert, pipe, "alice", addr); err != nil {
+			t.Errorf("cert should be accepted from %v: %v", addr, err)
+		}
+	}
+
+	if err := verifyUserCert(cert, pipe, "alice", "198.51.100.7:50000"); err == nil {
+		t.Errorf("cert should be rejected from outside its source-address")
+	}
+
+	cert, ca = newTestUserCertWithOptions(t, map[string]string{"force-command": "/bin/true"}, "alice")
+	pipe = &pipeConfig{FromTrustedUserCAKeys: keydata{Data: string(ssh.MarshalAuthorizedKey(ca))}}
+
+	if err := verifyUserCert(cert, pipe, "alice", "10.1.2.3:50000"); err == nil {
+		t.Errorf("cert with an unsupported critical option should be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+type usernameMapping int
+
+const (
+	// the upstream username if set, the downstream username otherwise
+	usernameMappingAuto = iota
+	// the downstream username, for upstreams shared by users logging in as themselves
+	usernameMappingKeep
+	// the upstream username as is
+	usernameMappingFixed
+	// the upstream username rendered as text/template with .Username, see usernameFuncs
+	usernameMappingTemplate
+)
+
+// usernameFuncs transform the downstream username in templates, e.g. "{{.Username | stripDomain | lower}}"
+var usernameFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"stripDomain": func(s string) string {
+		if i := strings.LastIndex(s, "@"); i >= 0 {
+			s = s[:i]
+		}
+
+		if i := strings.LastIndex(s, `\`); i >= 0 {
+			s = s[i+1:]
+		}
+
+		return s
+	},
+}
+
+func parseUsernameTemplate(text string) (*template.Template, error) {
+	t, err := template.New("username").Funcs(usernameFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream username template: %w", err)
+	}
+
+	return t, nil
+}
+
+func validateUsernameMapping(mapping usernameMapping, username string) error {
+	switch mapping {
+	case usernameMappingFixed:
+		if username == "" {
+			return fmt.Errorf("upstream username mapping fixed requires an upstream username")
+		}
+	case usernameMappingTemplate:
+		if _, err := parseUsernameTemplate(username); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mapUsername returns the upstream username of u for the downstream username user
+func mapUsername(u *upstream, user string, m *userMatch) (string, error) {
+	switch u.UsernameMapping {
+	case usernameMappingKeep:
+		return user, nil
+	case usernameMappingFixed:
+		return m.expand(u.Username), nil
+	case usernameMappingTemplate:
+		t, err := parseUsernameTemplate(u.Username)
+		if err != nil {
+			return "", err
+		}
+
+		var b strings.Builder
+		if err := t.Execute(&b, struct{ Username string }{user}); err != nil {
+			return "", fmt.Errorf("upstream username template: %w", err)
+		}
+
+		if b.Len() == 0 {
+			return "", fmt.Errorf("upstream username template %q is empty for %v", u.Username, user)
+		}
+
+		return b.String(), nil
+	default:
+		return withDefault(m.expand(u.Username), user), nil
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMapUsername(t *testing.T) {
+	for _, tc := range []struct {
+		mapping  usernameMapping
+		username string
+		user     string
+		expected string
+	}{
+		{usernameMappingAuto, "", "bob", "bob"},
+		{usernameMappingAuto, "app", "bob", "app"},
+		{usernameMappingKeep, "app", "bob", "bob"},
+		{usernameMappingFixed, "app", "bob", "app"},
+		{usernameMappingTemplate, "adm-{{.Username}}", "bob", "adm-bob"},
+		{usernameMappingTemplate, "{{.Username | stripDomain | lower}}", "Bob@corp.example", "bob"},
+		{usernameMappingTemplate, `{{.Username | stripDomain}}`, `CORP\bob`, "bob"},
+		{usernameMappingTemplate, `{{.Username | trimSuffix "-admin"}}`, "bob-admin", "bob"},
+	} {
+		mapped, err := mapUsername(&upstream{Username: tc.username, UsernameMapping: tc.mapping}, tc.user, nil)
+		if err != nil || mapped != tc.expected {
+			t.Errorf("%v %q of %v: expected %v, got %v, %v", usernameMappingNames[tc.mapping], tc.username, tc.user, tc.expected, mapped, err)
+		}
+	}
+
+	if err := validateUsernameMapping(usernameMappingFixed, ""); err == nil {
+		t.Errorf("expected fixed mapping without username to fail")
+	}
+
+	if err := validateUsernameMapping(usernameMappingTemplate, "{{.Username"); err == nil {
+		t.Errorf("expected invalid template to fail")
+	}
+}
+
+func TestSharedUpstreamKeepsDownstreamUsername(t *testing.T) {
+	p := newTestPlugin(t)
+
+	shared := upstream{
+		Username:        "{{.Username | lower}}",
+		UsernameMapping: usernameMappingTemplate,
+		Server:          server{Address: "shared:22"},
+	}
+
+	if err := p.db.Create(&shared).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"Alice", "Bob"} {
+		if err := p.db.Create(&downstream{Username: user, UpstreamID: int(shared.ID)}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for user, expected := range map[string]string{"Alice": "alice", "Bob": "bob"} {
+		pipes, err := p.loadPipeFromDB(&testConn{user: user})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pipes[0].MappedUsername != expected {
+			t.Errorf("%v: expected upstream username %v, got %v", user, expected, pipes[0].MappedUsername)
+		}
+	}
+}